@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sync"
+	"github.com/spf13/pflag"
+	"io"
+	"encoding/ascii85"
+	"github.com/tehmoon/errors"
+)
+
+func init() {
+	MODULELIST.Register("ascii85", "Ascii85 decode or encode", NewAscii85)
+}
+
+type Ascii85 struct {
+	decode bool
+	encode bool
+}
+
+func (m Ascii85) Init(in, out chan *Message, global *GlobalFlags) (error) {
+	if (m.decode && m.encode) || (! m.decode && ! m.encode) {
+		return errors.Errorf("One of %q and %q is required", "encode", "decode")
+	}
+
+	go func(in, out chan *Message) {
+		wg := &sync.WaitGroup{}
+
+		init := false
+		mc := NewMessageChannel()
+
+		out <- &Message{
+			Type: MessageTypeChannel,
+			Interface: mc.Callback,
+		}
+
+		LOOP: for message := range in {
+			switch message.Type {
+				case MessageTypeTerminate:
+					if ! init {
+						close(mc.Channel)
+					}
+					wg.Wait()
+					out <- message
+					break LOOP
+				case MessageTypeChannel:
+					cb, ok := message.Interface.(MessageChannelFunc)
+					if ok {
+						if ! init {
+							init = true
+						} else {
+							mc = NewMessageChannel()
+
+							out <- &Message{
+								Type: MessageTypeChannel,
+								Interface: mc.Callback,
+							}
+						}
+
+						wg.Add(1)
+						if m.decode {
+							go startAscii85Decode(cb, mc, wg)
+						} else if m.encode {
+							go startAscii85Encode(cb, mc, wg)
+						}
+
+						if ! global.MultiStreams {
+							if ! init {
+								close(mc.Channel)
+							}
+							wg.Wait()
+							out <- &Message{Type: MessageTypeTerminate,}
+							break LOOP
+						}
+					}
+			}
+		}
+
+		wg.Wait()
+		// Last message will signal the closing of the channel
+		<- in
+		close(out)
+	}(in, out)
+
+	return nil
+}
+
+func startAscii85Decode(cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	StartCodecDecode("ascii85", cb, mc, wg, func(r io.Reader) (io.Reader, error) {
+		return ascii85.NewDecoder(r), nil
+	})
+}
+
+func startAscii85Encode(cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	StartCodecEncode("ascii85", cb, mc, wg, func(w io.Writer) (io.WriteCloser, error) {
+		return ascii85.NewEncoder(w), nil
+	})
+}
+
+func NewAscii85() (Module) {
+	return &Ascii85{}
+}
+
+func (m *Ascii85) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.BoolVar(&m.decode, "decode", false, "Ascii85 decode")
+	fs.BoolVar(&m.encode, "encode", false, "Ascii85 encode")
+}
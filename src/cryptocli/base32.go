@@ -0,0 +1,123 @@
+package main
+
+import (
+	"sync"
+	"github.com/spf13/pflag"
+	"io"
+	"encoding/base32"
+	"github.com/tehmoon/errors"
+)
+
+func init() {
+	MODULELIST.Register("base32", "Base32 decode or encode", NewBase32)
+}
+
+type Base32 struct {
+	decode bool
+	encode bool
+	hex bool
+	raw bool
+}
+
+func (m Base32) Init(in, out chan *Message, global *GlobalFlags) (error) {
+	if (m.decode && m.encode) || (! m.decode && ! m.encode) {
+		return errors.Errorf("One of %q and %q is required", "encode", "decode")
+	}
+
+	go func(in, out chan *Message) {
+		wg := &sync.WaitGroup{}
+
+		init := false
+		mc := NewMessageChannel()
+
+		out <- &Message{
+			Type: MessageTypeChannel,
+			Interface: mc.Callback,
+		}
+
+		LOOP: for message := range in {
+			switch message.Type {
+				case MessageTypeTerminate:
+					if ! init {
+						close(mc.Channel)
+					}
+					wg.Wait()
+					out <- message
+					break LOOP
+				case MessageTypeChannel:
+					cb, ok := message.Interface.(MessageChannelFunc)
+					if ok {
+						if ! init {
+							init = true
+						} else {
+							mc = NewMessageChannel()
+
+							out <- &Message{
+								Type: MessageTypeChannel,
+								Interface: mc.Callback,
+							}
+						}
+
+						wg.Add(1)
+						if m.decode {
+							go startBase32Decode(m, cb, mc, wg)
+						} else if m.encode {
+							go startBase32Encode(m, cb, mc, wg)
+						}
+
+						if ! global.MultiStreams {
+							if ! init {
+								close(mc.Channel)
+							}
+							wg.Wait()
+							out <- &Message{Type: MessageTypeTerminate,}
+							break LOOP
+						}
+					}
+			}
+		}
+
+		wg.Wait()
+		// Last message will signal the closing of the channel
+		<- in
+		close(out)
+	}(in, out)
+
+	return nil
+}
+
+func (m Base32) encoding() (*base32.Encoding) {
+	encoding := base32.StdEncoding
+	if m.hex {
+		encoding = base32.HexEncoding
+	}
+
+	if m.raw {
+		encoding = encoding.WithPadding(base32.NoPadding)
+	}
+
+	return encoding
+}
+
+func startBase32Decode(m Base32, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	StartCodecDecode("base32", cb, mc, wg, func(r io.Reader) (io.Reader, error) {
+		return base32.NewDecoder(m.encoding(), r), nil
+	})
+}
+
+func startBase32Encode(m Base32, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	StartCodecEncode("base32", cb, mc, wg, func(w io.Writer) (io.WriteCloser, error) {
+		return base32.NewEncoder(m.encoding(), w), nil
+	})
+}
+
+func NewBase32() (Module) {
+	return &Base32{}
+}
+
+func (m *Base32) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.BoolVar(&m.decode, "decode", false, "Base32 decode")
+	fs.BoolVar(&m.encode, "encode", false, "Base32 encode")
+	fs.BoolVar(&m.hex, "hex", false, "Use the extended hex alphabet")
+	fs.BoolVar(&m.raw, "raw", false, "Don't use padding")
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"sync"
+	"github.com/spf13/pflag"
+	"github.com/tehmoon/errors"
+	"log"
+	"math/big"
+	"crypto/sha256"
+	"bytes"
+)
+
+func init() {
+	MODULELIST.Register("base58", "Base58 decode or encode", NewBase58)
+}
+
+type Base58 struct {
+	decode bool
+	encode bool
+	alphabet string
+	check bool
+}
+
+func (m Base58) Init(in, out chan *Message, global *GlobalFlags) (error) {
+	if (m.decode && m.encode) || (! m.decode && ! m.encode) {
+		return errors.Errorf("One of %q and %q is required", "encode", "decode")
+	}
+
+	switch m.alphabet {
+		case "bitcoin", "flickr":
+		default:
+			return errors.Errorf("Alphabet %q is not supported in base58 module", m.alphabet)
+	}
+
+	go func(in, out chan *Message) {
+		wg := &sync.WaitGroup{}
+
+		init := false
+		mc := NewMessageChannel()
+
+		out <- &Message{
+			Type: MessageTypeChannel,
+			Interface: mc.Callback,
+		}
+
+		LOOP: for message := range in {
+			switch message.Type {
+				case MessageTypeTerminate:
+					if ! init {
+						close(mc.Channel)
+					}
+					wg.Wait()
+					out <- message
+					break LOOP
+				case MessageTypeChannel:
+					cb, ok := message.Interface.(MessageChannelFunc)
+					if ok {
+						if ! init {
+							init = true
+						} else {
+							mc = NewMessageChannel()
+
+							out <- &Message{
+								Type: MessageTypeChannel,
+								Interface: mc.Callback,
+							}
+						}
+
+						wg.Add(1)
+						go startBase58(m, cb, mc, wg)
+
+						if ! global.MultiStreams {
+							if ! init {
+								close(mc.Channel)
+							}
+							wg.Wait()
+							out <- &Message{Type: MessageTypeTerminate,}
+							break LOOP
+						}
+					}
+			}
+		}
+
+		wg.Wait()
+		// Last message will signal the closing of the channel
+		<- in
+		close(out)
+	}(in, out)
+
+	return nil
+}
+
+const (
+	Base58AlphabetBitcoin = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+	Base58AlphabetFlickr = "123456789abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ"
+)
+
+// Base58 is a big number conversion so the whole input
+// has to be buffered before being encoded or decoded.
+func startBase58(m Base58, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	mc.Start(nil)
+	_, inc := cb()
+
+	outc := mc.Channel
+	defer close(outc)
+
+	buff := bytes.NewBuffer(make([]byte, 0))
+	for payload := range inc {
+		buff.Write(payload)
+	}
+
+	alphabet := Base58AlphabetBitcoin
+	if m.alphabet == "flickr" {
+		alphabet = Base58AlphabetFlickr
+	}
+
+	if m.encode {
+		data := buff.Bytes()
+		if m.check {
+			data = append(data, Base58Checksum(data)...)
+		}
+
+		outc <- Base58Encode(alphabet, data)
+		return
+	}
+
+	data, err := Base58Decode(alphabet, bytes.TrimSpace(buff.Bytes()))
+	if err != nil {
+		err = errors.Wrap(err, "Error decoding base58")
+		log.Println(err.Error())
+		return
+	}
+
+	if m.check {
+		if len(data) < 4 {
+			log.Println("Base58check data is too short")
+			return
+		}
+
+		payload, checksum := data[:len(data) - 4], data[len(data) - 4:]
+		if ! bytes.Equal(checksum, Base58Checksum(payload)) {
+			log.Println("Base58check checksum mismatch")
+			return
+		}
+
+		data = payload
+	}
+
+	outc <- data
+}
+
+// First 4 bytes of the double sha256 of the payload
+func Base58Checksum(payload []byte) ([]byte) {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+
+	return second[:4]
+}
+
+// Each leading zero byte is encoded as the first character of the alphabet
+func Base58Encode(alphabet string, data []byte) ([]byte) {
+	zeros := 0
+	for zeros < len(data) && data[zeros] == 0 {
+		zeros++
+	}
+
+	n := new(big.Int).SetBytes(data)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+
+	encoded := make([]byte, 0, len(data) * 138 / 100 + 1)
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		encoded = append(encoded, alphabet[mod.Int64()])
+	}
+
+	for i := 0; i < zeros; i++ {
+		encoded = append(encoded, alphabet[0])
+	}
+
+	for i, j := 0, len(encoded) - 1; i < j; i, j = i + 1, j - 1 {
+		encoded[i], encoded[j] = encoded[j], encoded[i]
+	}
+
+	return encoded
+}
+
+func Base58Decode(alphabet string, data []byte) ([]byte, error) {
+	var table [256]int
+	for i := range table {
+		table[i] = -1
+	}
+
+	for i := 0; i < len(alphabet); i++ {
+		table[alphabet[i]] = i
+	}
+
+	zeros := 0
+	for zeros < len(data) && data[zeros] == alphabet[0] {
+		zeros++
+	}
+
+	n := new(big.Int)
+	radix := big.NewInt(58)
+
+	for _, c := range data[zeros:] {
+		v := table[c]
+		if v < 0 {
+			return nil, errors.Errorf("Illegal base58 character %q", c)
+		}
+
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(v)))
+	}
+
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
+
+func NewBase58() (Module) {
+	return &Base58{}
+}
+
+func (m *Base58) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.BoolVar(&m.decode, "decode", false, "Base58 decode")
+	fs.BoolVar(&m.encode, "encode", false, "Base58 encode")
+	fs.StringVar(&m.alphabet, "alphabet", "bitcoin", "Alphabet to use: bitcoin or flickr")
+	fs.BoolVar(&m.check, "check", false, "Use base58check, append a 4 bytes checksum when encoding and verify it when decoding")
+}
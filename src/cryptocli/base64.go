@@ -5,7 +5,6 @@ import (
 	"github.com/spf13/pflag"
 	"io"
 	"encoding/base64"
-	"log"
 	"github.com/tehmoon/errors"
 )
 
@@ -16,6 +15,8 @@ func init() {
 type Base64 struct {
 	decode bool
 	encode bool
+	url bool
+	raw bool
 }
 
 func (m Base64) Init(in, out chan *Message, global *GlobalFlags) (error) {
@@ -57,10 +58,11 @@ func (m Base64) Init(in, out chan *Message, global *GlobalFlags) (error) {
 							}
 						}
 
+						wg.Add(1)
 						if m.decode {
-							go startBase64Decode(cb, mc, wg)
+							go startBase64Decode(m, cb, mc, wg)
 						} else if m.encode {
-							go startBase64Encode(cb, mc, wg)
+							go startBase64Encode(m, cb, mc, wg)
 						}
 
 						if ! global.MultiStreams {
@@ -84,80 +86,29 @@ func (m Base64) Init(in, out chan *Message, global *GlobalFlags) (error) {
 	return nil
 }
 
-func startBase64Decode(cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
-	reader, writer := io.Pipe()
-	b64 := base64.NewDecoder(base64.StdEncoding, reader)
-
-	mc.Start(nil)
-	_, inc := cb()
-
-	outc := mc.Channel
-
-	wg.Add(2)
-	go func() {
-		for payload := range inc {
-			_, err := writer.Write(payload)
-			if err != nil {
-				err = errors.Wrap(err, "Error writing data to pipe in base64")
-				log.Println(err.Error())
-				break
-			}
-		}
-
-		writer.Close()
-		DrainChannel(inc, nil)
-		wg.Done()
-	}()
+func (m Base64) encoding() (*base64.Encoding) {
+	encoding := base64.StdEncoding
+	if m.url {
+		encoding = base64.URLEncoding
+	}
 
-	go func() {
-		err := ReadBytesSendMessages(b64, outc)
-		if err != nil {
-			err = errors.Wrap(err, "Error reading base64 reader in base64")
-			log.Println(err.Error())
-		}
+	if m.raw {
+		encoding = encoding.WithPadding(base64.NoPadding)
+	}
 
-		close(outc)
-		wg.Done()
-	}()
+	return encoding
 }
 
-func startBase64Encode(cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
-	reader, writer := io.Pipe()
-
-	mc.Start(nil)
-	_, inc := cb()
-
-	outc := mc.Channel
-
-	wg.Add(2)
-	go func() {
-		b64w := base64.NewEncoder(base64.StdEncoding, writer)
-
-		for payload := range inc {
-			_, err := b64w.Write(payload)
-			if err != nil {
-				break
-			}
-		}
-
-		b64w.Close()
-		writer.Close()
-
-		DrainChannel(inc, nil)
-		wg.Done()
-	}()
-
-	go func() {
-		err := ReadBytesSendMessages(reader, outc)
-		if err != nil {
-			err = errors.Wrap(err, "Errors in base64 encode")
-			log.Println(err.Error())
-		}
+func startBase64Decode(m Base64, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	StartCodecDecode("base64", cb, mc, wg, func(r io.Reader) (io.Reader, error) {
+		return base64.NewDecoder(m.encoding(), r), nil
+	})
+}
 
-		reader.Close()
-		close(outc)
-		wg.Done()
-	}()
+func startBase64Encode(m Base64, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	StartCodecEncode("base64", cb, mc, wg, func(w io.Writer) (io.WriteCloser, error) {
+		return base64.NewEncoder(m.encoding(), w), nil
+	})
 }
 
 func NewBase64() (Module) {
@@ -167,4 +118,6 @@ func NewBase64() (Module) {
 func (m *Base64) SetFlagSet(fs *pflag.FlagSet, args []string) {
 	fs.BoolVar(&m.decode, "decode", false, "Base64 decode")
 	fs.BoolVar(&m.encode, "encode", false, "Base64 encode")
+	fs.BoolVar(&m.url, "url", false, "Use the URL and filename safe alphabet")
+	fs.BoolVar(&m.raw, "raw", false, "Don't use padding")
 }
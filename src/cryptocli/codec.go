@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"github.com/tehmoon/errors"
+	"log"
+)
+
+// Encode the incoming channel using the writer returned by newEncoder.
+// The encoder writes to an io.Pipe which is read in messages so the encoder
+// handles crumbs across message boundaries.
+func StartCodecEncode(name string, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup, newEncoder func(io.Writer) (io.WriteCloser, error)) {
+	defer wg.Done()
+
+	reader, writer := io.Pipe()
+
+	mc.Start(nil)
+	_, inc := cb()
+
+	outc := mc.Channel
+
+	syn := &sync.WaitGroup{}
+	syn.Add(2)
+
+	go func() {
+		defer syn.Done()
+		defer DrainChannel(inc, nil)
+
+		encoder, err := newEncoder(writer)
+		if err != nil {
+			err = errors.Wrapf(err, "Error initializing encoder in %s", name)
+			log.Println(err.Error())
+			writer.CloseWithError(err)
+			return
+		}
+
+		for payload := range inc {
+			_, err := encoder.Write(payload)
+			if err != nil {
+				err = errors.Wrapf(err, "Error encoding data in %s", name)
+				log.Println(err.Error())
+				writer.CloseWithError(err)
+				return
+			}
+		}
+
+		err = encoder.Close()
+		if err != nil {
+			err = errors.Wrapf(err, "Error encoding data in %s", name)
+			log.Println(err.Error())
+			writer.CloseWithError(err)
+			return
+		}
+
+		writer.Close()
+	}()
+
+	go func() {
+		defer syn.Done()
+		defer close(outc)
+
+		err := ReadBytesSendMessages(reader, outc)
+		if err != nil && err != io.EOF {
+			reader.CloseWithError(err)
+			return
+		}
+
+		reader.Close()
+	}()
+
+	syn.Wait()
+}
+
+// Decode the incoming channel using the reader returned by newDecoder.
+// If the decoder fails, the pipe is closed so the writing side stops.
+func StartCodecDecode(name string, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup, newDecoder func(io.Reader) (io.Reader, error)) {
+	defer wg.Done()
+
+	reader, writer := io.Pipe()
+
+	mc.Start(nil)
+	_, inc := cb()
+
+	outc := mc.Channel
+
+	syn := &sync.WaitGroup{}
+	syn.Add(2)
+
+	go func() {
+		defer syn.Done()
+		defer DrainChannel(inc, nil)
+
+		for payload := range inc {
+			_, err := writer.Write(payload)
+			if err != nil {
+				break
+			}
+		}
+
+		writer.Close()
+	}()
+
+	go func() {
+		defer syn.Done()
+		defer close(outc)
+
+		decoder, err := newDecoder(reader)
+		if err != nil {
+			err = errors.Wrapf(err, "Error initializing decoder in %s", name)
+			log.Println(err.Error())
+			reader.CloseWithError(err)
+			return
+		}
+
+		// Some decoders hold goroutines and buffers until closed
+		if closer, ok := decoder.(io.Closer); ok {
+			defer closer.Close()
+		}
+
+		err = ReadBytesSendMessages(decoder, outc)
+		if err != nil && err != io.EOF {
+			err = errors.Wrapf(err, "Error decoding data in %s", name)
+			log.Println(err.Error())
+			reader.CloseWithError(err)
+			return
+		}
+
+		reader.Close()
+	}()
+
+	syn.Wait()
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"sync"
+	"github.com/spf13/pflag"
+	"github.com/tehmoon/errors"
+	"io"
+	"io/ioutil"
+	"bytes"
+	"compress/bzip2"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"strings"
+	dsnetbzip2 "github.com/dsnet/compress/bzip2"
+	"github.com/andybalholm/brotli"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/ulikunitz/xz"
+)
+
+func init() {
+	MODULELIST.Register("compress", "Compress using zstd, xz, bzip2, lz4, snappy, brotli, zlib, deflate or gzip", NewCompress)
+}
+
+type Compress struct {
+	algo string
+	level int
+	window int
+	flush bool
+	codec *CompressionCodec
+}
+
+// Flushes the compressor after each write so each message can be
+// decompressed right away, at the cost of the compression ratio.
+type compressFlushWriter struct {
+	io.WriteCloser
+	flusher interface{
+		Flush() (error)
+	}
+}
+
+func (w *compressFlushWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	if err != nil {
+		return n, err
+	}
+
+	return n, w.flusher.Flush()
+}
+
+func newCompressFlushWriter(writer io.WriteCloser) (*compressFlushWriter) {
+	flusher, ok := writer.(interface{
+		Flush() (error)
+	})
+	if ! ok {
+		return nil
+	}
+
+	return &compressFlushWriter{
+		WriteCloser: writer,
+		flusher: flusher,
+	}
+}
+
+// Level and window are -1 and 0 respectively when not set so each codec
+// can use its own defaults. Sniff returns true if the header is the
+// beginning of a stream for that codec, it is nil when the format has
+// no magic bytes. Extension is the usual file extension of the format.
+type CompressionCodec struct {
+	Extension string
+	NewWriter func(w io.Writer, level, window int) (io.WriteCloser, error)
+	NewReader func(r io.Reader, window int) (io.Reader, error)
+	Sniff func(header []byte) (bool)
+}
+
+// Codecs are sniffed in that order when using decompress --auto
+var CompressionCodecNames = []string{"gzip", "zstd", "xz", "bzip2", "lz4", "snappy", "zlib", "brotli", "deflate",}
+
+var CompressionCodecs = map[string]*CompressionCodec{
+	"gzip": &CompressionCodec{
+		Extension: ".gz",
+		NewWriter: func(w io.Writer, level, window int) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, level)
+		},
+		NewReader: func(r io.Reader, window int) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+		Sniff: compressionSniffMagic([]byte{0x1f, 0x8b,}),
+	},
+	"zstd": &CompressionCodec{
+		Extension: ".zst",
+		NewWriter: func(w io.Writer, level, window int) (io.WriteCloser, error) {
+			options := make([]zstd.EOption, 0)
+
+			if level != -1 {
+				if level < 1 || level > 22 {
+					return nil, errors.Errorf("Level %d is not between 1 and 22", level)
+				}
+
+				options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+			}
+
+			if window != 0 {
+				options = append(options, zstd.WithWindowSize(window))
+			}
+
+			return zstd.NewWriter(w, options...)
+		},
+		NewReader: func(r io.Reader, window int) (io.Reader, error) {
+			// Streams are decoded one after the other, the returned reader
+			// must be closed to stop the decoder's goroutines.
+			options := []zstd.DOption{zstd.WithDecoderConcurrency(1),}
+
+			if window != 0 {
+				options = append(options, zstd.WithDecoderMaxWindow(uint64(window)))
+			}
+
+			decoder, err := zstd.NewReader(r, options...)
+			if err != nil {
+				return nil, err
+			}
+
+			return decoder.IOReadCloser(), nil
+		},
+		Sniff: compressionSniffMagic([]byte{0x28, 0xb5, 0x2f, 0xfd,}),
+	},
+	"xz": &CompressionCodec{
+		Extension: ".xz",
+		NewWriter: func(w io.Writer, level, window int) (io.WriteCloser, error) {
+			config := xz.WriterConfig{
+				DictCap: window,
+			}
+
+			return config.NewWriter(w)
+		},
+		NewReader: func(r io.Reader, window int) (io.Reader, error) {
+			return xz.NewReader(r)
+		},
+		Sniff: compressionSniffMagic([]byte{0xfd, '7', 'z', 'X', 'Z', 0x00,}),
+	},
+	"bzip2": &CompressionCodec{
+		Extension: ".bz2",
+		NewWriter: func(w io.Writer, level, window int) (io.WriteCloser, error) {
+			if level == -1 {
+				level = 0
+			}
+
+			return dsnetbzip2.NewWriter(w, &dsnetbzip2.WriterConfig{Level: level,})
+		},
+		NewReader: func(r io.Reader, window int) (io.Reader, error) {
+			return bzip2.NewReader(r), nil
+		},
+		Sniff: compressionSniffMagic([]byte("BZh")),
+	},
+	"lz4": &CompressionCodec{
+		Extension: ".lz4",
+		NewWriter: func(w io.Writer, level, window int) (io.WriteCloser, error) {
+			writer := lz4.NewWriter(w)
+			options := make([]lz4.Option, 0)
+
+			switch {
+				case level == -1:
+				case level == 0:
+					options = append(options, lz4.CompressionLevelOption(lz4.Fast))
+				case level >= 1 && level <= 9:
+					options = append(options, lz4.CompressionLevelOption(lz4.CompressionLevel(1 << uint(8 + level))))
+				default:
+					return nil, errors.Errorf("Level %d is not between 0 and 9", level)
+			}
+
+			if window != 0 {
+				options = append(options, lz4.BlockSizeOption(lz4.BlockSize(window)))
+			}
+
+			err := writer.Apply(options...)
+			if err != nil {
+				return nil, err
+			}
+
+			return writer, nil
+		},
+		NewReader: func(r io.Reader, window int) (io.Reader, error) {
+			return lz4.NewReader(r), nil
+		},
+		Sniff: compressionSniffMagic([]byte{0x04, 0x22, 0x4d, 0x18,}),
+	},
+	"snappy": &CompressionCodec{
+		Extension: ".sz",
+		NewWriter: func(w io.Writer, level, window int) (io.WriteCloser, error) {
+			return snappy.NewBufferedWriter(w), nil
+		},
+		NewReader: func(r io.Reader, window int) (io.Reader, error) {
+			return snappy.NewReader(r), nil
+		},
+		Sniff: compressionSniffMagic([]byte("\xff\x06\x00\x00sNaPpY")),
+	},
+	"zlib": &CompressionCodec{
+		Extension: ".zz",
+		NewWriter: func(w io.Writer, level, window int) (io.WriteCloser, error) {
+			return zlib.NewWriterLevel(w, level)
+		},
+		NewReader: func(r io.Reader, window int) (io.Reader, error) {
+			return zlib.NewReader(r)
+		},
+		// Deflate method with a valid header checksum
+		Sniff: func(header []byte) (bool) {
+			if len(header) < 2 {
+				return false
+			}
+
+			return header[0] & 0x0f == 8 && header[0] >> 4 <= 7 && (uint(header[0]) << 8 | uint(header[1])) % 31 == 0
+		},
+	},
+	"brotli": &CompressionCodec{
+		Extension: ".br",
+		NewWriter: func(w io.Writer, level, window int) (io.WriteCloser, error) {
+			if level == -1 {
+				level = 6
+			}
+
+			if level < brotli.BestSpeed || level > brotli.BestCompression {
+				return nil, errors.Errorf("Level %d is not between %d and %d", level, brotli.BestSpeed, brotli.BestCompression)
+			}
+
+			if window != 0 && (window < 10 || window > 24) {
+				return nil, errors.Errorf("Window %d is not between 10 and 24", window)
+			}
+
+			return brotli.NewWriterOptions(w, brotli.WriterOptions{Quality: level, LGWin: window,}), nil
+		},
+		NewReader: func(r io.Reader, window int) (io.Reader, error) {
+			return brotli.NewReader(r), nil
+		},
+	},
+	"deflate": &CompressionCodec{
+		Extension: ".deflate",
+		NewWriter: func(w io.Writer, level, window int) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		},
+		NewReader: func(r io.Reader, window int) (io.Reader, error) {
+			return flate.NewReader(r), nil
+		},
+	},
+}
+
+func compressionSniffMagic(magic []byte) (func([]byte) (bool)) {
+	return func(header []byte) (bool) {
+		return bytes.HasPrefix(header, magic)
+	}
+}
+
+// Return the codec whose magic bytes match the header
+func CompressionSniff(header []byte) (string, *CompressionCodec) {
+	for _, name := range CompressionCodecNames {
+		codec := CompressionCodecs[name]
+
+		if codec.Sniff != nil && codec.Sniff(header) {
+			return name, codec
+		}
+	}
+
+	return "", nil
+}
+
+func (m *Compress) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.StringVar(&m.algo, "algo", "", "Compression algorithm: " + strings.Join(CompressionCodecNames, ", "))
+	fs.IntVar(&m.level, "level", -1, "Compression level, ignored by xz and snappy. Defaults to the algorithm's default")
+	fs.IntVar(&m.window, "window", 0, "Window size in bytes for zstd, dictionary capacity for xz, block size for lz4 or log2 of the window for brotli. Defaults to the algorithm's default")
+	fs.BoolVar(&m.flush, "flush", false, "Flush after each message for streaming, the output is bigger. Not supported by xz and bzip2")
+}
+
+func (m *Compress) Init(in, out chan *Message, global *GlobalFlags) (error) {
+	codec, found := CompressionCodecs[m.algo]
+	if ! found {
+		return errors.Errorf("Algorithm %q is not supported in compress module", m.algo)
+	}
+
+	m.codec = codec
+
+	// Create a writer right away to validate the level and the window
+	writer, err := codec.NewWriter(ioutil.Discard, m.level, m.window)
+	if err != nil {
+		return errors.Wrapf(err, "Error initializing %s writer in compress module", m.algo)
+	}
+
+	if m.flush && newCompressFlushWriter(writer) == nil {
+		writer.Close()
+		return errors.Errorf("Algorithm %q cannot be used with flag %q", m.algo, "--flush")
+	}
+
+	writer.Close()
+
+	go func(in, out chan *Message) {
+		wg := &sync.WaitGroup{}
+
+		init := false
+		mc := NewMessageChannel()
+
+		out <- &Message{
+			Type: MessageTypeChannel,
+			Interface: mc.Callback,
+		}
+
+		LOOP: for message := range in {
+			switch message.Type {
+				case MessageTypeTerminate:
+					if ! init {
+						close(mc.Channel)
+					}
+
+					wg.Wait()
+					out <- message
+					break LOOP
+				case MessageTypeChannel:
+					cb, ok := message.Interface.(MessageChannelFunc)
+					if ok {
+						if ! init {
+							init = true
+						} else {
+							mc = NewMessageChannel()
+
+							out <- &Message{
+								Type: MessageTypeChannel,
+								Interface: mc.Callback,
+							}
+						}
+
+						wg.Add(1)
+						go StartCodecEncode("compress", cb, mc, wg, func(w io.Writer) (io.WriteCloser, error) {
+							writer, err := m.codec.NewWriter(w, m.level, m.window)
+							if err != nil || ! m.flush {
+								return writer, err
+							}
+
+							return newCompressFlushWriter(writer), nil
+						})
+
+						if ! global.MultiStreams {
+							if ! init {
+								close(mc.Channel)
+							}
+							wg.Wait()
+							out <- &Message{Type: MessageTypeTerminate,}
+							break LOOP
+						}
+					}
+			}
+		}
+
+		wg.Wait()
+		// Last message will signal the closing of the channel
+		<- in
+		close(out)
+	}(in, out)
+
+	return nil
+}
+
+func NewCompress() (Module) {
+	return &Compress{}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"sync"
+	"github.com/spf13/pflag"
+	"github.com/tehmoon/errors"
+	"io"
+	"bufio"
+	"strings"
+)
+
+func init() {
+	MODULELIST.Register("decompress", "Decompress zstd, xz, bzip2, lz4, snappy, brotli, zlib, deflate or gzip. Use --auto to detect the algorithm", NewDecompress)
+}
+
+type Decompress struct {
+	algo string
+	auto bool
+	window int
+	codec *CompressionCodec
+}
+
+func (m *Decompress) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.StringVar(&m.algo, "algo", "", "Compression algorithm: " + strings.Join(CompressionCodecNames, ", "))
+	fs.BoolVar(&m.auto, "auto", false, "Detect the algorithm using the magic bytes. Brotli and deflate cannot be detected. Mutually exclusive with \"--algo\"")
+	fs.IntVar(&m.window, "window", 0, "Maximum window size in bytes allowed for zstd")
+}
+
+func (m *Decompress) Init(in, out chan *Message, global *GlobalFlags) (error) {
+	if m.auto && m.algo != "" {
+		return errors.Errorf("Flag %q is mutually exclusive with flag %q", "--auto", "--algo")
+	}
+
+	if ! m.auto {
+		codec, found := CompressionCodecs[m.algo]
+		if ! found {
+			return errors.Errorf("Algorithm %q is not supported in decompress module", m.algo)
+		}
+
+		m.codec = codec
+	}
+
+	go func(in, out chan *Message) {
+		wg := &sync.WaitGroup{}
+
+		init := false
+		mc := NewMessageChannel()
+
+		out <- &Message{
+			Type: MessageTypeChannel,
+			Interface: mc.Callback,
+		}
+
+		LOOP: for message := range in {
+			switch message.Type {
+				case MessageTypeTerminate:
+					if ! init {
+						close(mc.Channel)
+					}
+
+					wg.Wait()
+					out <- message
+					break LOOP
+				case MessageTypeChannel:
+					cb, ok := message.Interface.(MessageChannelFunc)
+					if ok {
+						if ! init {
+							init = true
+						} else {
+							mc = NewMessageChannel()
+
+							out <- &Message{
+								Type: MessageTypeChannel,
+								Interface: mc.Callback,
+							}
+						}
+
+						wg.Add(1)
+						go StartCodecDecode("decompress", cb, mc, wg, m.newReader)
+
+						if ! global.MultiStreams {
+							if ! init {
+								close(mc.Channel)
+							}
+							wg.Wait()
+							out <- &Message{Type: MessageTypeTerminate,}
+							break LOOP
+						}
+					}
+			}
+		}
+
+		wg.Wait()
+		// Last message will signal the closing of the channel
+		<- in
+		close(out)
+	}(in, out)
+
+	return nil
+}
+
+// With --auto, the first bytes are peeked to find the codec
+// then the buffered reader is handed to it.
+func (m *Decompress) newReader(r io.Reader) (io.Reader, error) {
+	if ! m.auto {
+		return m.codec.NewReader(r, m.window)
+	}
+
+	reader := bufio.NewReader(r)
+
+	header, err := reader.Peek(10)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	name, codec := CompressionSniff(header)
+	if codec == nil {
+		return nil, errors.New("Unable to detect the compression algorithm")
+	}
+
+	r, err = codec.NewReader(reader, m.window)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error initializing %s reader", name)
+	}
+
+	return r, nil
+}
+
+func NewDecompress() (Module) {
+	return &Decompress{}
+}
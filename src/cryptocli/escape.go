@@ -0,0 +1,576 @@
+package main
+
+import (
+	"sync"
+	"github.com/spf13/pflag"
+	"github.com/tehmoon/errors"
+	"log"
+	"io"
+	"bytes"
+	"fmt"
+	"html"
+	"net/url"
+	"mime/quotedprintable"
+	"strconv"
+	"unicode/utf8"
+	"unicode/utf16"
+)
+
+func init() {
+	MODULELIST.Register("escape", "Escape or unescape data using url, html, quoted-printable, json, c or unicode schemes", NewEscape)
+}
+
+/*
+escape module encodes or decodes the input using one of the schemes:
+	- url: percent encoding for query strings, space is "+"
+	- url-path: percent encoding for path segments, space is "%20"
+	- html: html entities. Decoding is lenient like browsers are
+	- qp: quoted-printable as in RFC 2045
+	- json: content of a JSON string without the quotes
+	- c: C string literal escapes. Non printable bytes are encoded as \xNN
+	- unicode: non ASCII runes are encoded as \uNNNN using surrogate pairs,
+	  invalid UTF-8 bytes as \xNN
+
+Escape sequences can be split across messages, in that case the incomplete
+sequence is kept until the next message. An incomplete sequence at the end
+of the stream is an error.
+*/
+
+type Escape struct {
+	scheme string
+	encode bool
+	decode bool
+}
+
+// Process as much data as possible and return the number of bytes
+// consumed. The rest is prepended to the next message. When eof is
+// true, everything has to be consumed.
+type EscapeFunc func(data []byte, eof bool) (out []byte, n int, err error)
+
+func (m *Escape) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.StringVar(&m.scheme, "scheme", "", "Escaping scheme: url, url-path, html, qp, json, c or unicode")
+	fs.BoolVar(&m.encode, "encode", false, "Escape the data")
+	fs.BoolVar(&m.decode, "decode", false, "Unescape the data")
+}
+
+func (m *Escape) Init(in, out chan *Message, global *GlobalFlags) (error) {
+	if (m.encode && m.decode) || (! m.encode && ! m.decode) {
+		return errors.Errorf("One of %q and %q is required", "encode", "decode")
+	}
+
+	_, err := m.escapeFunc()
+	if err != nil {
+		return err
+	}
+
+	go func(in, out chan *Message) {
+		wg := &sync.WaitGroup{}
+
+		init := false
+		mc := NewMessageChannel()
+
+		out <- &Message{
+			Type: MessageTypeChannel,
+			Interface: mc.Callback,
+		}
+
+		LOOP: for message := range in {
+			switch message.Type {
+				case MessageTypeTerminate:
+					if ! init {
+						close(mc.Channel)
+					}
+
+					wg.Wait()
+					out <- message
+					break LOOP
+				case MessageTypeChannel:
+					cb, ok := message.Interface.(MessageChannelFunc)
+					if ok {
+						if ! init {
+							init = true
+						} else {
+							mc = NewMessageChannel()
+
+							out <- &Message{
+								Type: MessageTypeChannel,
+								Interface: mc.Callback,
+							}
+						}
+
+						wg.Add(1)
+						if m.scheme == "qp" {
+							go startEscapeQP(m, cb, mc, wg)
+						} else {
+							go startEscape(m, cb, mc, wg)
+						}
+
+						if ! global.MultiStreams {
+							if ! init {
+								close(mc.Channel)
+							}
+							wg.Wait()
+							out <- &Message{Type: MessageTypeTerminate,}
+							break LOOP
+						}
+					}
+			}
+		}
+
+		wg.Wait()
+		// Last message will signal the closing of the channel
+		<- in
+		close(out)
+	}(in, out)
+
+	return nil
+}
+
+func (m *Escape) escapeFunc() (EscapeFunc, error) {
+	switch m.scheme {
+		case "url":
+			if m.encode {
+				return EscapeURLEncode(true), nil
+			}
+
+			return EscapeURLDecode(true), nil
+		case "url-path":
+			if m.encode {
+				return EscapeURLEncode(false), nil
+			}
+
+			return EscapeURLDecode(false), nil
+		case "html":
+			if m.encode {
+				return EscapeHTMLEncode, nil
+			}
+
+			return EscapeHTMLDecode, nil
+		case "qp":
+			// Handled by startEscapeQP
+			return nil, nil
+		case "json":
+			if m.encode {
+				return EscapeJSONEncode, nil
+			}
+
+			return EscapeBackslashDecode("json"), nil
+		case "c":
+			if m.encode {
+				return EscapeCEncode, nil
+			}
+
+			return EscapeBackslashDecode("c"), nil
+		case "unicode":
+			if m.encode {
+				return EscapeUnicodeEncode, nil
+			}
+
+			return EscapeBackslashDecode("unicode"), nil
+	}
+
+	return nil, errors.Errorf("Scheme %q is not supported in escape module", m.scheme)
+}
+
+func startEscape(m *Escape, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	mc.Start(nil)
+	_, inc := cb()
+	defer DrainChannel(inc, nil)
+
+	outc := mc.Channel
+	defer close(outc)
+
+	f, _ := m.escapeFunc()
+	crumb := make([]byte, 0)
+
+	for payload := range inc {
+		crumb = append(crumb, payload...)
+
+		data, n, err := f(crumb, false)
+		if err != nil {
+			err = errors.Wrapf(err, "Error processing %s scheme in escape module", m.scheme)
+			log.Println(err.Error())
+			return
+		}
+
+		crumb = append(make([]byte, 0), crumb[n:]...)
+
+		if len(data) > 0 {
+			outc <- data
+		}
+	}
+
+	data, _, err := f(crumb, true)
+	if err != nil {
+		err = errors.Wrapf(err, "Error processing %s scheme in escape module", m.scheme)
+		log.Println(err.Error())
+		return
+	}
+
+	if len(data) > 0 {
+		outc <- data
+	}
+}
+
+func startEscapeQP(m *Escape, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	if m.encode {
+		StartCodecEncode("escape", cb, mc, wg, func(w io.Writer) (io.WriteCloser, error) {
+			// Line breaks are encoded too so the data is not altered
+			writer := quotedprintable.NewWriter(w)
+			writer.Binary = true
+
+			return writer, nil
+		})
+
+		return
+	}
+
+	StartCodecDecode("escape", cb, mc, wg, func(r io.Reader) (io.Reader, error) {
+		return quotedprintable.NewReader(r), nil
+	})
+}
+
+// Percent encoding works byte by byte so everything is always consumed
+func EscapeURLEncode(query bool) (EscapeFunc) {
+	return func(data []byte, eof bool) ([]byte, int, error) {
+		if query {
+			return []byte(url.QueryEscape(string(data))), len(data), nil
+		}
+
+		return []byte(url.PathEscape(string(data))), len(data), nil
+	}
+}
+
+func EscapeURLDecode(query bool) (EscapeFunc) {
+	return func(data []byte, eof bool) ([]byte, int, error) {
+		buff := bytes.NewBuffer(make([]byte, 0, len(data)))
+
+		for i := 0; i < len(data); i++ {
+			switch data[i] {
+				case '%':
+					if i + 2 >= len(data) {
+						if ! eof {
+							return buff.Bytes(), i, nil
+						}
+
+						return nil, 0, errors.Errorf("Truncated percent encoding %q", data[i:])
+					}
+
+					b, err := strconv.ParseUint(string(data[i + 1:i + 3]), 16, 8)
+					if err != nil {
+						return nil, 0, errors.Errorf("Invalid percent encoding %q", data[i:i + 3])
+					}
+
+					buff.WriteByte(byte(b))
+					i += 2
+				case '+':
+					if query {
+						buff.WriteByte(' ')
+					} else {
+						buff.WriteByte('+')
+					}
+				default:
+					buff.WriteByte(data[i])
+			}
+		}
+
+		return buff.Bytes(), len(data), nil
+	}
+}
+
+func EscapeHTMLEncode(data []byte, eof bool) ([]byte, int, error) {
+	return []byte(html.EscapeString(string(data))), len(data), nil
+}
+
+// Longest html entity name is "&CounterClockwiseContourIntegral;"
+const escapeHTMLMaxEntity = 33
+
+func EscapeHTMLDecode(data []byte, eof bool) ([]byte, int, error) {
+	n := len(data)
+
+	// Keep a trailing entity that may not be complete yet
+	if ! eof {
+		i := bytes.LastIndexByte(data, '&')
+		if i != -1 && len(data) - i < escapeHTMLMaxEntity && bytes.IndexByte(data[i:], ';') == -1 {
+			n = i
+		}
+	}
+
+	return []byte(html.UnescapeString(string(data[:n]))), n, nil
+}
+
+// Incomplete runes at the end of data are kept for the next message
+func escapeRunes(data []byte, eof bool, cb func(buff *bytes.Buffer, r rune, raw []byte)) ([]byte, int, error) {
+	buff := bytes.NewBuffer(make([]byte, 0, len(data)))
+
+	i := 0
+	for i < len(data) {
+		if ! eof && ! utf8.FullRune(data[i:]) {
+			break
+		}
+
+		r, size := utf8.DecodeRune(data[i:])
+		cb(buff, r, data[i:i + size])
+		i += size
+	}
+
+	return buff.Bytes(), i, nil
+}
+
+func EscapeJSONEncode(data []byte, eof bool) ([]byte, int, error) {
+	return escapeRunes(data, eof, func(buff *bytes.Buffer, r rune, raw []byte) {
+		switch r {
+			case '"':
+				buff.WriteString("\\\"")
+			case '\\':
+				buff.WriteString("\\\\")
+			case '\n':
+				buff.WriteString("\\n")
+			case '\r':
+				buff.WriteString("\\r")
+			case '\t':
+				buff.WriteString("\\t")
+			case '\b':
+				buff.WriteString("\\b")
+			case '\f':
+				buff.WriteString("\\f")
+			default:
+				// Invalid UTF-8 is replaced like encoding/json does
+				if r < 0x20 || r == utf8.RuneError {
+					buff.WriteString(fmt.Sprintf("\\u%04x", r))
+					return
+				}
+
+				buff.Write(raw)
+		}
+	})
+}
+
+var escapeCEncodeTable = map[byte]string{
+	'\a': "\\a",
+	'\b': "\\b",
+	'\f': "\\f",
+	'\n': "\\n",
+	'\r': "\\r",
+	'\t': "\\t",
+	'\v': "\\v",
+	'\\': "\\\\",
+	'"': "\\\"",
+}
+
+func EscapeCEncode(data []byte, eof bool) ([]byte, int, error) {
+	buff := bytes.NewBuffer(make([]byte, 0, len(data)))
+
+	for _, c := range data {
+		if e, found := escapeCEncodeTable[c]; found {
+			buff.WriteString(e)
+			continue
+		}
+
+		if c < 0x20 || c > 0x7e {
+			buff.WriteString(fmt.Sprintf("\\x%02x", c))
+			continue
+		}
+
+		buff.WriteByte(c)
+	}
+
+	return buff.Bytes(), len(data), nil
+}
+
+func EscapeUnicodeEncode(data []byte, eof bool) ([]byte, int, error) {
+	return escapeRunes(data, eof, func(buff *bytes.Buffer, r rune, raw []byte) {
+		switch {
+			case r == utf8.RuneError && len(raw) == 1:
+				buff.WriteString(fmt.Sprintf("\\x%02x", raw[0]))
+			case r == '\\':
+				buff.WriteString("\\\\")
+			case r >= 0x20 && r <= 0x7e:
+				buff.WriteByte(byte(r))
+			case r > 0xffff:
+				r1, r2 := utf16.EncodeRune(r)
+				buff.WriteString(fmt.Sprintf("\\u%04x\\u%04x", r1, r2))
+			default:
+				buff.WriteString(fmt.Sprintf("\\u%04x", r))
+		}
+	})
+}
+
+var escapeBackslashSimple = map[string]map[byte]byte{
+	"json": map[byte]byte{
+		'"': '"',
+		'\\': '\\',
+		'/': '/',
+		'b': '\b',
+		'f': '\f',
+		'n': '\n',
+		'r': '\r',
+		't': '\t',
+	},
+	"c": map[byte]byte{
+		'a': '\a',
+		'b': '\b',
+		'f': '\f',
+		'n': '\n',
+		'r': '\r',
+		't': '\t',
+		'v': '\v',
+		'\\': '\\',
+		'\'': '\'',
+		'"': '"',
+		'?': '?',
+	},
+	"unicode": map[byte]byte{
+		'\\': '\\',
+	},
+}
+
+// Decode backslash escapes. json knows \uNNNN, c knows \xNN, octal,
+// \uNNNN and \UNNNNNNNN, unicode knows \xNN and \uNNNN.
+func EscapeBackslashDecode(scheme string) (EscapeFunc) {
+	simple := escapeBackslashSimple[scheme]
+
+	return func(data []byte, eof bool) ([]byte, int, error) {
+		buff := bytes.NewBuffer(make([]byte, 0, len(data)))
+
+		i := 0
+		for i < len(data) {
+			if data[i] != '\\' {
+				buff.WriteByte(data[i])
+				i++
+				continue
+			}
+
+			size, err := escapeBackslashSequence(scheme, simple, buff, data[i:], eof)
+			if err != nil {
+				return nil, 0, err
+			}
+
+			// Incomplete sequence
+			if size == 0 {
+				break
+			}
+
+			i += size
+		}
+
+		return buff.Bytes(), i, nil
+	}
+}
+
+var ErrEscapeTruncated = errors.New("Truncated escape sequence")
+
+func escapeHexDigits(data []byte, from, count int, eof bool) (v uint64, ok bool, err error) {
+	if len(data) < from + count {
+		if eof {
+			return 0, false, ErrEscapeTruncated
+		}
+
+		return 0, false, nil
+	}
+
+	v, err = strconv.ParseUint(string(data[from:from + count]), 16, 32)
+	if err != nil {
+		return 0, false, errors.Errorf("Invalid escape sequence %q", data[:from + count])
+	}
+
+	return v, true, nil
+}
+
+// Return the size of the sequence or 0 if more data is needed
+func escapeBackslashSequence(scheme string, simple map[byte]byte, buff *bytes.Buffer, data []byte, eof bool) (int, error) {
+	if len(data) < 2 {
+		if eof {
+			return 0, ErrEscapeTruncated
+		}
+
+		return 0, nil
+	}
+
+	c := data[1]
+
+	if r, found := simple[c]; found {
+		buff.WriteByte(r)
+		return 2, nil
+	}
+
+	switch {
+		case c == 'x' && scheme != "json":
+			v, ok, err := escapeHexDigits(data, 2, 2, eof)
+			if ! ok {
+				return 0, err
+			}
+
+			buff.WriteByte(byte(v))
+			return 4, nil
+		case c == 'U' && scheme == "c":
+			v, ok, err := escapeHexDigits(data, 2, 8, eof)
+			if ! ok {
+				return 0, err
+			}
+
+			if v > utf8.MaxRune {
+				return 0, errors.Errorf("Invalid escape sequence %q", data[:10])
+			}
+
+			buff.WriteString(string(rune(v)))
+			return 10, nil
+		case c == 'u':
+			v, ok, err := escapeHexDigits(data, 2, 4, eof)
+			if ! ok {
+				return 0, err
+			}
+
+			r := rune(v)
+			if ! utf16.IsSurrogate(r) || scheme == "c" {
+				buff.WriteString(string(r))
+				return 6, nil
+			}
+
+			// Surrogate pairs need the next sequence
+			if len(data) < 12 && ! eof {
+				return 0, nil
+			}
+
+			if len(data) >= 12 && data[6] == '\\' && data[7] == 'u' {
+				v2, ok, err := escapeHexDigits(data, 8, 4, eof)
+				if ! ok {
+					return 0, err
+				}
+
+				if r2 := utf16.DecodeRune(r, rune(v2)); r2 != utf8.RuneError {
+					buff.WriteString(string(r2))
+					return 12, nil
+				}
+			}
+
+			// Lone surrogates are replaced like encoding/json does
+			buff.WriteString(string(utf8.RuneError))
+			return 6, nil
+		case c >= '0' && c <= '7' && scheme == "c":
+			size := 2
+			for size < 4 && size < len(data) && data[size] >= '0' && data[size] <= '7' {
+				size++
+			}
+
+			if size < 4 && size == len(data) && ! eof {
+				return 0, nil
+			}
+
+			v, _ := strconv.ParseUint(string(data[1:size]), 8, 16)
+			if v > 0xff {
+				return 0, errors.Errorf("Invalid escape sequence %q", data[:size])
+			}
+
+			buff.WriteByte(byte(v))
+			return size, nil
+	}
+
+	return 0, errors.Errorf("Invalid escape sequence %q", data[:2])
+}
+
+func NewEscape() (Module) {
+	return &Escape{}
+}
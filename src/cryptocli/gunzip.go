@@ -7,15 +7,23 @@ import (
 	"github.com/tehmoon/errors"
 	"log"
 	"sync"
+	"bufio"
 )
 
 func init() {
 	MODULELIST.Register("gunzip", "Gunzip de-compress", NewGunzip)
 }
 
-type Gunzip struct {}
+type Gunzip struct {
+	multistream bool
+	eachMember bool
+}
 
 func (m *Gunzip) Init(in, out chan *Message, global *GlobalFlags) (error) {
+	if m.eachMember && ! global.MultiStreams {
+		return errors.Errorf("Flag %q is required since each member is sent to its own channel", "--multi-streams")
+	}
+
 	go func(in, out chan *Message) {
 		wg := &sync.WaitGroup{}
 
@@ -51,51 +59,21 @@ func (m *Gunzip) Init(in, out chan *Message, global *GlobalFlags) (error) {
 							}
 						}
 
-						reader, writer := io.Pipe()
-
 						wg.Add(1)
-						go func() {
-							defer wg.Done()
-
-							mc.Start(nil)
-							_, inc := cb()
-							outc := mc.Channel
-
-							wg.Add(2)
-							go func() {
-								for payload := range inc {
-									_, err := writer.Write(payload)
-									if err != nil {
-										err = errors.Wrap(err, "Error wrinting data to pipe")
-										log.Println(err.Error())
-										break
-									}
-								}
-
-								writer.Close()
-								DrainChannel(inc, nil)
-								wg.Done()
-							}()
-
-							go func() {
-								defer wg.Done()
-								defer close(outc)
-
-								gzipReader, err := gzip.NewReader(reader)
+						if m.eachMember {
+							go gunzipEachMemberStartHandler(out, cb, mc, wg)
+						} else {
+							go StartCodecDecode("gunzip", cb, mc, wg, func(r io.Reader) (io.Reader, error) {
+								reader, err := gzip.NewReader(r)
 								if err != nil {
-									err = errors.Wrap(err, "Error initializing gunzip reader")
-									log.Println(err.Error())
-									return
+									return nil, err
 								}
 
-								err = ReadBytesSendMessages(gzipReader, outc)
-								if err != nil {
-									err = errors.Wrap(err, "Error reading gzip reader in gunzip")
-									log.Println(err.Error())
-									return
-								}
-							}()
-						}()
+								reader.Multistream(m.multistream)
+
+								return reader, nil
+							})
+						}
 
 						if ! global.MultiStreams {
 							if ! init {
@@ -118,8 +96,70 @@ func (m *Gunzip) Init(in, out chan *Message, global *GlobalFlags) (error) {
 	return nil
 }
 
+// Each member is read until its end then the reader is reset to read
+// the next header. Each member is sent to its own channel which is started
+// once the header is read so the metadata is known.
+func gunzipEachMemberStartHandler(out chan *Message, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	_, inc := cb()
+	defer DrainChannel(inc, nil)
+
+	mr := NewMessageReader(inc)
+	defer mr.Close()
+
+	fanOut := NewMessageFanOut(out, mc)
+	defer fanOut.Close()
+
+	// gzip.Reader needs an io.ByteReader so it doesn't read past a member
+	reader := bufio.NewReader(mr)
+
+	gzipReader, err := gzip.NewReader(reader)
+	if err != nil {
+		if err != io.EOF {
+			err = errors.Wrap(err, "Error initializing gunzip reader")
+			log.Println(err.Error())
+		}
+
+		return
+	}
+
+	for i := 0; ; i++ {
+		gzipReader.Multistream(false)
+
+		mc = fanOut.Next(map[string]interface{}{
+			"index": i,
+			"name": gzipReader.Name,
+			"comment": gzipReader.Comment,
+			"mtime": gzipReader.ModTime,
+		})
+
+		err = ReadBytesSendMessages(gzipReader, mc.Channel)
+		close(mc.Channel)
+
+		if err != nil && err != io.EOF {
+			err = errors.Wrapf(err, "Error reading member number %d in gunzip", i)
+			log.Println(err.Error())
+			return
+		}
+
+		err = gzipReader.Reset(reader)
+		if err != nil {
+			if err != io.EOF {
+				err = errors.Wrapf(err, "Error reading header of member number %d in gunzip", i + 1)
+				log.Println(err.Error())
+			}
+
+			return
+		}
+	}
+}
+
 func NewGunzip() (Module) {
 	return &Gunzip{}
 }
 
-func (m *Gunzip) SetFlagSet(fs *pflag.FlagSet, args []string) {}
+func (m *Gunzip) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.BoolVar(&m.multistream, "multistream", true, "Read concatenated members as a single stream. Set to false to stop after the first member")
+	fs.BoolVar(&m.eachMember, "each-member", false, "Send each member to its own channel with the header as metadata. Requires \"--multi-streams\"")
+}
@@ -3,17 +3,49 @@ package main
 import (
 	"sync"
 	"github.com/spf13/pflag"
+	"github.com/tehmoon/errors"
 	"compress/gzip"
 	"bytes"
+	"io"
+	"text/template"
+	"time"
 )
 
 func init() {
 	MODULELIST.Register("gzip", "Gzip compress", NewGzip)
 }
 
-type Gzip struct {}
+type Gzip struct {
+	level int
+	name string
+	mtime string
+	comment string
+	modTime time.Time
+	tpl *template.Template
+}
+
+func (m *Gzip) Init(in, out chan *Message, global *GlobalFlags) (err error) {
+	_, err = gzip.NewWriterLevel(nil, m.level)
+	if err != nil {
+		return errors.Wrapf(err, "Bad value for flag %q in gzip module", "--level")
+	}
+
+	m.tpl, err = template.New("root").Parse(m.name)
+	if err != nil {
+		return errors.Wrapf(err, "Error parsing template for %q flag", "--name")
+	}
+
+	switch m.mtime {
+		case "":
+		case "now":
+			m.modTime = time.Now()
+		default:
+			m.modTime, err = time.Parse(time.RFC3339, m.mtime)
+			if err != nil {
+				return errors.Wrapf(err, "Error parsing %q flag", "--mtime")
+			}
+	}
 
-func (m Gzip) Init(in, out chan *Message, global *GlobalFlags) (error) {
 	go func(in, out chan *Message) {
 		wg := &sync.WaitGroup{}
 
@@ -50,30 +82,7 @@ func (m Gzip) Init(in, out chan *Message, global *GlobalFlags) (error) {
 						}
 
 						wg.Add(1)
-						go func() {
-							buff := bytes.NewBuffer(nil)
-							gzipWriter := gzip.NewWriter(buff)
-
-							go func() {
-								mc.Start(nil)
-								_, inc := cb()
-
-								for payload := range inc {
-									_, err := gzipWriter.Write(payload)
-									if err != nil {
-										break
-									}
-
-									gzipWriter.Flush()
-
-									mc.Channel <- CopyResetBuffer(buff)
-								}
-
-								close(mc.Channel)
-								DrainChannel(inc, nil)
-								wg.Done()
-							}()
-						}()
+						go gzipStartHandler(m, cb, mc, wg)
 
 						if ! global.MultiStreams {
 							if ! init {
@@ -97,8 +106,38 @@ func (m Gzip) Init(in, out chan *Message, global *GlobalFlags) (error) {
 	return nil
 }
 
+// The header is written with the first block so the name can be
+// rendered using the metadata of the incoming channel.
+func gzipStartHandler(m *Gzip, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	StartCodecEncode("gzip", cb, mc, wg, func(w io.Writer) (io.WriteCloser, error) {
+		metadata, _ := cb()
+
+		buff := bytes.NewBuffer(make([]byte, 0))
+		err := m.tpl.Execute(buff, metadata)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error executing template name")
+		}
+
+		writer, err := gzip.NewWriterLevel(w, m.level)
+		if err != nil {
+			return nil, err
+		}
+
+		writer.Name = buff.String()
+		writer.Comment = m.comment
+		writer.ModTime = m.modTime
+
+		return writer, nil
+	})
+}
+
 func NewGzip() (Module) {
 	return &Gzip{}
 }
 
-func (m *Gzip) SetFlagSet(fs *pflag.FlagSet, args []string) {}
+func (m *Gzip) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.IntVar(&m.level, "level", gzip.DefaultCompression, "Compression level from 1 to 9, 0 for no compression")
+	fs.StringVar(&m.name, "name", "", "Metadata template for the file name stored in the header. IE: `\"{{ .path }}\"`")
+	fs.StringVar(&m.mtime, "mtime", "", "Modification time stored in the header in RFC3339 format or \"now\"")
+	fs.StringVar(&m.comment, "comment", "", "Comment stored in the header")
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"sync"
+	"github.com/spf13/pflag"
+	"github.com/tehmoon/errors"
+	"log"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	MODULELIST.Register("hexdump", "Render the input like xxd or hexdump -C, or parse it back to bytes with --reverse", NewHexdump)
+}
+
+/*
+hexdump module renders each line as an offset, the hexadecimal
+representation of --width bytes then the printable characters.
+
+formats:
+	- xxd: bytes of a group are joined together and groups are separated by a space
+	  00000000: 4865 6c6c 6f2c 2077 6f72 6c64 210a       Hello, world!.
+	- canonical: like hexdump -C, bytes are separated by a space and groups by
+	  an extra space. The last line is the total length.
+	  00000000  48 65 6c 6c 6f 2c 20 77  6f 72 6c 64 21 0a        |Hello, world!.|
+	  0000000e
+
+--reverse parses the output of the selected format back to bytes. The offset of each
+line is honored, gaps are filled with zeros and a "*" line in the canonical format
+repeats the previous line until the next offset.
+*/
+
+type Hexdump struct {
+	format string
+	width int
+	group int
+	uppercase bool
+	reverse bool
+}
+
+func (m *Hexdump) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.StringVar(&m.format, "format", "xxd", "Output format: xxd or canonical")
+	fs.IntVar(&m.width, "width", 16, "Number of bytes per line")
+	fs.IntVar(&m.group, "group", 0, "Number of bytes per group. Defaults to 2 for xxd and 8 for canonical")
+	fs.BoolVar(&m.uppercase, "uppercase", false, "Use uppercase hexadecimal letters")
+	fs.BoolVar(&m.reverse, "reverse", false, "Parse the dump and output the bytes")
+}
+
+func (m *Hexdump) Init(in, out chan *Message, global *GlobalFlags) (error) {
+	switch m.format {
+		case "xxd":
+			if m.group == 0 {
+				m.group = 2
+			}
+		case "canonical":
+			if m.group == 0 {
+				m.group = 8
+			}
+		default:
+			return errors.Errorf("Format %q is not supported in hexdump module", m.format)
+	}
+
+	if m.width < 1 {
+		return errors.Errorf("Flag %q has to be greater than 0", "--width")
+	}
+
+	if m.group < 1 {
+		return errors.Errorf("Flag %q has to be greater than 0", "--group")
+	}
+
+	go func(in, out chan *Message) {
+		wg := &sync.WaitGroup{}
+
+		init := false
+		mc := NewMessageChannel()
+
+		out <- &Message{
+			Type: MessageTypeChannel,
+			Interface: mc.Callback,
+		}
+
+		LOOP: for message := range in {
+			switch message.Type {
+				case MessageTypeTerminate:
+					if ! init {
+						close(mc.Channel)
+					}
+
+					wg.Wait()
+					out <- message
+					break LOOP
+				case MessageTypeChannel:
+					cb, ok := message.Interface.(MessageChannelFunc)
+					if ok {
+						if ! init {
+							init = true
+						} else {
+							mc = NewMessageChannel()
+
+							out <- &Message{
+								Type: MessageTypeChannel,
+								Interface: mc.Callback,
+							}
+						}
+
+						wg.Add(1)
+						if m.reverse {
+							go startHexdumpReverse(m, cb, mc, wg)
+						} else {
+							go startHexdump(m, cb, mc, wg)
+						}
+
+						if ! global.MultiStreams {
+							if ! init {
+								close(mc.Channel)
+							}
+							wg.Wait()
+							out <- &Message{Type: MessageTypeTerminate,}
+							break LOOP
+						}
+					}
+			}
+		}
+
+		wg.Wait()
+		// Last message will signal the closing of the channel
+		<- in
+		close(out)
+	}(in, out)
+
+	return nil
+}
+
+// Full lines are rendered as soon as they are received,
+// the remaining bytes are kept until the next message.
+func startHexdump(m *Hexdump, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	mc.Start(nil)
+	_, inc := cb()
+	outc := mc.Channel
+	defer close(outc)
+
+	var (
+		offset int64
+		crumb = make([]byte, 0)
+	)
+
+	for payload := range inc {
+		crumb = append(crumb, payload...)
+
+		if len(crumb) < m.width {
+			continue
+		}
+
+		buff := bytes.NewBuffer(make([]byte, 0))
+
+		for len(crumb) >= m.width {
+			m.writeLine(buff, offset, crumb[:m.width])
+			offset += int64(m.width)
+			crumb = crumb[m.width:]
+		}
+
+		outc <- buff.Bytes()
+	}
+
+	buff := bytes.NewBuffer(make([]byte, 0))
+
+	if len(crumb) > 0 {
+		m.writeLine(buff, offset, crumb)
+		offset += int64(len(crumb))
+	}
+
+	if m.format == "canonical" {
+		buff.WriteString(m.formatOffset(offset))
+		buff.WriteByte('\n')
+	}
+
+	if buff.Len() > 0 {
+		outc <- buff.Bytes()
+	}
+}
+
+// Like xxd -u, offsets stay lowercase
+func (m *Hexdump) formatOffset(offset int64) (string) {
+	return fmt.Sprintf("%08x", offset)
+}
+
+func (m *Hexdump) writeLine(buff *bytes.Buffer, offset int64, line []byte) {
+	buff.WriteString(m.formatOffset(offset))
+
+	if m.format == "xxd" {
+		buff.WriteString(": ")
+	} else {
+		buff.WriteString("  ")
+	}
+
+	// Lines are padded to the width so the printable characters are aligned
+	for i := 0; i < m.width; i++ {
+		if i != 0 && i % m.group == 0 {
+			buff.WriteByte(' ')
+		}
+
+		if i >= len(line) {
+			buff.WriteString("  ")
+		} else {
+			h := hex.EncodeToString(line[i:i + 1])
+			if m.uppercase {
+				h = strings.ToUpper(h)
+			}
+
+			buff.WriteString(h)
+		}
+
+		if m.format == "canonical" {
+			buff.WriteByte(' ')
+		}
+	}
+
+	if m.format == "xxd" {
+		buff.WriteString("  ")
+	} else {
+		buff.WriteString(" |")
+	}
+
+	for _, c := range line {
+		if c < 0x20 || c > 0x7e {
+			c = '.'
+		}
+
+		buff.WriteByte(c)
+	}
+
+	if m.format == "canonical" {
+		buff.WriteByte('|')
+	}
+
+	buff.WriteByte('\n')
+}
+
+type hexdumpReverser struct {
+	m *Hexdump
+	offset int64
+	previous []byte
+	repeat bool
+}
+
+// Lines are split across message boundaries, the last line
+// doesn't need a trailing new line.
+func startHexdumpReverse(m *Hexdump, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	mc.Start(nil)
+	_, inc := cb()
+	defer DrainChannel(inc, nil)
+
+	outc := mc.Channel
+	defer close(outc)
+
+	r := &hexdumpReverser{
+		m: m,
+	}
+
+	crumb := make([]byte, 0)
+
+	for payload := range inc {
+		crumb = append(crumb, payload...)
+
+		i := bytes.LastIndexByte(crumb, '\n')
+		if i == -1 {
+			continue
+		}
+
+		data, err := r.parseLines(crumb[:i])
+		if err != nil {
+			err = errors.Wrap(err, "Error parsing dump in hexdump module")
+			log.Println(err.Error())
+			return
+		}
+
+		crumb = append(make([]byte, 0), crumb[i + 1:]...)
+
+		if len(data) > 0 {
+			outc <- data
+		}
+	}
+
+	data, err := r.parseLines(crumb)
+	if err != nil {
+		err = errors.Wrap(err, "Error parsing dump in hexdump module")
+		log.Println(err.Error())
+		return
+	}
+
+	if len(data) > 0 {
+		outc <- data
+	}
+}
+
+func (r *hexdumpReverser) parseLines(lines []byte) ([]byte, error) {
+	buff := bytes.NewBuffer(make([]byte, 0))
+
+	for _, line := range strings.Split(string(lines), "\n") {
+		err := r.parseLine(buff, strings.TrimRight(line, "\r"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return buff.Bytes(), nil
+}
+
+func (r *hexdumpReverser) parseLine(buff *bytes.Buffer, line string) (error) {
+	if strings.TrimSpace(line) == "" {
+		return nil
+	}
+
+	if r.m.format == "canonical" && strings.TrimSpace(line) == "*" {
+		r.repeat = true
+		return nil
+	}
+
+	var field, rest string
+
+	if r.m.format == "xxd" {
+		i := strings.IndexByte(line, ':')
+		if i == -1 {
+			return errors.Errorf("Missing offset in line %q", line)
+		}
+
+		field, rest = line[:i], line[i + 1:]
+
+		// The hex part ends at the double space before the printable characters
+		rest = strings.TrimLeft(rest, " ")
+		if i := strings.Index(rest, "  "); i != -1 {
+			rest = rest[:i]
+		}
+	} else {
+		fields := strings.SplitN(strings.TrimLeft(line, " "), " ", 2)
+		field = fields[0]
+
+		if len(fields) > 1 {
+			rest = fields[1]
+		}
+
+		if i := strings.IndexByte(rest, '|'); i != -1 {
+			rest = rest[:i]
+		}
+	}
+
+	offset, err := strconv.ParseInt(strings.TrimSpace(field), 16, 64)
+	if err != nil {
+		return errors.Wrapf(err, "Error parsing offset in line %q", line)
+	}
+
+	if offset < r.offset {
+		return errors.Errorf("Offset %s goes backward in line %q", field, line)
+	}
+
+	if r.repeat && len(r.previous) > 0 {
+		for offset - r.offset >= int64(len(r.previous)) {
+			buff.Write(r.previous)
+			r.offset += int64(len(r.previous))
+		}
+	}
+
+	r.repeat = false
+
+	if offset > r.offset {
+		buff.Write(make([]byte, offset - r.offset))
+		r.offset = offset
+	}
+
+	data, err := hex.DecodeString(strings.Replace(rest, " ", "", -1))
+	if err != nil {
+		return errors.Wrapf(err, "Error decoding hex in line %q", line)
+	}
+
+	buff.Write(data)
+	r.offset += int64(len(data))
+
+	if len(data) > 0 {
+		r.previous = data
+	}
+
+	return nil
+}
+
+func NewHexdump() (Module) {
+	return &Hexdump{}
+}
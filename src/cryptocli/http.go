@@ -30,6 +30,8 @@ type HTTP struct {
 	showServerHeaders bool
 	tplUrl *template.Template
 	MaxRedirects int
+	tlsOptions TLSClientOptions
+	tlsConfig *tls.Config
 }
 
 func (m *HTTP) SetFlagSet(fs *pflag.FlagSet, args []string) {
@@ -44,6 +46,8 @@ func (m *HTTP) SetFlagSet(fs *pflag.FlagSet, args []string) {
 	fs.StringVar(&m.user, "user", "", "Specify the required user for basic auth")
 	fs.StringVar(&m.password, "password", "", "Specify the required password for basic auth")
 	fs.IntVar(&m.MaxRedirects, "max-redirects", 0, "Maximum redirects")
+	m.tlsOptions.SetFlagSet(fs)
+	m.tlsOptions.SetServernameFlag(fs)
 }
 
 func (m *HTTP) Init(in, out chan *Message, global *GlobalFlags) (err error) {
@@ -59,6 +63,11 @@ func (m *HTTP) Init(in, out chan *Message, global *GlobalFlags) (err error) {
 		return errors.Errorf("Flag %q is required when %q is set", "--user", "--password")
 	}
 
+	m.tlsConfig, err = m.tlsOptions.Config(m.insecure)
+	if err != nil {
+		return errors.Wrap(err, "Error configuring TLS")
+	}
+
 	m.tplUrl, err = template.New("root").Parse(m.url)
 	if err != nil {
 		return errors.Wrap(err, "Error parsing template for \"--url\" flag")
@@ -131,7 +140,6 @@ func httpStartHandler(m *HTTP, cb MessageChannelFunc, mc *MessageChannel,  wg *s
 	cancel := make(chan error)
 	goahead := &sync.WaitGroup{}
 
-	mc.Start(nil)
 	metadata, inc := cb()
 
 	buff := bytes.NewBuffer(make([]byte, 0))
@@ -139,6 +147,7 @@ func httpStartHandler(m *HTTP, cb MessageChannelFunc, mc *MessageChannel,  wg *s
 	if err != nil {
 		err = errors.Wrap(err, "Error executing template url")
 		log.Println(err.Error())
+		mc.Start(nil)
 		close(mc.Channel)
 		DrainChannel(inc, nil)
 		return
@@ -150,6 +159,10 @@ func httpStartHandler(m *HTTP, cb MessageChannelFunc, mc *MessageChannel,  wg *s
 	outc := mc.Channel
 	defer close(outc)
 
+	// The channel is started once the response is received so the TLS
+	// parameters can be set in metadata, or without metadata on errors.
+	defer mc.Start(nil)
+
 	wg.Add(1)
 	goahead.Add(1)
 	go func(inc chan []byte, writer *io.PipeWriter, wg *sync.WaitGroup, goahead *sync.WaitGroup, cancel chan error) {
@@ -204,7 +217,7 @@ func httpStartHandler(m *HTTP, cb MessageChannelFunc, mc *MessageChannel,  wg *s
 
 	client := &http.Client{
 		Timeout: m.readTimeout,
-		Transport: httpCreateTransport(m.insecure),
+		Transport: httpCreateTransport(m.tlsConfig),
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			if len(via) > m.MaxRedirects && m.MaxRedirects >= 0 {
 				return errors.New("Maximum redirects reached")
@@ -248,6 +261,13 @@ func httpStartHandler(m *HTTP, cb MessageChannelFunc, mc *MessageChannel,  wg *s
 
 	log.Printf("Response status is %q\n", resp.Status)
 
+	outMetadata := make(map[string]interface{})
+	if resp.TLS != nil {
+		TLSClientMetadata(resp.TLS, outMetadata)
+	}
+
+	mc.Start(outMetadata)
+
 	close(cancel)
 
 	if resp.Body == nil {
@@ -268,7 +288,7 @@ func NewHTTP() (Module) {
 	return &HTTP{}
 }
 
-func httpCreateTransport(insecure bool) (http.RoundTripper) {
+func httpCreateTransport(config *tls.Config) (http.RoundTripper) {
 	var (
 		tr = &http.Transport{}
 		rt = http.DefaultTransport
@@ -278,16 +298,10 @@ func httpCreateTransport(insecure bool) (http.RoundTripper) {
 	if ok {
 		*tr = *transport
 
-		tr.TLSClientConfig = httpCreateTLSConfig(insecure)
+		tr.TLSClientConfig = config
 
 		rt = tr
 	}
 
 	return rt
 }
-
-func httpCreateTLSConfig(insecure bool) (config *tls.Config) {
-	return &tls.Config{
-		InsecureSkipVerify: insecure,
-	}
-}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"time"
+	"log"
+	"net"
+	"io"
+	"bytes"
+	"bufio"
+	"strings"
+	"strconv"
+	"net/http"
+	"crypto/tls"
+	"text/template"
+	"github.com/tehmoon/errors"
+	"github.com/spf13/pflag"
+)
+
+func init() {
+	MODULELIST.Register("http-proxy", "Listens TCP as an HTTP proxy, the target is set in metadata", NewHTTPProxy)
+}
+
+/*
+http-proxy module works like tcp-server but reads the proxy request first.
+The target is set in the channel metadata so the next module can connect to it:
+
+  http-proxy --listen :8080 -- tcp --addr '{{ index . "dest-addr" }}'
+
+CONNECT requests are answered right away then the tunnel is relayed. When the
+--decrypt template returns true, the tunnel is TLS intercepted with a
+certificate signed by the CA and the decrypted stream is relayed instead.
+
+Absolute-URI requests are rewritten in origin-form with "Connection: close"
+so the connection carries a single target.
+*/
+
+type HTTPProxy struct {
+	addr string
+	connectTimeout time.Duration
+	readTimeout time.Duration
+	decrypt string
+	decryptTmpl *template.Template
+	ca TLSCAOptions
+}
+
+func httpProxyHandler(conn net.Conn, m *HTTPProxy, relay *ServerRelayer) {
+	conn.SetDeadline(time.Now().Add(m.readTimeout))
+
+	reader := bufio.NewReader(conn)
+
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		err = errors.Wrapf(err, "Error reading proxy request from %q", conn.RemoteAddr().String())
+		log.Println(err.Error())
+		ServerRelayAbort(conn, relay)
+		return
+	}
+
+	host, port, err := httpProxyTarget(req)
+	if err != nil {
+		err = errors.Wrapf(err, "Error in proxy request from %q", conn.RemoteAddr().String())
+		log.Println(err.Error())
+		httpProxyWriteStatus(conn, http.StatusBadRequest)
+		ServerRelayAbort(conn, relay)
+		return
+	}
+
+	metadata := map[string]interface{}{
+		"local-addr": conn.LocalAddr().String(),
+		"remote-addr": conn.RemoteAddr().String(),
+		"addr": m.addr,
+		"method": req.Method,
+		"dest-host": host,
+		"dest-port": port,
+		"dest-addr": net.JoinHostPort(host, strconv.Itoa(port)),
+	}
+
+	var stream net.Conn = ServerBufferedConn{
+		Conn: conn,
+		Reader: reader,
+	}
+
+	if req.Method == http.MethodConnect {
+		decrypt, err := TLSExecuteDecrypt(m.decryptTmpl, metadata)
+		if err != nil {
+			log.Println(err.Error())
+			httpProxyWriteStatus(conn, http.StatusInternalServerError)
+			ServerRelayAbort(conn, relay)
+			return
+		}
+
+		metadata["decrypt"] = decrypt
+
+		err = httpProxyWriteStatus(conn, http.StatusOK)
+		if err != nil {
+			err = errors.Wrap(err, "Error writing CONNECT response")
+			log.Println(err.Error())
+			ServerRelayAbort(conn, relay)
+			return
+		}
+
+		if decrypt {
+			config, err := m.ca.ForgeConfig(host)
+			if err != nil {
+				log.Println(err.Error())
+				ServerRelayAbort(conn, relay)
+				return
+			}
+
+			sconn := tls.Server(stream, config)
+
+			err = sconn.Handshake()
+			if err != nil {
+				err = errors.Wrap(err, "Error with TLS handshake")
+				log.Println(err.Error())
+				ServerRelayAbort(conn, relay)
+				return
+			}
+
+			stream = sconn
+		}
+
+		conn.SetDeadline(time.Time{})
+		ServerConnHandler("http-proxy", stream, relay, metadata, m.readTimeout, ReadBytesStep)
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	req.Header.Del("Proxy-Connection")
+	req.Header.Del("Proxy-Authorization")
+	req.Close = true
+
+	// The request is sent in origin-form
+	buff := bytes.NewBuffer(make([]byte, 0))
+
+	err = req.Write(buff)
+	if err != nil {
+		err = errors.Wrap(err, "Error rewriting proxy request")
+		log.Println(err.Error())
+		httpProxyWriteStatus(conn, http.StatusBadRequest)
+		ServerRelayAbort(conn, relay)
+		return
+	}
+
+	stream = ServerBufferedConn{
+		Conn: conn,
+		Reader: io.MultiReader(buff, reader),
+	}
+
+	ServerConnHandler("http-proxy", stream, relay, metadata, m.readTimeout, ReadBytesStep)
+}
+
+// Target of CONNECT or absolute-URI requests
+func httpProxyTarget(req *http.Request) (string, int, error) {
+	hostport := req.Host
+	defaultPort := "443"
+
+	if req.Method != http.MethodConnect {
+		if ! req.URL.IsAbs() {
+			return "", 0, errors.Errorf("Request URI %q is not absolute", req.RequestURI)
+		}
+
+		if req.URL.Scheme != "http" {
+			return "", 0, errors.Errorf("Scheme %q is not supported", req.URL.Scheme)
+		}
+
+		hostport = req.URL.Host
+		defaultPort = "80"
+	}
+
+	if hostport == "" {
+		return "", 0, errors.New("Target host is empty")
+	}
+
+	host, p, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, p = strings.Trim(hostport, "[]"), defaultPort
+	}
+
+	port, err := strconv.ParseUint(p, 10, 16)
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "Error parsing port %q", p)
+	}
+
+	return host, int(port), nil
+}
+
+func httpProxyWriteStatus(conn net.Conn, status int) (error) {
+	_, err := conn.Write([]byte("HTTP/1.1 " + strconv.Itoa(status) + " " + http.StatusText(status) + "\r\n\r\n"))
+	return err
+}
+
+func (m *HTTPProxy) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.StringVar(&m.addr, "listen", "", "Listen on addr:port. If port is 0, random port will be assigned")
+	fs.DurationVar(&m.connectTimeout, "connect-timeout", 30 * time.Second, "Max amount of time to wait for a potential connection when pipeline is closing")
+	fs.DurationVar(&m.readTimeout, "read-timeout", 15 * time.Second, "Amout of time to wait reading from the connection")
+	fs.StringVar(&m.decrypt, "decrypt", "false", "TLS intercept CONNECT tunnels with own CA to decrypt the traffic. Use template, return boolean false or true.")
+	m.ca.SetFlagSet(fs)
+}
+
+func NewHTTPProxy() (Module) {
+	return &HTTPProxy{}
+}
+
+func (m *HTTPProxy) Init(in, out chan *Message, global *GlobalFlags) (err error) {
+	if m.readTimeout < 1 {
+		return errors.Errorf("Flag %q cannot be negative or zero", "--read-timeout")
+	}
+
+	if m.connectTimeout < 1 {
+		return errors.Errorf("Flag %q cannot be negative or zero", "--connect-timeout")
+	}
+
+	m.decryptTmpl, err = TLSParseDecrypt(m.decrypt)
+	if err != nil {
+		return errors.Wrap(err, "Error parsing template for \"--decrypt\" flag")
+	}
+
+	err = m.ca.Init()
+	if err != nil {
+		return err
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", m.addr)
+	if err != nil {
+		return errors.Wrap(err, "Unable to resolve tcp address")
+	}
+
+	var listener net.Listener
+	listener, err = net.ListenTCP("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "Unable to listen on tcp address")
+	}
+
+	if m.decrypt != "false" {
+		err = m.ca.Load()
+		if err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	log.Printf("Http-proxy listening on %s\n", listener.Addr().String())
+
+	go StartServer("http-proxy", listener, m.connectTimeout, func(conn net.Conn, relay *ServerRelayer) {
+		httpProxyHandler(conn, m, relay)
+	}, in, out, global)
+
+	return nil
+}
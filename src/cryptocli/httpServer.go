@@ -3,6 +3,7 @@ package main
 import (
 	"time"
 	"net/http"
+	"crypto/tls"
 	"github.com/tehmoon/errors"
 	"github.com/spf13/pflag"
 	"sync"
@@ -26,6 +27,7 @@ type HTTPServer struct {
 	headers []string
 	showClientHeaders bool
 	showServerHeaders bool
+	tlsOptions TLSServerOptions
 }
 
 var HTTPServerFormUploadPage = []byte(`
@@ -53,12 +55,13 @@ func (m *HTTPServer) SetFlagSet(fs *pflag.FlagSet, args []string) {
 	fs.StringVar(&m.user, "user", "", "Specify the required user for basic auth")
 	fs.StringVar(&m.password, "password", "", "Specify the required password for basic auth")
 	fs.StringVar(&m.redirect, "redirect-to", "", "Redirect the request to where the download can begin")
+	m.tlsOptions.SetFlagSet(fs)
 }
 
 func HTTPServerHandleResponse(m *HTTPServer, w http.ResponseWriter, req *http.Request, relay *HTTPServerRelayer) {
 	mc, cb, wg := relay.MessageChannel, relay.Callback, relay.Wg
 	defer wg.Done()
-	mc.Start(map[string]interface{}{
+	metadata := map[string]interface{}{
 		"redirect-to": m.redirect,
 		"url": req.URL.String(),
 		"headers": req.Header,
@@ -66,7 +69,13 @@ func HTTPServerHandleResponse(m *HTTPServer, w http.ResponseWriter, req *http.Re
 		"remote-addr": req.RemoteAddr,
 		"request-uri": req.RequestURI,
 		"addr": m.addr,
-	})
+	}
+
+	if req.TLS != nil {
+		TLSServerMetadata(req.TLS, metadata)
+	}
+
+	mc.Start(metadata)
 
 	_, inc := cb()
 	defer DrainChannel(inc, nil)
@@ -355,11 +364,21 @@ func (m *HTTPServer) Init(in, out chan *Message, global *GlobalFlags) (error) {
 		return errors.Wrap(err, "Unable to resolve tcp address")
 	}
 
-	listener, err := net.ListenTCP("tcp", addr)
+	tlsConfig, err := m.tlsOptions.Config()
+	if err != nil {
+		return errors.Wrap(err, "Error configuring TLS")
+	}
+
+	var listener net.Listener
+	listener, err = net.ListenTCP("tcp", addr)
 	if err != nil {
 		return errors.Wrap(err, "Unable to listen on tcp address")
 	}
 
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
 	log.Printf("HTTP Server is listening on address: %q\n", addr.String())
 
 	go func() {
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"sync"
+	"github.com/spf13/pflag"
+	"github.com/tehmoon/errors"
+	"log"
+	"io"
+	"hash"
+	"crypto"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"lukechampine.com/blake3"
+)
+
+func init() {
+	MODULELIST.Register("merkle", "Hash the input by chunks and compute a merkle root, an S3 multipart ETag or a BLAKE3 tree hash", NewMerkle)
+}
+
+/*
+merkle module splits the input into --chunk-size chunks and hashes each of them
+
+modes:
+	- merkle: the RFC 6962 tree hash using --algo. Leaves are the hash of
+	  0x00 followed by the chunk, parents are the hash of 0x01 followed by
+	  both children so a parent can never be presented as a leaf. A lonely
+	  node is promoted to the next level as is.
+	- s3-etag: chunks are hashed with md5, the root is the md5 of the concatenated
+	  chunk hashes followed by "-" and the number of chunks. Like aws-cli, a single
+	  chunk gives the md5 of the data.
+	- blake3: chunks are hashed with blake3, the root is the blake3 tree hash
+	  of the whole input.
+
+output:
+	- by default a line per chunk "<hex hash>  <index>" then a line "<hex root>  root"
+	- --manifest outputs a single JSON document instead
+	- --root-only outputs the raw root hash, or the ETag string for s3-etag
+*/
+
+type Merkle struct {
+	algo string
+	hash crypto.Hash
+	mode string
+	chunkSize int
+	manifest bool
+	rootOnly bool
+}
+
+type MerkleChunk struct {
+	Index int `json:"index"`
+	Offset int64 `json:"offset"`
+	Size int `json:"size"`
+	Hash string `json:"hash"`
+}
+
+type MerkleManifest struct {
+	Mode string `json:"mode"`
+	Algo string `json:"algo"`
+	ChunkSize int `json:"chunk_size"`
+	Size int64 `json:"size"`
+	Chunks []*MerkleChunk `json:"chunks"`
+	Root string `json:"root"`
+}
+
+func (m *Merkle) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.StringVar(&m.mode, "mode", "merkle", "Root computation: merkle, s3-etag or blake3")
+	fs.StringVar(&m.algo, "algo", "sha256", "Hash algorithm for the merkle mode. See the dgst module for the list")
+	fs.IntVar(&m.chunkSize, "chunk-size", 8 * 1024 * 1024, "Size of the chunks in bytes. Use the multipart part size for s3-etag")
+	fs.BoolVar(&m.manifest, "manifest", false, "Output a JSON manifest instead of lines")
+	fs.BoolVar(&m.rootOnly, "root-only", false, "Only output the raw root hash. Mutually exclusive with \"--manifest\"")
+}
+
+func (m *Merkle) Init(in, out chan *Message, global *GlobalFlags) (err error) {
+	if m.chunkSize < 1 {
+		return errors.Errorf("Flag %q has to be greater than 0", "--chunk-size")
+	}
+
+	if m.manifest && m.rootOnly {
+		return errors.Errorf("Flag %q is mutually exclusive with flag %q", "--manifest", "--root-only")
+	}
+
+	switch m.mode {
+		case "merkle":
+			m.hash, err = findDgst(m.algo)
+			if err != nil {
+				return err
+			}
+		case "s3-etag":
+			m.algo = "md5"
+		case "blake3":
+			m.algo = "blake3"
+		default:
+			return errors.Errorf("Mode %q is not supported in merkle module", m.mode)
+	}
+
+	go func(in, out chan *Message) {
+		wg := &sync.WaitGroup{}
+
+		init := false
+		mc := NewMessageChannel()
+
+		out <- &Message{
+			Type: MessageTypeChannel,
+			Interface: mc.Callback,
+		}
+
+		LOOP: for message := range in {
+			switch message.Type {
+				case MessageTypeTerminate:
+					if ! init {
+						close(mc.Channel)
+					}
+
+					wg.Wait()
+					out <- message
+					break LOOP
+				case MessageTypeChannel:
+					cb, ok := message.Interface.(MessageChannelFunc)
+					if ok {
+						if ! init {
+							init = true
+						} else {
+							mc = NewMessageChannel()
+
+							out <- &Message{
+								Type: MessageTypeChannel,
+								Interface: mc.Callback,
+							}
+						}
+
+						wg.Add(1)
+						go merkleStartHandler(m, cb, mc, wg)
+
+						if ! global.MultiStreams {
+							if ! init {
+								close(mc.Channel)
+							}
+							wg.Wait()
+							out <- &Message{Type: MessageTypeTerminate,}
+							break LOOP
+						}
+					}
+			}
+		}
+
+		wg.Wait()
+		// Last message will signal the closing of the channel
+		<- in
+		close(out)
+	}(in, out)
+
+	return nil
+}
+
+func (m *Merkle) newHash() (hash.Hash) {
+	switch m.mode {
+		case "s3-etag":
+			return md5.New()
+		case "blake3":
+			return blake3.New(32, nil)
+	}
+
+	return m.hash.New()
+}
+
+func merkleStartHandler(m *Merkle, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	mc.Start(map[string]interface{}{
+		"mode": m.mode,
+		"algo": m.algo,
+		"chunk-size": m.chunkSize,
+	})
+	_, inc := cb()
+	defer DrainChannel(inc, nil)
+
+	outc := mc.Channel
+	defer close(outc)
+
+	reader := NewChannelReader(inc)
+	brcb := ByteReaderCallbackFull(reader, m.chunkSize)
+
+	// The blake3 root is the hash of the whole stream
+	var tree hash.Hash
+	if m.mode == "blake3" {
+		tree = m.newHash()
+	}
+
+	manifest := &MerkleManifest{
+		Mode: m.mode,
+		Algo: m.algo,
+		ChunkSize: m.chunkSize,
+		Chunks: make([]*MerkleChunk, 0),
+	}
+
+	leaves := make([][]byte, 0)
+
+	for {
+		payload, err := brcb()
+		if payload != nil {
+			h := m.newHash()
+			if m.mode == "merkle" {
+				h.Write(MerkleLeafPrefix)
+			}
+			h.Write(payload)
+			sum := h.Sum(nil)
+
+			if tree != nil {
+				tree.Write(payload)
+			}
+
+			chunk := &MerkleChunk{
+				Index: len(leaves),
+				Offset: manifest.Size,
+				Size: len(payload),
+				Hash: hex.EncodeToString(sum),
+			}
+
+			leaves = append(leaves, sum)
+			manifest.Chunks = append(manifest.Chunks, chunk)
+			manifest.Size += int64(len(payload))
+
+			if ! m.manifest && ! m.rootOnly {
+				outc <- []byte(fmt.Sprintf("%s  %d\n", chunk.Hash, chunk.Index))
+			}
+		}
+
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				err = errors.Wrap(err, "Error reading chunk in merkle module")
+				log.Println(err.Error())
+				return
+			}
+
+			break
+		}
+	}
+
+	var root []byte
+
+	switch m.mode {
+		case "merkle":
+			root = MerkleRoot(m.hash, leaves)
+			manifest.Root = hex.EncodeToString(root)
+		case "s3-etag":
+			manifest.Root = MerkleS3ETag(leaves)
+			root = []byte(manifest.Root)
+		case "blake3":
+			root = tree.Sum(nil)
+			manifest.Root = hex.EncodeToString(root)
+	}
+
+	if m.rootOnly {
+		outc <- root
+		return
+	}
+
+	if m.manifest {
+		payload, err := json.Marshal(manifest)
+		if err != nil {
+			err = errors.Wrap(err, "Error marshaling manifest in merkle module")
+			log.Println(err.Error())
+			return
+		}
+
+		outc <- append(payload, '\n')
+		return
+	}
+
+	outc <- []byte(fmt.Sprintf("%s  root\n", manifest.Root))
+}
+
+// Domain separation of RFC 6962
+var (
+	MerkleLeafPrefix = []byte{0x00,}
+	MerkleNodePrefix = []byte{0x01,}
+)
+
+// Compute the merkle root from the leaf hashes, already prefixed by
+// MerkleLeafPrefix. Each parent is the hash of MerkleNodePrefix and both
+// children concatenated and a lonely node is promoted as is.
+// No leaves gives the hash of empty data.
+func MerkleRoot(algo crypto.Hash, leaves [][]byte) ([]byte) {
+	if len(leaves) == 0 {
+		return algo.New().Sum(nil)
+	}
+
+	level := leaves
+
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level) + 1) / 2)
+
+		for i := 0; i < len(level); i += 2 {
+			if i + 1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+
+			h := algo.New()
+			h.Write(MerkleNodePrefix)
+			h.Write(level[i])
+			h.Write(level[i + 1])
+			next = append(next, h.Sum(nil))
+		}
+
+		level = next
+	}
+
+	return level[0]
+}
+
+// Compute the ETag of an object uploaded to S3 using multipart upload
+// with parts' md5 sums.
+func MerkleS3ETag(sums [][]byte) (string) {
+	switch len(sums) {
+		case 0:
+			return hex.EncodeToString(md5.New().Sum(nil))
+		case 1:
+			return hex.EncodeToString(sums[0])
+	}
+
+	h := md5.New()
+	for _, sum := range sums {
+		h.Write(sum)
+	}
+
+	return fmt.Sprintf("%x-%d", h.Sum(nil), len(sums))
+}
+
+func NewMerkle() (Module) {
+	return &Merkle{}
+}
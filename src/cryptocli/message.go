@@ -89,3 +89,55 @@ func RelayMessages(in, out chan *Message) {
 	<- in
 	close(out)
 }
+
+// A fan-out lets a module send many channels out of a single incoming one,
+// like the files of an archive, each with its own metadata.
+// The first channel is the one the module has already announced, the
+// following ones are announced on the fly so downstream modules receive
+// them in order. Downstream modules need "--multi-streams" to read more
+// than the first channel.
+type MessageFanOut struct {
+	out chan *Message
+	mc *MessageChannel
+	count int
+}
+
+func NewMessageFanOut(out chan *Message, mc *MessageChannel) (*MessageFanOut) {
+	return &MessageFanOut{
+		out: out,
+		mc: mc,
+		count: 0,
+	}
+}
+
+// Returns a started channel. The caller must close it before calling
+// Next() again.
+func (fo *MessageFanOut) Next(metadata map[string]interface{}) (*MessageChannel) {
+	if fo.count > 0 {
+		fo.mc = NewMessageChannel()
+
+		fo.out <- &Message{
+			Type: MessageTypeChannel,
+			Interface: fo.mc.Callback,
+		}
+	}
+
+	fo.mc.Start(metadata)
+	fo.count++
+
+	return fo.mc
+}
+
+// Number of channels that have been sent
+func (fo *MessageFanOut) Count() (int) {
+	return fo.count
+}
+
+// Must be called once done. If nothing has been sent,
+// the announced channel is closed so downstream modules don't wait for it.
+func (fo *MessageFanOut) Close() {
+	if fo.count == 0 {
+		fo.mc.Start(nil)
+		close(fo.mc.Channel)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"sync"
+	"github.com/spf13/pflag"
+	"github.com/tehmoon/errors"
+	"log"
+	"time"
+	"crypto"
+	"crypto/hmac"
+	_ "crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"net/url"
+	"strconv"
+	"strings"
+	"fmt"
+	"bytes"
+)
+
+func init() {
+	MODULELIST.Register("otp", "Generate or verify TOTP/HOTP one time passwords", NewOTP)
+}
+
+type OTP struct {
+	secretPipe string
+	verify bool
+	skew int
+	config *OTPConfig
+	flags OTPFlags
+}
+
+type OTPFlags struct {
+	t string
+	algo string
+	digits int
+	period time.Duration
+	counter uint64
+}
+
+type OTPConfig struct {
+	Type string
+	Algo string
+	Hash crypto.Hash
+	Digits int
+	Period time.Duration
+	Counter uint64
+	Secret []byte
+}
+
+func (m *OTP) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.StringVar(&m.secretPipe, "secret-pipe", "", "Read the base32 secret or the otpauth:// URI from a pipeline. URI parameters take precedence over flags. IE: `\"env --var OTP_SECRET\"`")
+	fs.StringVar(&m.flags.t, "type", "totp", "Type of one time password: totp or hotp")
+	fs.StringVar(&m.flags.algo, "algo", "sha1", "Hash algorithm to use: sha1, sha256, sha512")
+	fs.IntVar(&m.flags.digits, "digits", 6, "Number of digits of the code")
+	fs.DurationVar(&m.flags.period, "period", 30 * time.Second, "Period of validity of a totp code")
+	fs.Uint64Var(&m.flags.counter, "counter", 0, "Counter to use for hotp")
+	fs.BoolVar(&m.verify, "verify", false, "Read the code from the input and output true or false instead of generating a code")
+	fs.IntVar(&m.skew, "skew", 1, "Number of periods before and after the current time for totp or counters after --counter for hotp to accept when verifying")
+}
+
+func (m *OTP) Init(in, out chan *Message, global *GlobalFlags) (err error) {
+	if m.secretPipe == "" {
+		return errors.Errorf("Flag %q must be specified in otp module", "--secret-pipe")
+	}
+
+	if m.skew < 0 {
+		return errors.Errorf("Flag %q cannot be negative", "--skew")
+	}
+
+	secret, err := ReadAllPipeline(m.secretPipe)
+	if err != nil {
+		return errors.Wrapf(err, "Error reading secret from %q flag in otp module", "--secret-pipe")
+	}
+
+	m.config, err = OTPParseSecret(string(secret[:]), &OTPConfig{
+		Type: m.flags.t,
+		Algo: m.flags.algo,
+		Digits: m.flags.digits,
+		Period: m.flags.period,
+		Counter: m.flags.counter,
+	})
+	if err != nil {
+		return errors.Wrap(err, "Error parsing secret in otp module")
+	}
+
+	go func(in, out chan *Message) {
+		wg := &sync.WaitGroup{}
+
+		init := false
+		mc := NewMessageChannel()
+
+		out <- &Message{
+			Type: MessageTypeChannel,
+			Interface: mc.Callback,
+		}
+
+		LOOP: for message := range in {
+			switch message.Type {
+				case MessageTypeTerminate:
+					if ! init {
+						close(mc.Channel)
+					}
+
+					wg.Wait()
+					out <- message
+					break LOOP
+				case MessageTypeChannel:
+					cb, ok := message.Interface.(MessageChannelFunc)
+					if ok {
+						if ! init {
+							init = true
+						} else {
+							mc = NewMessageChannel()
+
+							out <- &Message{
+								Type: MessageTypeChannel,
+								Interface: mc.Callback,
+							}
+						}
+
+						wg.Add(1)
+						go otpStartHandler(m, cb, mc, wg)
+
+						if ! global.MultiStreams {
+							if ! init {
+								close(mc.Channel)
+							}
+							wg.Wait()
+							out <- &Message{Type: MessageTypeTerminate,}
+							break LOOP
+						}
+					}
+			}
+		}
+
+		wg.Wait()
+		// Last message will signal the closing of the channel
+		<- in
+		close(out)
+	}(in, out)
+
+	return nil
+}
+
+func otpStartHandler(m *OTP, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	mc.Start(map[string]interface{}{
+		"type": m.config.Type,
+		"digits": m.config.Digits,
+		"period": m.config.Period.String(),
+		"counter": m.config.Counter,
+	})
+	_, inc := cb()
+	outc := mc.Channel
+	defer close(outc)
+
+	if ! m.verify {
+		wg.Add(1)
+		go DrainChannel(inc, wg)
+
+		outc <- []byte(OTPGenerate(m.config, time.Now()))
+		return
+	}
+
+	buff := bytes.NewBuffer(make([]byte, 0))
+	for payload := range inc {
+		buff.Write(payload)
+	}
+
+	ok := OTPVerify(m.config, strings.TrimSpace(buff.String()), time.Now(), m.skew)
+	if ! ok {
+		log.Println("One time password is invalid in otp module")
+	}
+
+	outc <- []byte(strconv.FormatBool(ok))
+}
+
+// Parse either a base32 secret or an otpauth:// URI. The defaults are used
+// for every parameter that the URI does not set.
+func OTPParseSecret(secret string, defaults *OTPConfig) (config *OTPConfig, err error) {
+	config = &OTPConfig{}
+	*config = *defaults
+
+	secret = strings.TrimSpace(secret)
+
+	if strings.HasPrefix(secret, "otpauth://") {
+		u, err := url.Parse(secret)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error parsing otpauth URI")
+		}
+
+		config.Type = u.Host
+		query := u.Query()
+
+		secret = query.Get("secret")
+
+		if v := query.Get("algorithm"); v != "" {
+			config.Algo = v
+		}
+
+		if v := query.Get("digits"); v != "" {
+			config.Digits, err = strconv.Atoi(v)
+			if err != nil {
+				return nil, errors.Wrap(err, "Error parsing digits parameter in otpauth URI")
+			}
+		}
+
+		if v := query.Get("period"); v != "" {
+			period, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, errors.Wrap(err, "Error parsing period parameter in otpauth URI")
+			}
+
+			config.Period = time.Duration(period) * time.Second
+		}
+
+		if v := query.Get("counter"); v != "" {
+			config.Counter, err = strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return nil, errors.Wrap(err, "Error parsing counter parameter in otpauth URI")
+			}
+		}
+	}
+
+	config.Type = strings.ToLower(config.Type)
+	if config.Type != "totp" && config.Type != "hotp" {
+		return nil, errors.Errorf("One time password type %q is not supported", config.Type)
+	}
+
+	switch strings.ToLower(config.Algo) {
+		case "sha1", "sha256", "sha512":
+			config.Hash, err = findDgst(config.Algo)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errors.Errorf("Hash algorithm %q is not supported for one time passwords", config.Algo)
+	}
+
+	if config.Digits < 1 || config.Digits > 10 {
+		return nil, errors.New("Number of digits has to be between 1 and 10")
+	}
+
+	if config.Period < time.Second {
+		return nil, errors.New("Period has to be at least one second")
+	}
+
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	secret = strings.TrimRight(secret, "=")
+
+	config.Secret, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error decoding base32 secret")
+	}
+
+	if len(config.Secret) == 0 {
+		return nil, errors.New("Secret is empty")
+	}
+
+	return config, nil
+}
+
+// RFC 4226 code for a counter value
+func OTPGenerateCounter(config *OTPConfig, counter uint64) (string) {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+
+	mac := hmac.New(config.Hash.New, config.Secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum) - 1] & 0x0f
+	code := uint64(binary.BigEndian.Uint32(sum[offset:offset + 4]) & 0x7fffffff)
+
+	mod := uint64(1)
+	for i := 0; i < config.Digits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", config.Digits, code % mod)
+}
+
+func otpTimeCounter(config *OTPConfig, t time.Time) (uint64) {
+	return uint64(t.Unix() / int64(config.Period / time.Second))
+}
+
+// Generate the code using the time for totp or the counter for hotp
+func OTPGenerate(config *OTPConfig, t time.Time) (string) {
+	if config.Type == "hotp" {
+		return OTPGenerateCounter(config, config.Counter)
+	}
+
+	return OTPGenerateCounter(config, otpTimeCounter(config, t))
+}
+
+// Verify the code allowing skew periods around t for totp and skew
+// counters after the configured one for hotp.
+func OTPVerify(config *OTPConfig, code string, t time.Time, skew int) (bool) {
+	if len(code) != config.Digits {
+		return false
+	}
+
+	var counters []uint64
+
+	if config.Type == "hotp" {
+		for i := 0; i <= skew; i++ {
+			counters = append(counters, config.Counter + uint64(i))
+		}
+	} else {
+		current := otpTimeCounter(config, t)
+
+		for i := -skew; i <= skew; i++ {
+			if i < 0 && uint64(-i) > current {
+				continue
+			}
+
+			counters = append(counters, uint64(int64(current) + int64(i)))
+		}
+	}
+
+	for _, counter := range counters {
+		if hmac.Equal([]byte(OTPGenerateCounter(config, counter)), []byte(code)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func NewOTP() (Module) {
+	return &OTP{}
+}
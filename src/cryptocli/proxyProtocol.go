@@ -0,0 +1,253 @@
+package main
+
+import (
+	"net"
+	"io"
+	"bufio"
+	"bytes"
+	"strings"
+	"strconv"
+	"encoding/binary"
+	"github.com/tehmoon/errors"
+)
+
+/*
+PROXY protocol headers from HAProxy's proxy-protocol.txt. Only TCP over IPv4
+and IPv6 is supported. Headers without addresses, "UNKNOWN" in v1 and "LOCAL"
+in v2, are parsed with nil addresses so the connection's addresses are kept.
+*/
+
+var ProxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// Longest v1 header including CRLF
+const ProxyProtocolV1MaxLength = 107
+
+type ProxyProtocolHeader struct {
+	Source *net.TCPAddr
+	Destination *net.TCPAddr
+}
+
+// Read a v1 or v2 header from the reader, the version is detected
+func ProxyProtocolRead(r *bufio.Reader) (*ProxyProtocolHeader, error) {
+	sig, err := r.Peek(len(ProxyProtocolV2Signature))
+	if err != nil && len(sig) < len("PROXY ") {
+		return nil, errors.Wrap(err, "Error reading proxy protocol signature")
+	}
+
+	if bytes.Equal(sig, ProxyProtocolV2Signature) {
+		return proxyProtocolReadV2(r)
+	}
+
+	if bytes.HasPrefix(sig, []byte("PROXY ")) {
+		return proxyProtocolReadV1(r)
+	}
+
+	return nil, errors.New("Proxy protocol header is missing")
+}
+
+func proxyProtocolReadV1(r *bufio.Reader) (*ProxyProtocolHeader, error) {
+	line := make([]byte, 0, ProxyProtocolV1MaxLength)
+
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, errors.Wrap(err, "Error reading proxy protocol v1 header")
+		}
+
+		line = append(line, b)
+
+		if bytes.HasSuffix(line, []byte("\r\n")) {
+			break
+		}
+
+		if len(line) == ProxyProtocolV1MaxLength {
+			return nil, errors.New("Proxy protocol v1 header is too long")
+		}
+	}
+
+	fields := strings.Split(string(line[:len(line) - 2]), " ")
+
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return &ProxyProtocolHeader{}, nil
+	}
+
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.Errorf("Malformed proxy protocol v1 header %q", string(line))
+	}
+
+	src, err := proxyProtocolParseAddr(fields[2], fields[4])
+	if err != nil {
+		return nil, errors.Wrap(err, "Error parsing source address")
+	}
+
+	dst, err := proxyProtocolParseAddr(fields[3], fields[5])
+	if err != nil {
+		return nil, errors.Wrap(err, "Error parsing destination address")
+	}
+
+	return &ProxyProtocolHeader{
+		Source: src,
+		Destination: dst,
+	}, nil
+}
+
+func proxyProtocolParseAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, errors.Errorf("Invalid ip %q", host)
+	}
+
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid port %q", port)
+	}
+
+	return &net.TCPAddr{IP: ip, Port: int(p),}, nil
+}
+
+func proxyProtocolReadV2(r *bufio.Reader) (*ProxyProtocolHeader, error) {
+	header := make([]byte, 16)
+
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading proxy protocol v2 header")
+	}
+
+	verCmd, family := header[12], header[13]
+	length := binary.BigEndian.Uint16(header[14:])
+
+	payload := make([]byte, length)
+
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading proxy protocol v2 addresses")
+	}
+
+	if verCmd >> 4 != 2 {
+		return nil, errors.Errorf("Proxy protocol version %d is not supported", verCmd >> 4)
+	}
+
+	// LOCAL command, connection made by the proxy itself
+	if verCmd & 0x0f == 0 {
+		return &ProxyProtocolHeader{}, nil
+	}
+
+	var size int
+
+	switch family {
+		case 0x11:
+			size = net.IPv4len
+		case 0x21:
+			size = net.IPv6len
+		default:
+			// Other families are only transported
+			return &ProxyProtocolHeader{}, nil
+	}
+
+	if len(payload) < size * 2 + 4 {
+		return nil, errors.New("Proxy protocol v2 addresses are truncated")
+	}
+
+	src := &net.TCPAddr{
+		IP: net.IP(payload[:size]),
+		Port: int(binary.BigEndian.Uint16(payload[size * 2:])),
+	}
+
+	dst := &net.TCPAddr{
+		IP: net.IP(payload[size:size * 2]),
+		Port: int(binary.BigEndian.Uint16(payload[size * 2 + 2:])),
+	}
+
+	return &ProxyProtocolHeader{
+		Source: src,
+		Destination: dst,
+	}, nil
+}
+
+// Encode the header in v1 or v2. Without both addresses
+// the header tells the receiver to keep the connection's.
+func ProxyProtocolEncode(version string, header *ProxyProtocolHeader) ([]byte, error) {
+	src, dst := header.Source, header.Destination
+	ipv6 := false
+
+	if src != nil && dst != nil {
+		ipv6 = src.IP.To4() == nil || dst.IP.To4() == nil
+	}
+
+	switch version {
+		case "v1":
+			if src == nil || dst == nil {
+				return []byte("PROXY UNKNOWN\r\n"), nil
+			}
+
+			family, srcIP, dstIP := "TCP4", src.IP.To4().String(), dst.IP.To4().String()
+			if ipv6 {
+				family, srcIP, dstIP = "TCP6", proxyProtocolFormatIPv6(src.IP), proxyProtocolFormatIPv6(dst.IP)
+			}
+
+			return []byte("PROXY " + family + " " + srcIP + " " + dstIP + " " + strconv.Itoa(src.Port) + " " + strconv.Itoa(dst.Port) + "\r\n"), nil
+		case "v2":
+			buff := bytes.NewBuffer(make([]byte, 0))
+			buff.Write(ProxyProtocolV2Signature)
+
+			if src == nil || dst == nil {
+				buff.Write([]byte{0x20, 0x00, 0x00, 0x00,})
+				return buff.Bytes(), nil
+			}
+
+			family, srcIP, dstIP := byte(0x11), []byte(src.IP.To4()), []byte(dst.IP.To4())
+			if ipv6 {
+				family, srcIP, dstIP = 0x21, []byte(src.IP.To16()), []byte(dst.IP.To16())
+			}
+
+			buff.Write([]byte{0x21, family,})
+			binary.Write(buff, binary.BigEndian, uint16(len(srcIP) * 2 + 4))
+			buff.Write(srcIP)
+			buff.Write(dstIP)
+			binary.Write(buff, binary.BigEndian, uint16(src.Port))
+			binary.Write(buff, binary.BigEndian, uint16(dst.Port))
+
+			return buff.Bytes(), nil
+	}
+
+	return nil, errors.Errorf("Proxy protocol version %q is not supported", version)
+}
+
+// IPv4 addresses are mapped so they are valid in TCP6 headers
+func proxyProtocolFormatIPv6(ip net.IP) (string) {
+	if ip.To4() != nil {
+		return "::ffff:" + ip.To4().String()
+	}
+
+	return ip.String()
+}
+
+// Header from the "remote-addr" and "local-addr" metadata of the upstream
+// channel. Addresses are nil when they are missing or not ip:port.
+func ProxyProtocolFromMetadata(metadata map[string]interface{}) (*ProxyProtocolHeader) {
+	header := &ProxyProtocolHeader{}
+
+	parse := func(key string) (*net.TCPAddr) {
+		value, ok := metadata[key].(string)
+		if ! ok {
+			return nil
+		}
+
+		host, port, err := net.SplitHostPort(value)
+		if err != nil {
+			return nil
+		}
+
+		addr, err := proxyProtocolParseAddr(host, port)
+		if err != nil {
+			return nil
+		}
+
+		return addr
+	}
+
+	header.Source = parse("remote-addr")
+	header.Destination = parse("local-addr")
+
+	return header
+}
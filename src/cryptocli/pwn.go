@@ -427,6 +427,55 @@ func PwnHandler(m *Pwn, cb MessageChannelFunc, mc *MessageChannel, js *ast.Progr
 		return val
 	})
 
+	vm.Set("otp", func(call otto.FunctionCall) otto.Value {
+		secret, err := call.Argument(0).ToString()
+		if err != nil {
+			err = errors.Wrapf(err, "Error casting first argument to string in %s\n", call.CallerLocation())
+			log.Println(err.Error())
+			return otto.UndefinedValue()
+		}
+
+		config, _, err := pwnOTPConfig(secret, call.Argument(1))
+		if err != nil {
+			err = errors.Wrapf(err, "Error parsing one time password options in %s\n", call.CallerLocation())
+			log.Println(err.Error())
+			return otto.UndefinedValue()
+		}
+
+		val, _ := otto.ToValue(OTPGenerate(config, time.Now()))
+
+		return val
+	})
+
+	vm.Set("otpVerify", func(call otto.FunctionCall) otto.Value {
+		secret, err := call.Argument(0).ToString()
+		if err != nil {
+			err = errors.Wrapf(err, "Error casting first argument to string in %s\n", call.CallerLocation())
+			log.Println(err.Error())
+			return otto.UndefinedValue()
+		}
+
+		code, err := call.Argument(1).ToString()
+		if err != nil {
+			err = errors.Wrapf(err, "Error casting second argument to string in %s\n", call.CallerLocation())
+			log.Println(err.Error())
+			return otto.UndefinedValue()
+		}
+
+		config, skew, err := pwnOTPConfig(secret, call.Argument(2))
+		if err != nil {
+			err = errors.Wrapf(err, "Error parsing one time password options in %s\n", call.CallerLocation())
+			log.Println(err.Error())
+			return otto.UndefinedValue()
+		}
+
+		if OTPVerify(config, code, time.Now(), skew) {
+			return otto.TrueValue()
+		}
+
+		return otto.FalseValue()
+	})
+
 	vm.Set("sleep", func(call otto.FunctionCall) otto.Value {
 		first, err := call.Argument(0).ToInteger()
 		if err != nil {
@@ -521,6 +570,80 @@ func PwnHandler(m *Pwn, cb MessageChannelFunc, mc *MessageChannel, js *ast.Progr
 	}(outc, metadata, vm, wg, cancel)
 }
 
+// Create the one time password configuration from the secret and the
+// optional options object: type, algo, digits, period, counter and skew.
+func pwnOTPConfig(secret string, options otto.Value) (config *OTPConfig, skew int, err error) {
+	defaults := &OTPConfig{
+		Type: "totp",
+		Algo: "sha1",
+		Digits: 6,
+		Period: 30 * time.Second,
+	}
+	skew = 1
+
+	exported, _ := options.Export()
+	if exported != nil {
+		v, ok := exported.(map[string]interface{})
+		if ! ok {
+			return nil, 0, errors.New("Options argument is not an object")
+		}
+
+		for key, arg := range v {
+			switch key {
+				case "type", "algo":
+					value, ok := arg.(string)
+					if ! ok {
+						return nil, 0, errors.Errorf("Option %q is not a string", key)
+					}
+
+					if key == "type" {
+						defaults.Type = value
+					} else {
+						defaults.Algo = value
+					}
+				case "digits", "period", "counter", "skew":
+					value, ok := pwnExportInt(arg)
+					if ! ok || value < 0 {
+						return nil, 0, errors.Errorf("Option %q is not a positive integer", key)
+					}
+
+					switch key {
+						case "digits":
+							defaults.Digits = int(value)
+						case "period":
+							defaults.Period = time.Duration(value) * time.Second
+						case "counter":
+							defaults.Counter = uint64(value)
+						case "skew":
+							skew = int(value)
+					}
+				default:
+					return nil, 0, errors.Errorf("Option %q is unknown", key)
+			}
+		}
+	}
+
+	config, err = OTPParseSecret(secret, defaults)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return config, skew, nil
+}
+
+func pwnExportInt(v interface{}) (int64, bool) {
+	switch i := v.(type) {
+		case int64:
+			return i, true
+		case int:
+			return int64(i), true
+		case float64:
+			return int64(i), float64(int64(i)) == i
+	}
+
+	return 0, false
+}
+
 func NewPwn() (Module) {
 	return &Pwn{}
 }
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"github.com/tehmoon/errors"
+	"sync"
+	"log"
+	"github.com/spf13/pflag"
+	"os"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+func init() {
+	MODULELIST.Register("read-dir", "Walk a directory tree or a glob and send each file to its own channel", NewReadDir)
+}
+
+/*
+read-dir module walks the tree once then terminates the pipeline. Files are
+sent one after the other, each to its own channel. Channels that come back
+from the end of the pipeline are discarded.
+
+Glob patterns match the path relative to the root, "**" matches any number
+of directories. Patterns without a "/" match the file's name at any depth.
+*/
+
+type ReadDir struct {
+	path string
+	includes []string
+	excludes []string
+	symlinks string
+	maxDepth int
+	root string
+	glob []string
+}
+
+func (m *ReadDir) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.StringVar(&m.path, "path", "", "Directory to walk or glob pattern. IE: \"logs/**/*.log\"")
+	fs.StringArrayVar(&m.includes, "include", []string{}, "Only send files matching one of the glob patterns")
+	fs.StringArrayVar(&m.excludes, "exclude", []string{}, "Skip files and directories matching one of the glob patterns")
+	fs.StringVar(&m.symlinks, "symlinks", "file", "Symlink policy: skip, file to only follow links to files or follow to also walk linked directories")
+	fs.IntVar(&m.maxDepth, "max-depth", -1, "Maximum number of directories to descend, 0 only reads the root. Negative is unlimited")
+}
+
+func (m *ReadDir) Init(in, out chan *Message, global *GlobalFlags) (err error) {
+	if m.path == "" {
+		return errors.Errorf("Flag %q must be present", "--path")
+	}
+
+	if ! global.MultiStreams {
+		return errors.Errorf("Flag %q is required since each file is sent to its own channel", "--multi-streams")
+	}
+
+	switch m.symlinks {
+		case "skip", "file", "follow":
+		default:
+			return errors.Errorf("Symlink policy %q is not supported in read-dir module", m.symlinks)
+	}
+
+	for _, pattern := range append(m.includes, m.excludes...) {
+		_, err = filepath.Match(pattern, "")
+		if err != nil {
+			return errors.Wrapf(err, "Err compiling pattern %q", pattern)
+		}
+	}
+
+	m.root, m.glob = ReadDirSplitGlob(m.path)
+
+	for _, pattern := range m.glob {
+		_, err = filepath.Match(pattern, "")
+		if err != nil {
+			return errors.Wrapf(err, "Err compiling pattern %q", m.path)
+		}
+	}
+
+	go func(in, out chan *Message) {
+		wg := &sync.WaitGroup{}
+
+		init := false
+		mc := NewMessageChannel()
+
+		out <- &Message{
+			Type: MessageTypeChannel,
+			Interface: mc.Callback,
+		}
+
+		done := make(chan struct{})
+
+		LOOP: for {
+			select {
+				case <- done:
+					wg.Wait()
+					out <- &Message{Type: MessageTypeTerminate,}
+					break LOOP
+				case message, opened := <- in:
+					if ! opened {
+						break LOOP
+					}
+
+					switch message.Type {
+						case MessageTypeTerminate:
+							if ! init {
+								close(mc.Channel)
+							}
+
+							wg.Wait()
+							out <- message
+							break LOOP
+						case MessageTypeChannel:
+							cb, ok := message.Interface.(MessageChannelFunc)
+							if ok {
+								// The tree is walked once, the other channels
+								// are coming back from the end of the pipeline.
+								if init {
+									go func(cb MessageChannelFunc) {
+										_, inc := cb()
+										DrainChannel(inc, nil)
+									}(cb)
+
+									continue
+								}
+
+								init = true
+
+								wg.Add(1)
+								go readDirStartHandler(m, out, cb, mc, wg, done)
+							}
+					}
+			}
+		}
+
+		wg.Wait()
+
+		// Discard channels until the last message which will signal
+		// the closing of the channel
+		for message := range in {
+			if message.Type == MessageTypeTerminate {
+				break
+			}
+
+			cb, ok := message.Interface.(MessageChannelFunc)
+			if ok {
+				go func(cb MessageChannelFunc) {
+					_, inc := cb()
+					DrainChannel(inc, nil)
+				}(cb)
+			}
+		}
+
+		close(out)
+	}(in, out)
+
+	return nil
+}
+
+func readDirStartHandler(m *ReadDir, out chan *Message, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup, done chan struct{}) {
+	defer wg.Done()
+	defer close(done)
+
+	// The channel comes back from the end of the pipeline
+	go func(cb MessageChannelFunc) {
+		_, inc := cb()
+		DrainChannel(inc, nil)
+	}(cb)
+
+	fanOut := NewMessageFanOut(out, mc)
+	defer fanOut.Close()
+
+	info, err := os.Stat(m.root)
+	if err != nil {
+		err = errors.Wrap(err, "Error reading root in read-dir module")
+		log.Println(err.Error())
+		return
+	}
+
+	if ! info.IsDir() {
+		if len(m.glob) == 0 {
+			readDirSendFile(fanOut, m.root, filepath.Base(m.root), info)
+		}
+
+		return
+	}
+
+	realRoot, _ := filepath.EvalSymlinks(m.root)
+
+	readDirWalk(m, fanOut, m.root, "", 0, map[string]bool{realRoot: true,})
+}
+
+// Walk the directory in lexical order. Visited holds the real path
+// of the directories being walked to avoid symlink loops.
+func readDirWalk(m *ReadDir, fanOut *MessageFanOut, dir, rel string, depth int, visited map[string]bool) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		err = errors.Wrapf(err, "Error reading directory %q in read-dir module", dir)
+		log.Println(err.Error())
+		return
+	}
+
+	for _, info := range infos {
+		p := filepath.Join(dir, info.Name())
+		name := filepath.ToSlash(filepath.Join(rel, info.Name()))
+
+		if info.Mode() & os.ModeSymlink != 0 {
+			if m.symlinks == "skip" {
+				continue
+			}
+
+			info, err = os.Stat(p)
+			if err != nil {
+				err = errors.Wrapf(err, "Error following symlink %q in read-dir module", p)
+				log.Println(err.Error())
+				continue
+			}
+
+			if info.IsDir() && m.symlinks != "follow" {
+				continue
+			}
+		}
+
+		if ReadDirMatchAny(m.excludes, name) {
+			continue
+		}
+
+		if info.IsDir() {
+			if m.maxDepth >= 0 && depth >= m.maxDepth {
+				continue
+			}
+
+			real, err := filepath.EvalSymlinks(p)
+			if err != nil || visited[real] {
+				continue
+			}
+
+			visited[real] = true
+			readDirWalk(m, fanOut, p, name, depth + 1, visited)
+			delete(visited, real)
+
+			continue
+		}
+
+		if ! info.Mode().IsRegular() {
+			continue
+		}
+
+		if len(m.glob) > 0 && ! ReadDirMatch(m.glob, strings.Split(name, "/")) {
+			continue
+		}
+
+		if len(m.includes) > 0 && ! ReadDirMatchAny(m.includes, name) {
+			continue
+		}
+
+		readDirSendFile(fanOut, p, name, info)
+	}
+}
+
+func readDirSendFile(fanOut *MessageFanOut, p, name string, info os.FileInfo) {
+	file, err := os.Open(p)
+	if err != nil {
+		err = errors.Wrap(err, "Error opening file")
+		log.Println(err.Error())
+		return
+	}
+	defer file.Close()
+
+	metadata := map[string]interface{}{
+		"index": fanOut.Count(),
+		"path": p,
+		"name": name,
+		"size": info.Size(),
+		"mode": info.Mode(),
+		"mtime": info.ModTime(),
+	}
+
+	mc := fanOut.Next(metadata)
+	defer close(mc.Channel)
+
+	err = ReadBytesSendMessages(file, mc.Channel)
+	if err != nil && err != io.EOF {
+		err = errors.Wrapf(err, "Error reading file %q", p)
+		log.Println(err.Error())
+	}
+}
+
+// Split the path into the directory to walk and the glob pattern parts.
+// The root is the longest leading path without any meta characters.
+func ReadDirSplitGlob(p string) (root string, glob []string) {
+	parts := strings.Split(filepath.ToSlash(p), "/")
+
+	for i, part := range parts {
+		if strings.ContainsAny(part, "*?[") {
+			root = strings.Join(parts[:i], "/")
+			if root == "" && i > 0 {
+				root = "/"
+			}
+
+			if root == "" {
+				root = "."
+			}
+
+			return filepath.FromSlash(root), parts[i:]
+		}
+	}
+
+	return p, nil
+}
+
+// Match the slash separated name against the pattern parts where "**"
+// matches zero or more parts.
+func ReadDirMatch(pattern, name []string) (bool) {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if ReadDirMatch(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+
+		ok, _ := filepath.Match(pattern[0], name[0])
+		if ! ok {
+			return false
+		}
+
+		pattern = pattern[1:]
+		name = name[1:]
+	}
+
+	return len(name) == 0
+}
+
+// Patterns without a "/" match the last part of the name
+func ReadDirMatchAny(patterns []string, name string) (bool) {
+	parts := strings.Split(name, "/")
+
+	for _, pattern := range patterns {
+		if ! strings.Contains(pattern, "/") {
+			ok, _ := filepath.Match(pattern, parts[len(parts) - 1])
+			if ok {
+				return true
+			}
+
+			continue
+		}
+
+		if ReadDirMatch(strings.Split(pattern, "/"), parts) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func NewReadDir() (Module) {
+	return &ReadDir{}
+}
@@ -9,18 +9,43 @@ import (
 	"path/filepath"
 	"text/template"
 	"bytes"
+	"io"
+	"time"
+	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
 )
 
 type ReadFile struct {
 	path string
+	follow bool
+	fromEnd bool
+	state string
+	pollInterval time.Duration
+	stateInterval time.Duration
 }
 
+// Saved offset of a file. The fingerprint is the sha256 of its first bytes,
+// if it doesn't match when resuming, the file has been rotated.
+type ReadFileState struct {
+	Offset int64 `json:"offset"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+const ReadFileFingerprintSize = 1024
+
 func init() {
 	MODULELIST.Register("read-file", "Read file from filesystem", NewReadFile)
 }
 
 func (m *ReadFile) SetFlagSet(fs *pflag.FlagSet, args []string) {
 	fs.StringVar(&m.path , "path", "", "File's path using templates")
+	fs.BoolVar(&m.follow, "follow", false, "Keep reading data appended to the file. Rotation and truncation are detected")
+	fs.BoolVar(&m.fromEnd, "from-end", false, "Start reading from the end of the file when there is no saved offset. Requires \"--follow\"")
+	fs.StringVar(&m.state, "state", "", "Metadata template for the file's path where the offset is persisted to resume reading")
+	fs.DurationVar(&m.pollInterval, "poll-interval", time.Second, "Time to wait before checking the file again when following")
+	fs.DurationVar(&m.stateInterval, "state-interval", time.Second, "Minimum time between two saves of the offset while reading. It is always saved once the end of the file is reached")
 }
 
 func (m *ReadFile) Init(in, out chan *Message, global *GlobalFlags) (err error) {
@@ -35,6 +60,27 @@ func (m *ReadFile) Init(in, out chan *Message, global *GlobalFlags) (err error)
 		return errors.Wrap(err, "Error parsing template for \"--path\" flag")
 	}
 
+	if m.fromEnd && ! m.follow {
+		return errors.Errorf("Flag %q requires flag %q", "--from-end", "--follow")
+	}
+
+	if m.pollInterval <= 0 {
+		return errors.Errorf("Flag %q has to be greater than 0", "--poll-interval")
+	}
+
+	if m.stateInterval <= 0 {
+		return errors.Errorf("Flag %q has to be greater than 0", "--state-interval")
+	}
+
+	var tplState *template.Template
+
+	if m.state != "" {
+		tplState, err = template.New("root").Parse(m.state)
+		if err != nil {
+			return errors.Wrapf(err, "Error parsing template for %q flag", "--state")
+		}
+	}
+
 	go func(m *ReadFile, in, out chan *Message) {
 		wg := &sync.WaitGroup{}
 
@@ -70,7 +116,7 @@ func (m *ReadFile) Init(in, out chan *Message, global *GlobalFlags) (err error)
 						}
 
 						wg.Add(1)
-						go func() {
+						go func(cb MessageChannelFunc, mc *MessageChannel) {
 							defer wg.Done()
 
 							mc.Start(map[string]interface{}{
@@ -90,6 +136,21 @@ func (m *ReadFile) Init(in, out chan *Message, global *GlobalFlags) (err error)
 							p := filepath.Clean(string(buff.Bytes()[:]))
 							buff.Reset()
 
+							state := ""
+							if tplState != nil {
+								err = tplState.Execute(buff, metadata)
+								if err != nil {
+									err = errors.Wrap(err, "Error executing template state")
+									log.Println(err.Error())
+									close(mc.Channel)
+									DrainChannel(inc, nil)
+									return
+								}
+
+								state = filepath.Clean(string(buff.Bytes()[:]))
+								buff.Reset()
+							}
+
 							outc := mc.Channel
 
 							wg.Add(2)
@@ -98,21 +159,14 @@ func (m *ReadFile) Init(in, out chan *Message, global *GlobalFlags) (err error)
 								defer wg.Done()
 								defer close(outc)
 
-								file, err := os.Open(p)
-								if err != nil {
-									err = errors.Wrap(err, "Error opening file")
-									log.Println(err.Error())
-									return
-								}
-
-								err = ReadBytesSendMessages(file, outc)
+								err := readFileStart(m, p, state, outc)
 								if err != nil {
 									err = errors.Wrap(err, "Error reading file")
 									log.Println(err.Error())
 									return
 								}
 							}(m, outc, wg)
-						}()
+						}(cb, mc)
 
 						if ! global.MultiStreams {
 							wg.Wait()
@@ -136,3 +190,240 @@ func (m *ReadFile) Init(in, out chan *Message, global *GlobalFlags) (err error)
 func NewReadFile() (Module) {
 	return &ReadFile{}
 }
+
+// Read the file until EOF. If following, wait for more data and reopen
+// the path when it has been rotated.
+func readFileStart(m *ReadFile, p, state string, outc chan []byte) (error) {
+	file, err := os.Open(p)
+	if err != nil {
+		return errors.Wrap(err, "Error opening file")
+	}
+	defer func() {
+		file.Close()
+	}()
+
+	offset, err := readFileResume(m, file, state)
+	if err != nil {
+		return err
+	}
+
+	// The saved offset is behind what has been sent so the data is sent
+	// again rather than lost when resuming.
+	saved := offset
+	lastSave := time.Now()
+
+	save := func() {
+		if state == "" || saved == offset {
+			return
+		}
+
+		err := ReadFileSaveState(file, state, offset)
+		if err != nil {
+			err = errors.Wrap(err, "Error saving state")
+			log.Println(err.Error())
+			return
+		}
+
+		saved = offset
+		lastSave = time.Now()
+	}
+	defer save()
+
+	step := func(payload []byte) (bool) {
+		outc <- payload
+		offset += int64(len(payload))
+
+		if time.Since(lastSave) >= m.stateInterval {
+			save()
+		}
+
+		return true
+	}
+
+	for {
+		err = ReadBytesStep(file, step)
+		if err != io.EOF {
+			return err
+		}
+
+		save()
+
+		if ! m.follow {
+			return nil
+		}
+
+		time.Sleep(m.pollInterval)
+
+		info, err := os.Stat(p)
+		if err != nil {
+			// The file might be in the middle of a rotation
+			continue
+		}
+
+		current, err := file.Stat()
+		if err != nil {
+			return err
+		}
+
+		if ! os.SameFile(info, current) {
+			// Read what has been written before the rotation
+			err = ReadBytesStep(file, step)
+			if err != io.EOF {
+				return err
+			}
+
+			save()
+			file.Close()
+
+			file, err = os.Open(p)
+			if err != nil {
+				return errors.Wrap(err, "Error opening rotated file")
+			}
+
+			log.Printf("File %q has been rotated\n", p)
+			offset = 0
+			saved = -1
+
+			continue
+		}
+
+		if info.Size() < offset {
+			_, err = file.Seek(0, io.SeekStart)
+			if err != nil {
+				return err
+			}
+
+			log.Printf("File %q has been truncated\n", p)
+			offset = 0
+			saved = -1
+		}
+	}
+}
+
+// Returns the offset to start reading from and seek the file to it
+func readFileResume(m *ReadFile, file *os.File, state string) (offset int64, err error) {
+	if state != "" {
+		s, err := ReadFileLoadState(state)
+		if err != nil {
+			return 0, errors.Wrap(err, "Error loading state")
+		}
+
+		if s != nil {
+			fingerprint, err := ReadFileFingerprint(file, s.Offset)
+			if err != nil {
+				return 0, err
+			}
+
+			if fingerprint == s.Fingerprint {
+				return file.Seek(s.Offset, io.SeekStart)
+			}
+
+			log.Printf("File %q does not match the saved state, reading from the start\n", file.Name())
+			return 0, nil
+		}
+	}
+
+	if m.fromEnd {
+		return file.Seek(0, io.SeekEnd)
+	}
+
+	return 0, nil
+}
+
+// Hash the first bytes of the file up to offset. If the file is smaller
+// than offset, the fingerprint is empty.
+func ReadFileFingerprint(file *os.File, offset int64) (string, error) {
+	size := offset
+	if size > ReadFileFingerprintSize {
+		size = ReadFileFingerprintSize
+	}
+
+	buff := make([]byte, size)
+
+	_, err := file.ReadAt(buff, 0)
+	if err != nil {
+		if err == io.EOF {
+			return "", nil
+		}
+
+		return "", err
+	}
+
+	sum := sha256.Sum256(buff)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Returns nil if there is no state yet
+func ReadFileLoadState(p string) (*ReadFileState, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	state := &ReadFileState{}
+
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error parsing state file %q", p)
+	}
+
+	return state, nil
+}
+
+// The state is written and synced to a temporary file then renamed
+// so it is never partially written, even after a crash.
+func ReadFileSaveState(file *os.File, p string, offset int64) (error) {
+	fingerprint, err := ReadFileFingerprint(file, offset)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(&ReadFileState{
+		Offset: offset,
+		Fingerprint: fingerprint,
+	})
+	if err != nil {
+		return err
+	}
+
+	tmp := p + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0640)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, p)
+	if err != nil {
+		return err
+	}
+
+	// Persist the rename
+	dir, err := os.Open(filepath.Dir(p))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
@@ -67,6 +67,25 @@ func ReadBytesStep(r io.Reader, cb func([]byte) (bool)) (error) {
 	return err
 }
 
+// Read one packet per read with a buffer big enough for any packet so
+// boundaries are preserved. The callback will pass the packet. If the
+// callback return false, it stops reading and returns EOF
+func ReadPacketsStep(r io.Reader, cb func([]byte) (bool)) (error) {
+	for {
+		buff := make([]byte, PacketMaxSize)
+
+		i, err := r.Read(buff)
+		if err != nil {
+			return err
+		}
+
+		cont := cb(buff[:i])
+		if ! cont {
+			return io.EOF
+		}
+	}
+}
+
 type MessageReader struct {
 	reader *io.PipeReader
 	writer *io.PipeWriter
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"sync"
+	"time"
+	"log"
+	"io"
+	"net"
+	"github.com/tehmoon/errors"
+)
+
+// Each accepted connection announces a new channel and is paired with
+// a channel coming from the pipeline. The relayer holds both so the
+// connection's handler can start.
+type ServerRelayer struct {
+	Callback MessageChannelFunc
+	MessageChannel *MessageChannel
+	Wg *sync.WaitGroup
+}
+
+// Handler serving an accepted connection, it must call relay.Wg.Done()
+type ServerHandler func(conn net.Conn, relay *ServerRelayer)
+
+// Accept connections from the listener and relay them to the handler until
+// the pipeline terminates. Without --multi-streams, only one connection is
+// served. Name is used in logs.
+func StartServer(name string, listener net.Listener, connectTimeout time.Duration, handler ServerHandler, in, out chan *Message, global *GlobalFlags) {
+	wg := &sync.WaitGroup{}
+	relayer := make(chan *ServerRelayer)
+	connc := make(chan struct{})
+	cancel := make(chan struct{})
+
+	donec := make(chan struct{}, global.MaxConcurrentStreams)
+
+	go func(l net.Listener, relayer chan *ServerRelayer, connc, done, cancel chan struct{}) {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				err = errors.Wrapf(err, "Error accepting %s connection", name)
+				log.Println(err.Error())
+				return
+			}
+
+			go serverServe(conn, handler, relayer, connc, donec, cancel)
+		}
+	}(listener, relayer, connc, donec, cancel)
+
+	ticker := time.NewTicker(connectTimeout)
+
+	cbs := make([]MessageChannelFunc, 0)
+	mcs := make([]*MessageChannel, 0)
+
+	LOOP: for {
+		select {
+			case <- ticker.C:
+				ticker.Stop()
+				close(cancel)
+				wg.Wait()
+				log.Println("Connect timeout reached, nobody connected and no messages from inputs were received")
+				out <- &Message{
+					Type: MessageTypeTerminate,
+				}
+
+				break LOOP
+			case _, opened := <- connc:
+				if ! opened {
+					break LOOP
+				}
+
+				mc := NewMessageChannel()
+
+				out <- &Message{
+					Type: MessageTypeChannel,
+					Interface: mc.Callback,
+				}
+
+				if len(cbs) == 0 {
+					mcs = append(mcs, mc)
+					continue
+				}
+
+				wg.Add(1)
+
+				cb := cbs[0]
+				cbs = cbs[1:]
+
+				relayer <- &ServerRelayer{
+					Callback: cb,
+					MessageChannel: mc,
+					Wg: wg,
+				}
+
+				if ! global.MultiStreams {
+					close(cancel)
+					wg.Wait()
+					out <- &Message{Type: MessageTypeTerminate,}
+					break LOOP
+				}
+
+			case message, opened := <- in:
+				ticker.Stop()
+				if ! opened {
+					close(cancel)
+					wg.Wait()
+					out <- &Message{
+						Type: MessageTypeTerminate,
+					}
+					break LOOP
+				}
+
+				switch message.Type {
+					case MessageTypeTerminate:
+						close(cancel)
+						wg.Wait()
+						out <- message
+						break LOOP
+					case MessageTypeChannel:
+						cb, ok := message.Interface.(MessageChannelFunc)
+						if ok {
+							if len(mcs) == 0 {
+								cbs = append(cbs, cb)
+								continue
+							}
+
+							wg.Add(1)
+							mc := mcs[0]
+							mcs = mcs[1:]
+
+							relayer <- &ServerRelayer{
+								Callback: cb,
+								MessageChannel: mc,
+								Wg: wg,
+							}
+
+							if ! global.MultiStreams {
+								close(cancel)
+								wg.Wait()
+								out <- &Message{Type: MessageTypeTerminate,}
+								break LOOP
+							}
+						}
+				}
+		}
+	}
+
+	listener.Close()
+	close(connc)
+
+	for _, mc := range mcs {
+		close(mc.Channel)
+	}
+
+	for _, cb := range cbs {
+		_, inc := cb()
+		DrainChannel(inc, nil)
+	}
+
+	wg.Wait()
+	close(relayer)
+	close(donec)
+
+	<- in
+	close(out)
+}
+
+func serverServe(conn net.Conn, handler ServerHandler, relayer chan *ServerRelayer, connc, donec, cancel chan struct{}) {
+	donec <- struct{}{}
+	defer func(donec chan struct{}) {
+		<- donec
+	}(donec)
+
+	select {
+		case relay, opened := <- relayer:
+			if ! opened {
+				return
+			}
+
+			handler(conn, relay)
+			return
+		case <- cancel:
+			return
+		default:
+	}
+
+	select {
+		case connc <- struct{}{}:
+		case <- cancel:
+			return
+	}
+
+	select {
+		case relay, opened := <- relayer:
+			if ! opened {
+				return
+			}
+
+			handler(conn, relay)
+			return
+		case <- cancel:
+			return
+	}
+}
+
+// Reads from the reader instead of the connection so bytes buffered
+// while parsing a preamble are not lost
+type ServerBufferedConn struct {
+	net.Conn
+	Reader io.Reader
+}
+
+func (c ServerBufferedConn) Read(b []byte) (int, error) {
+	return c.Reader.Read(b)
+}
+
+// Close the relayed channels without serving the connection,
+// used when the connection is rejected before being relayed.
+func ServerRelayAbort(conn net.Conn, relay *ServerRelayer) {
+	defer relay.Wg.Done()
+	conn.Close()
+
+	relay.MessageChannel.Start(nil)
+	close(relay.MessageChannel.Channel)
+
+	_, inc := relay.Callback()
+	DrainChannel(inc, nil)
+}
+
+// Read from the connection using step until the read timeout and write
+// the incoming channel to it. The connection is closed when either is done.
+func ServerConnHandler(name string, conn net.Conn, relay *ServerRelayer, metadata map[string]interface{}, readTimeout time.Duration, step func(io.Reader, func([]byte) (bool)) (error)) {
+	mc, cb, wg := relay.MessageChannel, relay.Callback, relay.Wg
+	defer wg.Done()
+	defer conn.Close()
+
+	mc.Start(metadata)
+
+	_, inc := cb()
+	outc := mc.Channel
+	defer close(outc)
+
+	log.Printf("Client %q is connected\n", conn.RemoteAddr().String())
+	go func(conn net.Conn, inc chan []byte) {
+		defer conn.Close()
+
+		for payload := range inc {
+			_, err := conn.Write(payload)
+			if err != nil {
+				err = errors.Wrapf(err, "Error writing to %s connection", name)
+				log.Println(err.Error())
+				break
+			}
+		}
+
+		DrainChannel(inc, nil)
+	}(conn, inc)
+
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+
+	err := step(conn, func(payload []byte) bool {
+		outc <- payload
+		conn.SetReadDeadline(time.Now().Add(readTimeout))
+
+		return true
+	})
+	if err != nil {
+		err = errors.Wrapf(err, "Error reading from %s socket", name)
+		log.Println(err.Error())
+		return
+	}
+}
+
+/*
+Packet servers create a session when a datagram is received from a new
+remote address. Each datagram is sent as a message and each incoming message
+is sent back as a datagram to that address. The session ends after the idle
+timeout or when the incoming channel is closed, the next datagram from that
+address creates a new session.
+
+Datagrams from unbound unix sockets don't have an address, they all belong to
+the same session and nothing can be sent back.
+*/
+
+type packetServerSession struct {
+	// Nil for unbound unix sockets
+	addr net.Addr
+	key string
+	datac chan []byte
+}
+
+type packetServerSessions struct {
+	sync.Mutex
+	sessions map[string]*packetServerSession
+	closed bool
+}
+
+// Biggest datagram read by packet servers, it fits any UDP datagram
+const PacketMaxSize = UDPMaxDatagramSize
+
+// Number of datagrams waiting to be read by a session
+// before new ones are dropped.
+const PacketServerSessionBacklog = 128
+
+// Serve sessions from the packet connection until the pipeline terminates.
+// Without --multi-streams, only the first remote address is served.
+// Name is used in logs and addr is set in metadata.
+func StartPacketServer(name string, conn net.PacketConn, addr string, connectTimeout, idleTimeout time.Duration, in, out chan *Message, global *GlobalFlags) {
+	wg := &sync.WaitGroup{}
+	sessionc := make(chan *packetServerSession)
+	cancel := make(chan struct{})
+
+	sessions := &packetServerSessions{
+		sessions: make(map[string]*packetServerSession),
+	}
+
+	go packetServerRead(name, conn, sessions, sessionc, cancel, global.MultiStreams)
+
+	ticker := time.NewTicker(connectTimeout)
+
+	cbs := make([]MessageChannelFunc, 0)
+	pending := make([]*packetServerSession, 0)
+	mcs := make([]*MessageChannel, 0)
+
+	start := func(cb MessageChannelFunc, mc *MessageChannel, session *packetServerSession) {
+		wg.Add(1)
+		go packetServerHandler(name, conn, addr, idleTimeout, sessions, session, cb, mc, wg)
+	}
+
+	LOOP: for {
+		select {
+			case <- ticker.C:
+				ticker.Stop()
+				log.Println("Connect timeout reached, nobody sent datagrams and no messages from inputs were received")
+				out <- &Message{
+					Type: MessageTypeTerminate,
+				}
+
+				break LOOP
+			case session := <- sessionc:
+				mc := NewMessageChannel()
+
+				out <- &Message{
+					Type: MessageTypeChannel,
+					Interface: mc.Callback,
+				}
+
+				if len(cbs) == 0 {
+					mcs = append(mcs, mc)
+					pending = append(pending, session)
+					continue
+				}
+
+				cb := cbs[0]
+				cbs = cbs[1:]
+
+				start(cb, mc, session)
+
+				if ! global.MultiStreams {
+					wg.Wait()
+					out <- &Message{Type: MessageTypeTerminate,}
+					break LOOP
+				}
+			case message, opened := <- in:
+				ticker.Stop()
+				if ! opened {
+					wg.Wait()
+					out <- &Message{
+						Type: MessageTypeTerminate,
+					}
+					break LOOP
+				}
+
+				switch message.Type {
+					case MessageTypeTerminate:
+						wg.Wait()
+						out <- message
+						break LOOP
+					case MessageTypeChannel:
+						cb, ok := message.Interface.(MessageChannelFunc)
+						if ok {
+							if len(mcs) == 0 {
+								cbs = append(cbs, cb)
+								continue
+							}
+
+							mc, session := mcs[0], pending[0]
+							mcs, pending = mcs[1:], pending[1:]
+
+							start(cb, mc, session)
+
+							if ! global.MultiStreams {
+								wg.Wait()
+								out <- &Message{Type: MessageTypeTerminate,}
+								break LOOP
+							}
+						}
+				}
+		}
+	}
+
+	sessions.Lock()
+	sessions.closed = true
+	sessions.Unlock()
+
+	close(cancel)
+	conn.Close()
+
+	for _, mc := range mcs {
+		mc.Start(nil)
+		close(mc.Channel)
+	}
+
+	for _, cb := range cbs {
+		_, inc := cb()
+		DrainChannel(inc, nil)
+	}
+
+	wg.Wait()
+
+	<- in
+	close(out)
+}
+
+// Dispatch datagrams to sessions, a new session is created for unknown
+// remote addresses. Returns once cancel is closed.
+func packetServerRead(name string, conn net.PacketConn, sessions *packetServerSessions, sessionc chan *packetServerSession, cancel chan struct{}, multiStreams bool) {
+	created := false
+
+	for {
+		buff := make([]byte, PacketMaxSize)
+
+		i, addr, err := conn.ReadFrom(buff)
+		if err != nil {
+			sessions.Lock()
+			closed := sessions.closed
+			sessions.Unlock()
+
+			if ! closed {
+				err = errors.Wrapf(err, "Error reading from %s socket", name)
+				log.Println(err.Error())
+			}
+
+			return
+		}
+
+		sessions.Lock()
+
+		if sessions.closed {
+			sessions.Unlock()
+			return
+		}
+
+		key := ""
+		if addr != nil {
+			key = addr.String()
+		}
+
+		session, found := sessions.sessions[key]
+		if ! found {
+			if created && ! multiStreams {
+				sessions.Unlock()
+				continue
+			}
+
+			session = &packetServerSession{
+				addr: addr,
+				key: key,
+				datac: make(chan []byte, PacketServerSessionBacklog),
+			}
+
+			sessions.sessions[key] = session
+			created = true
+		}
+
+		// Datagrams are dropped if the session is not reading fast enough
+		select {
+			case session.datac <- buff[:i]:
+			default:
+		}
+
+		sessions.Unlock()
+
+		if ! found {
+			select {
+				case sessionc <- session:
+				case <- cancel:
+					return
+			}
+		}
+	}
+}
+
+func packetServerHandler(name string, conn net.PacketConn, addr string, idleTimeout time.Duration, sessions *packetServerSessions, session *packetServerSession, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	mc.Start(map[string]interface{}{
+		"local-addr": conn.LocalAddr().String(),
+		"remote-addr": session.key,
+		"addr": addr,
+	})
+
+	_, inc := cb()
+	outc := mc.Channel
+
+	log.Printf("Session %q is started\n", session.key)
+
+	donec := make(chan struct{})
+
+	go func() {
+		defer close(donec)
+
+		for payload := range inc {
+			if session.addr == nil {
+				continue
+			}
+
+			_, err := conn.WriteTo(payload, session.addr)
+			if err != nil {
+				err = errors.Wrapf(err, "Error writing to %s socket", name)
+				log.Println(err.Error())
+				break
+			}
+		}
+
+		DrainChannel(inc, nil)
+	}()
+
+	timer := time.NewTimer(idleTimeout)
+	defer timer.Stop()
+
+	LOOP: for {
+		select {
+			case payload := <- session.datac:
+				outc <- payload
+
+				if ! timer.Stop() {
+					<- timer.C
+				}
+
+				timer.Reset(idleTimeout)
+			case <- timer.C:
+				break LOOP
+			case <- donec:
+				break LOOP
+		}
+	}
+
+	sessions.Lock()
+	delete(sessions.sessions, session.key)
+	sessions.Unlock()
+
+	close(outc)
+	<- donec
+
+	log.Printf("Session %q is ended\n", session.key)
+}
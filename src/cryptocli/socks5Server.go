@@ -0,0 +1,324 @@
+package main
+
+import (
+	"time"
+	"log"
+	"net"
+	"io"
+	"strconv"
+	"crypto/subtle"
+	"encoding/binary"
+	"github.com/tehmoon/errors"
+	"github.com/spf13/pflag"
+)
+
+func init() {
+	MODULELIST.Register("socks5-server", "Listens TCP and performs the SOCKS5 handshake, the destination is set in metadata", NewSocks5Server)
+}
+
+/*
+socks5-server module works like tcp-server but performs the SOCKS5 handshake
+first. Only the CONNECT command is supported. The requested destination is set
+in the channel metadata so the next module can connect to it:
+
+  socks5-server --listen :1080 -- tcp --addr '{{ index . "dest-addr" }}'
+
+The destination keys are also set with an underscore so they can be used
+without index: '{{ .dest_host }}:{{ .dest_port }}' is the same address.
+
+The success reply is sent before the next module connects since the
+connection is made further in the pipeline.
+*/
+
+const (
+	Socks5Version byte = 0x05
+
+	Socks5MethodNoAuth byte = 0x00
+	Socks5MethodUserPass byte = 0x02
+	Socks5MethodNoAcceptable byte = 0xff
+
+	Socks5AuthVersion byte = 0x01
+
+	Socks5CommandConnect byte = 0x01
+
+	Socks5AddrIPv4 byte = 0x01
+	Socks5AddrDomain byte = 0x03
+	Socks5AddrIPv6 byte = 0x04
+
+	Socks5ReplySucceeded byte = 0x00
+	Socks5ReplyCommandNotSupported byte = 0x07
+	Socks5ReplyAddrNotSupported byte = 0x08
+)
+
+type Socks5Server struct {
+	addr string
+	username string
+	password string
+	connectTimeout time.Duration
+	readTimeout time.Duration
+}
+
+// Destination requested by the client
+type Socks5Request struct {
+	Host string
+	Port uint16
+}
+
+func socks5ServerHandler(conn net.Conn, m *Socks5Server, relay *ServerRelayer) {
+	conn.SetDeadline(time.Now().Add(m.readTimeout))
+
+	username, req, err := m.handshake(conn)
+	if err != nil {
+		err = errors.Wrapf(err, "Error during socks5 handshake with %q", conn.RemoteAddr().String())
+		log.Println(err.Error())
+		ServerRelayAbort(conn, relay)
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	metadata := map[string]interface{}{
+		"local-addr": conn.LocalAddr().String(),
+		"remote-addr": conn.RemoteAddr().String(),
+		"addr": m.addr,
+		"dest-host": req.Host,
+		"dest-port": int(req.Port),
+		"dest-addr": net.JoinHostPort(req.Host, strconv.Itoa(int(req.Port))),
+	}
+
+	metadata["dest_host"] = metadata["dest-host"]
+	metadata["dest_port"] = metadata["dest-port"]
+	metadata["dest_addr"] = metadata["dest-addr"]
+
+	if username != "" {
+		metadata["username"] = username
+	}
+
+	ServerConnHandler("socks5", conn, relay, metadata, m.readTimeout, ReadBytesStep)
+}
+
+// Negotiate the method, authenticate if needed and read the request.
+// Returns the username when authenticated.
+func (m *Socks5Server) handshake(conn net.Conn) (string, *Socks5Request, error) {
+	header := make([]byte, 2)
+
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "Error reading greeting")
+	}
+
+	if header[0] != Socks5Version {
+		return "", nil, errors.Errorf("Version %d is not supported", header[0])
+	}
+
+	methods := make([]byte, header[1])
+
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "Error reading methods")
+	}
+
+	method := Socks5MethodNoAuth
+	if m.username != "" {
+		method = Socks5MethodUserPass
+	}
+
+	found := false
+	for _, offered := range methods {
+		if offered == method {
+			found = true
+			break
+		}
+	}
+
+	if ! found {
+		conn.Write([]byte{Socks5Version, Socks5MethodNoAcceptable,})
+		return "", nil, errors.New("No acceptable authentication method")
+	}
+
+	_, err = conn.Write([]byte{Socks5Version, method,})
+	if err != nil {
+		return "", nil, errors.Wrap(err, "Error writing method")
+	}
+
+	username := ""
+
+	if method == Socks5MethodUserPass {
+		username, err = m.authenticate(conn)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	req, err := socks5ReadRequest(conn)
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = socks5WriteReply(conn, Socks5ReplySucceeded)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "Error writing reply")
+	}
+
+	return username, req, nil
+}
+
+// Username/password authentication from RFC 1929
+func (m *Socks5Server) authenticate(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return "", errors.Wrap(err, "Error reading authentication")
+	}
+
+	if header[0] != Socks5AuthVersion {
+		conn.Write([]byte{Socks5AuthVersion, 0x01,})
+		return "", errors.Errorf("Authentication version %d is not supported", header[0])
+	}
+
+	username := make([]byte, header[1])
+
+	_, err = io.ReadFull(conn, username)
+	if err != nil {
+		return "", errors.Wrap(err, "Error reading username")
+	}
+
+	_, err = io.ReadFull(conn, header[1:])
+	if err != nil {
+		return "", errors.Wrap(err, "Error reading password length")
+	}
+
+	password := make([]byte, header[1])
+
+	_, err = io.ReadFull(conn, password)
+	if err != nil {
+		return "", errors.Wrap(err, "Error reading password")
+	}
+
+	valid := subtle.ConstantTimeCompare(username, []byte(m.username)) &
+		subtle.ConstantTimeCompare(password, []byte(m.password))
+
+	if valid != 1 {
+		conn.Write([]byte{Socks5AuthVersion, 0x01,})
+		return "", errors.Errorf("Authentication failed for user %q", string(username))
+	}
+
+	_, err = conn.Write([]byte{Socks5AuthVersion, 0x00,})
+	if err != nil {
+		return "", errors.Wrap(err, "Error writing authentication status")
+	}
+
+	return string(username), nil
+}
+
+func socks5ReadRequest(conn net.Conn) (*Socks5Request, error) {
+	header := make([]byte, 4)
+
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading request")
+	}
+
+	if header[1] != Socks5CommandConnect {
+		socks5WriteReply(conn, Socks5ReplyCommandNotSupported)
+		return nil, errors.Errorf("Command %d is not supported", header[1])
+	}
+
+	var host string
+
+	switch header[3] {
+		case Socks5AddrIPv4, Socks5AddrIPv6:
+			ip := make([]byte, net.IPv4len)
+			if header[3] == Socks5AddrIPv6 {
+				ip = make([]byte, net.IPv6len)
+			}
+
+			_, err = io.ReadFull(conn, ip)
+			if err != nil {
+				return nil, errors.Wrap(err, "Error reading address")
+			}
+
+			host = net.IP(ip).String()
+		case Socks5AddrDomain:
+			_, err = io.ReadFull(conn, header[:1])
+			if err != nil {
+				return nil, errors.Wrap(err, "Error reading domain length")
+			}
+
+			domain := make([]byte, header[0])
+
+			_, err = io.ReadFull(conn, domain)
+			if err != nil {
+				return nil, errors.Wrap(err, "Error reading domain")
+			}
+
+			host = string(domain)
+		default:
+			socks5WriteReply(conn, Socks5ReplyAddrNotSupported)
+			return nil, errors.Errorf("Address type %d is not supported", header[3])
+	}
+
+	port := make([]byte, 2)
+
+	_, err = io.ReadFull(conn, port)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error reading port")
+	}
+
+	return &Socks5Request{
+		Host: host,
+		Port: binary.BigEndian.Uint16(port),
+	}, nil
+}
+
+// The bound address is always 0.0.0.0:0
+func socks5WriteReply(conn net.Conn, reply byte) (error) {
+	_, err := conn.Write([]byte{Socks5Version, reply, 0x00, Socks5AddrIPv4, 0, 0, 0, 0, 0, 0,})
+	return err
+}
+
+func (m *Socks5Server) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.StringVar(&m.addr, "listen", "", "Listen on addr:port. If port is 0, random port will be assigned")
+	fs.StringVar(&m.username, "username", "", "Require username/password authentication with this username")
+	fs.StringVar(&m.password, "password", "", "Password for the username/password authentication")
+	fs.DurationVar(&m.connectTimeout, "connect-timeout", 30 * time.Second, "Max amount of time to wait for a potential connection when pipeline is closing")
+	fs.DurationVar(&m.readTimeout, "read-timeout", 15 * time.Second, "Amout of time to wait reading from the connection")
+}
+
+func NewSocks5Server() (Module) {
+	return &Socks5Server{}
+}
+
+func (m *Socks5Server) Init(in, out chan *Message, global *GlobalFlags) (error) {
+	if m.readTimeout < 1 {
+		return errors.Errorf("Flag %q cannot be negative or zero", "--read-timeout")
+	}
+
+	if m.connectTimeout < 1 {
+		return errors.Errorf("Flag %q cannot be negative or zero", "--connect-timeout")
+	}
+
+	if m.password != "" && m.username == "" {
+		return errors.Errorf("Flag %q is required with %q", "--username", "--password")
+	}
+
+	addr, err := net.ResolveTCPAddr("tcp", m.addr)
+	if err != nil {
+		return errors.Wrap(err, "Unable to resolve tcp address")
+	}
+
+	var listener net.Listener
+	listener, err = net.ListenTCP("tcp", addr)
+	if err != nil {
+		return errors.Wrap(err, "Unable to listen on tcp address")
+	}
+
+	log.Printf("Socks5-server listening on %s\n", listener.Addr().String())
+
+	go StartServer("socks5", listener, m.connectTimeout, func(conn net.Conn, relay *ServerRelayer) {
+		socks5ServerHandler(conn, m, relay)
+	}, in, out, global)
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/rand"
+	"io"
+	"github.com/tehmoon/errors"
+)
+
+/*
+Shamir secret sharing over GF(2^8)
+
+Each byte of the secret is the constant term of its own random polynomial
+of degree threshold - 1. A share is the evaluation of every polynomial at
+the share's x coordinate.
+
+format of a share:
+	1 byte x coordinate || 1 byte per byte of secret
+*/
+
+var (
+	sssExp [510]byte
+	sssLog [256]byte
+)
+
+// Generate the exp and log tables using 3 as the generator
+// and the AES reducing polynomial x^8 + x^4 + x^3 + x + 1.
+func init() {
+	x := byte(1)
+
+	for i := 0; i < 255; i++ {
+		sssExp[i] = x
+		sssExp[i + 255] = x
+		sssLog[x] = byte(i)
+
+		xtime := x << 1
+		if x & 0x80 != 0 {
+			xtime ^= 0x1b
+		}
+
+		x ^= xtime
+	}
+}
+
+func sssMul(a, b byte) (byte) {
+	if a == 0 || b == 0 {
+		return 0
+	}
+
+	return sssExp[int(sssLog[a]) + int(sssLog[b])]
+}
+
+func sssDiv(a, b byte) (byte) {
+	if a == 0 {
+		return 0
+	}
+
+	return sssExp[int(sssLog[a]) + 255 - int(sssLog[b])]
+}
+
+// Split the secret into n shares where k of them are needed
+// to recover it. The x coordinate of share i is i + 1 and is not
+// part of the returned slices.
+func SSSSplitBytes(secret []byte, k, n int) (shares [][]byte, err error) {
+	if k < 2 || k > n || n > 255 {
+		return nil, errors.Errorf("Invalid threshold %d for %d shares", k, n)
+	}
+
+	coeffs := make([]byte, len(secret) * (k - 1))
+
+	_, err = io.ReadFull(rand.Reader, coeffs)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error generating polynomial coefficients")
+	}
+
+	shares = make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret))
+	}
+
+	for j, s := range secret {
+		poly := coeffs[j * (k - 1):(j + 1) * (k - 1)]
+
+		for i := range shares {
+			x := byte(i + 1)
+
+			// Horner's method starting from the highest degree
+			y := byte(0)
+			for c := len(poly) - 1; c >= 0; c-- {
+				y = sssMul(y, x) ^ poly[c]
+			}
+
+			shares[i][j] = sssMul(y, x) ^ s
+		}
+	}
+
+	return shares, nil
+}
+
+// Recover the secret by interpolating the polynomials at x = 0.
+// xs holds the x coordinate of each share in ys.
+func SSSCombineBytes(xs []byte, ys [][]byte) (secret []byte, err error) {
+	if len(xs) != len(ys) {
+		return nil, errors.New("Number of x coordinates and shares mismatch")
+	}
+
+	if len(ys) < 2 {
+		return nil, errors.New("At least two shares are required")
+	}
+
+	l := len(ys[0])
+	seen := make(map[byte]bool)
+
+	for i, x := range xs {
+		if x == 0 {
+			return nil, errors.Errorf("Share number %d has an invalid x coordinate", i + 1)
+		}
+
+		if seen[x] {
+			return nil, errors.Errorf("Share with x coordinate %d is duplicated", x)
+		}
+
+		if len(ys[i]) != l {
+			return nil, errors.Errorf("Share number %d does not have the same length as the others", i + 1)
+		}
+
+		seen[x] = true
+	}
+
+	// Lagrange basis polynomials evaluated at 0 are the same for every byte
+	basis := make([]byte, len(xs))
+	for i := range xs {
+		num, den := byte(1), byte(1)
+
+		for j := range xs {
+			if i == j {
+				continue
+			}
+
+			num = sssMul(num, xs[j])
+			den = sssMul(den, xs[i] ^ xs[j])
+		}
+
+		basis[i] = sssDiv(num, den)
+	}
+
+	secret = make([]byte, l)
+	for j := range secret {
+		for i := range ys {
+			secret[j] ^= sssMul(ys[i][j], basis[i])
+		}
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"sync"
+	"github.com/spf13/pflag"
+	"github.com/tehmoon/errors"
+	"log"
+)
+
+func init() {
+	MODULELIST.Register("sss-combine", "Recover a secret from shamir secret sharing shares", NewSSSCombine)
+}
+
+type SSSCombine struct {
+	sharePipes []string
+}
+
+func (m *SSSCombine) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.StringArrayVar(&m.sharePipes, "share-pipe", make([]string, 0), "Read a share from a pipeline. Repeat the flag for each share. IE: `\"read-file --path share-1\"`")
+}
+
+func (m *SSSCombine) Init(in, out chan *Message, global *GlobalFlags) (error) {
+	if len(m.sharePipes) < 2 {
+		return errors.Errorf("Flag %q has to be set at least twice", "--share-pipe")
+	}
+
+	go func(in, out chan *Message) {
+		wg := &sync.WaitGroup{}
+
+		init := false
+		mc := NewMessageChannel()
+
+		out <- &Message{
+			Type: MessageTypeChannel,
+			Interface: mc.Callback,
+		}
+
+		LOOP: for message := range in {
+			switch message.Type {
+				case MessageTypeTerminate:
+					if ! init {
+						close(mc.Channel)
+					}
+
+					wg.Wait()
+					out <- message
+					break LOOP
+				case MessageTypeChannel:
+					cb, ok := message.Interface.(MessageChannelFunc)
+					if ok {
+						if ! init {
+							init = true
+						} else {
+							mc = NewMessageChannel()
+
+							out <- &Message{
+								Type: MessageTypeChannel,
+								Interface: mc.Callback,
+							}
+						}
+
+						wg.Add(1)
+						go sssCombineStartHandler(m, cb, mc, wg)
+
+						if ! global.MultiStreams {
+							if ! init {
+								close(mc.Channel)
+							}
+							wg.Wait()
+							out <- &Message{Type: MessageTypeTerminate,}
+							break LOOP
+						}
+					}
+			}
+		}
+
+		wg.Wait()
+		// Last message will signal the closing of the channel
+		<- in
+		close(out)
+	}(in, out)
+
+	return nil
+}
+
+func sssCombineStartHandler(m *SSSCombine, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	mc.Start(map[string]interface{}{
+		"shares": len(m.sharePipes),
+	})
+	_, inc := cb()
+	outc := mc.Channel
+
+	wg.Add(1)
+	go DrainChannel(inc, wg)
+	defer close(outc)
+
+	xs := make([]byte, len(m.sharePipes))
+	ys := make([][]byte, len(m.sharePipes))
+
+	for i, pipe := range m.sharePipes {
+		share, err := ReadAllPipeline(pipe)
+		if err != nil {
+			err = errors.Wrapf(err, "Error reading share number %d in sss-combine module", i + 1)
+			log.Println(err.Error())
+			return
+		}
+
+		if len(share) == 0 {
+			log.Printf("Share number %d is empty in sss-combine module\n", i + 1)
+			return
+		}
+
+		xs[i] = share[0]
+		ys[i] = share[1:]
+	}
+
+	secret, err := SSSCombineBytes(xs, ys)
+	if err != nil {
+		err = errors.Wrap(err, "Error combining shares in sss-combine module")
+		log.Println(err.Error())
+		return
+	}
+
+	outc <- secret
+}
+
+func NewSSSCombine() (Module) {
+	return &SSSCombine{}
+}
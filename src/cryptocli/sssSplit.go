@@ -0,0 +1,128 @@
+package main
+
+import (
+	"sync"
+	"github.com/spf13/pflag"
+	"github.com/tehmoon/errors"
+	"log"
+)
+
+func init() {
+	MODULELIST.Register("sss-split", "Split a secret into shares using shamir secret sharing. Each share is sent to its own channel", NewSSSSplit)
+}
+
+type SSSSplit struct {
+	threshold int
+	shares int
+}
+
+func (m *SSSSplit) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.IntVar(&m.threshold, "threshold", 0, "Minimum number of shares required to recover the secret")
+	fs.IntVar(&m.shares, "shares", 0, "Number of shares to create, up to 255")
+}
+
+func (m *SSSSplit) Init(in, out chan *Message, global *GlobalFlags) (error) {
+	if m.threshold < 2 {
+		return errors.Errorf("Flag %q has to be greater than 1", "--threshold")
+	}
+
+	if m.shares < m.threshold {
+		return errors.Errorf("Flag %q cannot be less than flag %q", "--shares", "--threshold")
+	}
+
+	if m.shares > 255 {
+		return errors.Errorf("Flag %q cannot be greater than 255", "--shares")
+	}
+
+	if ! global.MultiStreams {
+		return errors.Errorf("Flag %q is required since each share is sent to its own channel", "--multi-streams")
+	}
+
+	go func(in, out chan *Message) {
+		wg := &sync.WaitGroup{}
+
+		init := false
+		mc := NewMessageChannel()
+
+		out <- &Message{
+			Type: MessageTypeChannel,
+			Interface: mc.Callback,
+		}
+
+		LOOP: for message := range in {
+			switch message.Type {
+				case MessageTypeTerminate:
+					if ! init {
+						close(mc.Channel)
+					}
+
+					wg.Wait()
+					out <- message
+					break LOOP
+				case MessageTypeChannel:
+					cb, ok := message.Interface.(MessageChannelFunc)
+					if ok {
+						if ! init {
+							init = true
+						} else {
+							mc = NewMessageChannel()
+
+							out <- &Message{
+								Type: MessageTypeChannel,
+								Interface: mc.Callback,
+							}
+						}
+
+						wg.Add(1)
+						go sssSplitStartHandler(m, out, cb, mc, wg)
+					}
+			}
+		}
+
+		wg.Wait()
+		// Last message will signal the closing of the channel
+		<- in
+		close(out)
+	}(in, out)
+
+	return nil
+}
+
+// Shares are sent one after the other, each to its own channel,
+// so the secret is buffered.
+func sssSplitStartHandler(m *SSSSplit, out chan *Message, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	_, inc := cb()
+	defer DrainChannel(inc, nil)
+
+	fanOut := NewMessageFanOut(out, mc)
+	defer fanOut.Close()
+
+	secret := make([]byte, 0)
+	for payload := range inc {
+		secret = append(secret, payload...)
+	}
+
+	shares, err := SSSSplitBytes(secret, m.threshold, m.shares)
+	if err != nil {
+		err = errors.Wrap(err, "Error splitting secret in sss-split module")
+		log.Println(err.Error())
+		return
+	}
+
+	for i, share := range shares {
+		mc = fanOut.Next(map[string]interface{}{
+			"index": i + 1,
+			"threshold": m.threshold,
+			"shares": m.shares,
+		})
+
+		mc.Channel <- append([]byte{byte(i + 1),}, share...)
+		close(mc.Channel)
+	}
+}
+
+func NewSSSSplit() (Module) {
+	return &SSSSplit{}
+}
@@ -0,0 +1,705 @@
+package main
+
+import (
+	"io"
+	"fmt"
+	"net"
+	"bufio"
+	"bytes"
+	"strings"
+	"encoding/xml"
+	"encoding/binary"
+	"github.com/tehmoon/errors"
+)
+
+/*
+Plaintext negotiation of protocols upgrading to TLS in-band. The client side
+asks the server to start TLS, the server side plays a server that only
+accepts to start TLS. Once negotiated, the TLS handshake is the next thing on
+the returned connection.
+*/
+
+type startTLSProtocol struct {
+	client func(r *bufio.Reader, w io.Writer, domain string) (error)
+	server func(r *bufio.Reader, w io.Writer) (error)
+}
+
+var startTLSProtocols = map[string]*startTLSProtocol{
+	"smtp": &startTLSProtocol{client: startTLSClientSMTP, server: startTLSServerSMTP,},
+	"imap": &startTLSProtocol{client: startTLSClientIMAP, server: startTLSServerIMAP,},
+	"pop3": &startTLSProtocol{client: startTLSClientPOP3, server: startTLSServerPOP3,},
+	"ftp": &startTLSProtocol{client: startTLSClientFTP, server: startTLSServerFTP,},
+	"postgres": &startTLSProtocol{client: startTLSClientPostgres, server: startTLSServerPostgres,},
+	"ldap": &startTLSProtocol{client: startTLSClientLDAP, server: startTLSServerLDAP,},
+	"xmpp": &startTLSProtocol{client: startTLSClientXMPP, server: startTLSServerXMPP,},
+}
+
+const (
+	startTLSPostgresSSLRequest uint32 = 80877103
+	startTLSPostgresGSSENCRequest uint32 = 80877104
+	startTLSLDAPOID = "1.3.6.1.4.1.1466.20037"
+	startTLSXMPPNamespace = "urn:ietf:params:xml:ns:xmpp-tls"
+
+	// StartTLS messages are tiny, anything bigger is refused
+	// before allocating it.
+	startTLSBERMaxLength = 4096
+)
+
+func StartTLSSupported(protocol string) (bool) {
+	_, found := startTLSProtocols[protocol]
+	return found
+}
+
+// Ask the server to start TLS, domain is used by protocols that need a name
+func StartTLSClient(conn net.Conn, protocol, domain string) (net.Conn, error) {
+	p, found := startTLSProtocols[protocol]
+	if ! found {
+		return nil, errors.Errorf("Starttls protocol %q is not supported", protocol)
+	}
+
+	r := bufio.NewReader(conn)
+
+	err := p.client(r, conn, domain)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error negotiating starttls for %s", protocol)
+	}
+
+	return &ServerBufferedConn{Conn: conn, Reader: r,}, nil
+}
+
+// Wait for the client to start TLS
+func StartTLSServer(conn net.Conn, protocol string) (net.Conn, error) {
+	p, found := startTLSProtocols[protocol]
+	if ! found {
+		return nil, errors.Errorf("Starttls protocol %q is not supported", protocol)
+	}
+
+	r := bufio.NewReader(conn)
+
+	err := p.server(r, conn)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error negotiating starttls for %s", protocol)
+	}
+
+	return &ServerBufferedConn{Conn: conn, Reader: r,}, nil
+}
+
+func startTLSReadLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", errors.Wrap(err, "Error reading line")
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func startTLSWriteLine(w io.Writer, format string, a ...interface{}) (error) {
+	_, err := fmt.Fprintf(w, format + "\r\n", a...)
+	if err != nil {
+		return errors.Wrap(err, "Error writing line")
+	}
+
+	return nil
+}
+
+// Read a reply with a 3 digits code, continuation lines have a "-" after the code
+func startTLSReadReply(r *bufio.Reader) (string, error) {
+	for {
+		line, err := startTLSReadLine(r)
+		if err != nil {
+			return "", err
+		}
+
+		if len(line) < 3 {
+			return "", errors.Errorf("Malformed reply %q", line)
+		}
+
+		if len(line) > 3 && line[3] == '-' {
+			continue
+		}
+
+		return line[:3], nil
+	}
+}
+
+func startTLSExpectReply(r *bufio.Reader, code string) (error) {
+	reply, err := startTLSReadReply(r)
+	if err != nil {
+		return err
+	}
+
+	if reply != code {
+		return errors.Errorf("Expected reply %s, got %s", code, reply)
+	}
+
+	return nil
+}
+
+func startTLSClientSMTP(r *bufio.Reader, w io.Writer, domain string) (error) {
+	err := startTLSExpectReply(r, "220")
+	if err != nil {
+		return errors.Wrap(err, "Error reading greeting")
+	}
+
+	if domain == "" {
+		domain = "localhost"
+	}
+
+	err = startTLSWriteLine(w, "EHLO %s", domain)
+	if err != nil {
+		return err
+	}
+
+	err = startTLSExpectReply(r, "250")
+	if err != nil {
+		return errors.Wrap(err, "Error reading EHLO reply")
+	}
+
+	err = startTLSWriteLine(w, "STARTTLS")
+	if err != nil {
+		return err
+	}
+
+	return startTLSExpectReply(r, "220")
+}
+
+func startTLSServerSMTP(r *bufio.Reader, w io.Writer) (error) {
+	err := startTLSWriteLine(w, "220 cryptocli ESMTP")
+	if err != nil {
+		return err
+	}
+
+	for {
+		line, err := startTLSReadLine(r)
+		if err != nil {
+			return err
+		}
+
+		fields := strings.Fields(strings.ToUpper(line))
+		command := ""
+		if len(fields) > 0 {
+			command = fields[0]
+		}
+
+		switch command {
+			case "EHLO":
+				err = startTLSWriteLine(w, "250-cryptocli\r\n250 STARTTLS")
+			case "HELO", "NOOP", "RSET":
+				err = startTLSWriteLine(w, "250 OK")
+			case "STARTTLS":
+				return startTLSWriteLine(w, "220 Ready to start TLS")
+			case "QUIT":
+				startTLSWriteLine(w, "221 Bye")
+				return errors.New("Client quit before starting TLS")
+			default:
+				err = startTLSWriteLine(w, "530 Must issue a STARTTLS command first")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func startTLSClientIMAP(r *bufio.Reader, w io.Writer, domain string) (error) {
+	line, err := startTLSReadLine(r)
+	if err != nil {
+		return errors.Wrap(err, "Error reading greeting")
+	}
+
+	if ! strings.HasPrefix(line, "* OK") {
+		return errors.Errorf("Unexpected greeting %q", line)
+	}
+
+	err = startTLSWriteLine(w, "a001 STARTTLS")
+	if err != nil {
+		return err
+	}
+
+	for {
+		line, err = startTLSReadLine(r)
+		if err != nil {
+			return err
+		}
+
+		// Skip untagged responses
+		if strings.HasPrefix(line, "* ") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "a001 OK") {
+			return nil
+		}
+
+		return errors.Errorf("Unexpected STARTTLS reply %q", line)
+	}
+}
+
+func startTLSServerIMAP(r *bufio.Reader, w io.Writer) (error) {
+	capability := "CAPABILITY IMAP4rev1 STARTTLS LOGINDISABLED"
+
+	err := startTLSWriteLine(w, "* OK [%s] cryptocli ready", capability)
+	if err != nil {
+		return err
+	}
+
+	for {
+		line, err := startTLSReadLine(r)
+		if err != nil {
+			return err
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			err = startTLSWriteLine(w, "* BAD Missing command")
+			if err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		tag, command := fields[0], strings.ToUpper(fields[1])
+
+		switch command {
+			case "CAPABILITY":
+				err = startTLSWriteLine(w, "* %s\r\n%s OK CAPABILITY completed", capability, tag)
+			case "NOOP":
+				err = startTLSWriteLine(w, "%s OK NOOP completed", tag)
+			case "STARTTLS":
+				return startTLSWriteLine(w, "%s OK Begin TLS negotiation now", tag)
+			case "LOGOUT":
+				startTLSWriteLine(w, "* BYE Logging out\r\n%s OK LOGOUT completed", tag)
+				return errors.New("Client logged out before starting TLS")
+			default:
+				err = startTLSWriteLine(w, "%s BAD Must issue a STARTTLS command first", tag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func startTLSClientPOP3(r *bufio.Reader, w io.Writer, domain string) (error) {
+	line, err := startTLSReadLine(r)
+	if err != nil {
+		return errors.Wrap(err, "Error reading greeting")
+	}
+
+	if ! strings.HasPrefix(line, "+OK") {
+		return errors.Errorf("Unexpected greeting %q", line)
+	}
+
+	err = startTLSWriteLine(w, "STLS")
+	if err != nil {
+		return err
+	}
+
+	line, err = startTLSReadLine(r)
+	if err != nil {
+		return err
+	}
+
+	if ! strings.HasPrefix(line, "+OK") {
+		return errors.Errorf("Unexpected STLS reply %q", line)
+	}
+
+	return nil
+}
+
+func startTLSServerPOP3(r *bufio.Reader, w io.Writer) (error) {
+	err := startTLSWriteLine(w, "+OK cryptocli ready")
+	if err != nil {
+		return err
+	}
+
+	for {
+		line, err := startTLSReadLine(r)
+		if err != nil {
+			return err
+		}
+
+		fields := strings.Fields(strings.ToUpper(line))
+		command := ""
+		if len(fields) > 0 {
+			command = fields[0]
+		}
+
+		switch command {
+			case "CAPA":
+				err = startTLSWriteLine(w, "+OK Capability list follows\r\nSTLS\r\n.")
+			case "NOOP":
+				err = startTLSWriteLine(w, "+OK")
+			case "STLS":
+				return startTLSWriteLine(w, "+OK Begin TLS negotiation")
+			case "QUIT":
+				startTLSWriteLine(w, "+OK Bye")
+				return errors.New("Client quit before starting TLS")
+			default:
+				err = startTLSWriteLine(w, "-ERR Must issue a STLS command first")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func startTLSClientFTP(r *bufio.Reader, w io.Writer, domain string) (error) {
+	err := startTLSExpectReply(r, "220")
+	if err != nil {
+		return errors.Wrap(err, "Error reading greeting")
+	}
+
+	err = startTLSWriteLine(w, "AUTH TLS")
+	if err != nil {
+		return err
+	}
+
+	return startTLSExpectReply(r, "234")
+}
+
+func startTLSServerFTP(r *bufio.Reader, w io.Writer) (error) {
+	err := startTLSWriteLine(w, "220 cryptocli ready")
+	if err != nil {
+		return err
+	}
+
+	for {
+		line, err := startTLSReadLine(r)
+		if err != nil {
+			return err
+		}
+
+		fields := strings.Fields(strings.ToUpper(line))
+		command := ""
+		if len(fields) > 0 {
+			command = fields[0]
+		}
+
+		switch command {
+			case "FEAT":
+				err = startTLSWriteLine(w, "211-Features:\r\n AUTH TLS\r\n211 End")
+			case "NOOP":
+				err = startTLSWriteLine(w, "200 OK")
+			case "AUTH":
+				if len(fields) > 1 && (fields[1] == "TLS" || fields[1] == "SSL") {
+					return startTLSWriteLine(w, "234 AUTH %s successful", fields[1])
+				}
+
+				err = startTLSWriteLine(w, "504 Security mechanism not understood")
+			case "QUIT":
+				startTLSWriteLine(w, "221 Bye")
+				return errors.New("Client quit before starting TLS")
+			default:
+				err = startTLSWriteLine(w, "530 Must issue an AUTH TLS command first")
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func startTLSClientPostgres(r *bufio.Reader, w io.Writer, domain string) (error) {
+	request := make([]byte, 8)
+	binary.BigEndian.PutUint32(request, 8)
+	binary.BigEndian.PutUint32(request[4:], startTLSPostgresSSLRequest)
+
+	_, err := w.Write(request)
+	if err != nil {
+		return errors.Wrap(err, "Error writing SSLRequest")
+	}
+
+	b, err := r.ReadByte()
+	if err != nil {
+		return errors.Wrap(err, "Error reading SSLRequest reply")
+	}
+
+	if b != 'S' {
+		return errors.Errorf("Server refused SSL with reply %q", b)
+	}
+
+	return nil
+}
+
+func startTLSServerPostgres(r *bufio.Reader, w io.Writer) (error) {
+	for {
+		request := make([]byte, 8)
+
+		_, err := io.ReadFull(r, request)
+		if err != nil {
+			return errors.Wrap(err, "Error reading startup request")
+		}
+
+		code := binary.BigEndian.Uint32(request[4:])
+
+		switch code {
+			case startTLSPostgresSSLRequest:
+				_, err = w.Write([]byte{'S',})
+				if err != nil {
+					return errors.Wrap(err, "Error writing SSLRequest reply")
+				}
+
+				return nil
+			case startTLSPostgresGSSENCRequest:
+				// Refused so the client follows with an SSLRequest
+				_, err = w.Write([]byte{'N',})
+				if err != nil {
+					return errors.Wrap(err, "Error writing GSSENCRequest reply")
+				}
+			default:
+				return errors.Errorf("Unexpected startup request code %d", code)
+		}
+	}
+}
+
+// Read a BER element, returning its tag and value
+func startTLSReadBER(r *bufio.Reader) (byte, []byte, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "Error reading BER tag")
+	}
+
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "Error reading BER length")
+	}
+
+	length := int(b)
+
+	if b & 0x80 != 0 {
+		n := int(b & 0x7f)
+		if n == 0 || n > 2 {
+			return 0, nil, errors.Errorf("Unsupported BER length of %d bytes", n)
+		}
+
+		length = 0
+		for i := 0; i < n; i++ {
+			b, err = r.ReadByte()
+			if err != nil {
+				return 0, nil, errors.Wrap(err, "Error reading BER length")
+			}
+
+			length = length << 8 | int(b)
+		}
+	}
+
+	if length > startTLSBERMaxLength {
+		return 0, nil, errors.Errorf("BER length %d is bigger than %d", length, startTLSBERMaxLength)
+	}
+
+	value := make([]byte, length)
+
+	_, err = io.ReadFull(r, value)
+	if err != nil {
+		return 0, nil, errors.Wrap(err, "Error reading BER value")
+	}
+
+	return tag, value, nil
+}
+
+// Split a BER value in the raw elements it contains
+func startTLSSplitBER(data []byte) ([][]byte, error) {
+	elements := make([][]byte, 0)
+	r := bufio.NewReader(bytes.NewReader(data))
+
+	for {
+		_, err := r.Peek(1)
+		if err != nil {
+			return elements, nil
+		}
+
+		tag, value, err := startTLSReadBER(r)
+		if err != nil {
+			return nil, err
+		}
+
+		elements = append(elements, startTLSEncodeBER(tag, value))
+	}
+}
+
+func startTLSEncodeBER(tag byte, value []byte) ([]byte) {
+	buff := bytes.NewBuffer([]byte{tag,})
+
+	switch {
+		case len(value) < 0x80:
+			buff.WriteByte(byte(len(value)))
+		case len(value) < 0x100:
+			buff.Write([]byte{0x81, byte(len(value)),})
+		default:
+			buff.Write([]byte{0x82, byte(len(value) >> 8), byte(len(value)),})
+	}
+
+	buff.Write(value)
+
+	return buff.Bytes()
+}
+
+func startTLSClientLDAP(r *bufio.Reader, w io.Writer, domain string) (error) {
+	// ExtendedRequest with the StartTLS OID and message id 1
+	request := startTLSEncodeBER(0x30, append(
+		startTLSEncodeBER(0x02, []byte{0x01,}),
+		startTLSEncodeBER(0x77, startTLSEncodeBER(0x80, []byte(startTLSLDAPOID)))...,
+	))
+
+	_, err := w.Write(request)
+	if err != nil {
+		return errors.Wrap(err, "Error writing ExtendedRequest")
+	}
+
+	tag, value, err := startTLSReadBER(r)
+	if err != nil {
+		return errors.Wrap(err, "Error reading ExtendedResponse")
+	}
+
+	elements, err := startTLSSplitBER(value)
+	if err != nil || tag != 0x30 || len(elements) < 2 || elements[1][0] != 0x78 {
+		return errors.New("Malformed ExtendedResponse")
+	}
+
+	// The resultCode is the first element of the response
+	_, response, _ := startTLSReadBER(bufio.NewReader(bytes.NewReader(elements[1])))
+
+	result, err := startTLSSplitBER(response)
+	if err != nil || len(result) == 0 || result[0][0] != 0x0a {
+		return errors.New("Malformed ExtendedResponse result")
+	}
+
+	code := result[0][len(result[0]) - 1]
+	if code != 0 {
+		return errors.Errorf("Server refused StartTLS with result code %d", code)
+	}
+
+	return nil
+}
+
+func startTLSServerLDAP(r *bufio.Reader, w io.Writer) (error) {
+	tag, value, err := startTLSReadBER(r)
+	if err != nil {
+		return errors.Wrap(err, "Error reading ExtendedRequest")
+	}
+
+	elements, err := startTLSSplitBER(value)
+	if err != nil || tag != 0x30 || len(elements) < 2 || elements[0][0] != 0x02 {
+		return errors.New("Malformed LDAP message")
+	}
+
+	if elements[1][0] != 0x77 || ! bytes.Contains(elements[1], []byte(startTLSLDAPOID)) {
+		return errors.New("First LDAP message is not a StartTLS ExtendedRequest")
+	}
+
+	// Success with empty matchedDN and diagnosticMessage,
+	// the message id is copied from the request.
+	response := startTLSEncodeBER(0x30, append(
+		append([]byte{}, elements[0]...),
+		startTLSEncodeBER(0x78, bytes.Join([][]byte{
+			startTLSEncodeBER(0x0a, []byte{0x00,}),
+			startTLSEncodeBER(0x04, []byte{}),
+			startTLSEncodeBER(0x04, []byte{}),
+			startTLSEncodeBER(0x8a, []byte(startTLSLDAPOID)),
+		}, []byte{}))...,
+	))
+
+	_, err = w.Write(response)
+	if err != nil {
+		return errors.Wrap(err, "Error writing ExtendedResponse")
+	}
+
+	return nil
+}
+
+// Read from the stream until the closing ">" of an element containing name
+func startTLSReadXMPPElement(r *bufio.Reader, name string) (string, error) {
+	data := ""
+
+	for {
+		chunk, err := r.ReadString('>')
+		if err != nil {
+			return "", errors.Wrapf(err, "Error reading %q element", name)
+		}
+
+		data += chunk
+
+		if strings.Contains(data, name) {
+			return data, nil
+		}
+
+		if len(data) > 65536 {
+			return "", errors.Errorf("Element %q not found", name)
+		}
+	}
+}
+
+func startTLSClientXMPP(r *bufio.Reader, w io.Writer, domain string) (error) {
+	_, err := fmt.Fprintf(w, "<?xml version='1.0'?><stream:stream to='%s' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>", domain)
+	if err != nil {
+		return errors.Wrap(err, "Error writing stream header")
+	}
+
+	features, err := startTLSReadXMPPElement(r, "</stream:features>")
+	if err != nil {
+		return err
+	}
+
+	if ! strings.Contains(features, startTLSXMPPNamespace) {
+		return errors.New("Server does not offer starttls")
+	}
+
+	_, err = fmt.Fprintf(w, "<starttls xmlns='%s'/>", startTLSXMPPNamespace)
+	if err != nil {
+		return errors.Wrap(err, "Error writing starttls")
+	}
+
+	reply, err := startTLSReadXMPPElement(r, startTLSXMPPNamespace)
+	if err != nil {
+		return err
+	}
+
+	if ! strings.Contains(reply, "<proceed") {
+		return errors.Errorf("Unexpected starttls reply %q", reply)
+	}
+
+	return nil
+}
+
+func startTLSServerXMPP(r *bufio.Reader, w io.Writer) (error) {
+	header, err := startTLSReadXMPPElement(r, "<stream:stream")
+	if err != nil {
+		return err
+	}
+
+	domain := "cryptocli"
+
+	// Answer from the domain the client asked for
+	if i := strings.Index(header, " to="); i != -1 && len(header) > i + 5 {
+		quote := header[i + 4]
+		value := header[i + 5:]
+
+		if j := strings.IndexByte(value, quote); j != -1 {
+			domain = value[:j]
+		}
+	}
+
+	// The domain comes from the client, it is escaped so it cannot add markup
+	from := bytes.NewBuffer(make([]byte, 0))
+
+	err = xml.EscapeText(from, []byte(domain))
+	if err != nil {
+		return errors.Wrap(err, "Error escaping domain")
+	}
+
+	_, err = fmt.Fprintf(w, "<?xml version='1.0'?><stream:stream from='%s' id='cryptocli' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'><stream:features><starttls xmlns='%s'><required/></starttls></stream:features>", from.String(), startTLSXMPPNamespace)
+	if err != nil {
+		return errors.Wrap(err, "Error writing stream features")
+	}
+
+	_, err = startTLSReadXMPPElement(r, "<starttls")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "<proceed xmlns='%s'/>", startTLSXMPPNamespace)
+	if err != nil {
+		return errors.Wrap(err, "Error writing proceed")
+	}
+
+	return nil
+}
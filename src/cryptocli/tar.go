@@ -0,0 +1,273 @@
+package main
+
+import (
+	"sync"
+	"github.com/spf13/pflag"
+	"github.com/tehmoon/errors"
+	"log"
+	"archive/tar"
+	"bytes"
+	"text/template"
+	"time"
+)
+
+func init() {
+	MODULELIST.Register("tar", "Create a tar archive where each incoming channel is an entry", NewTar)
+}
+
+/*
+tar module writes a single archive to its first channel, each incoming
+channel becomes an entry:
+	- the name is rendered from the channel's metadata using --name
+	- "mode" and "mtime" are used if found in the metadata
+	- if "size" is found in the metadata, the entry is streamed, otherwise
+	  it is buffered in memory to compute the size. A streamed entry that
+	  doesn't match its size is truncated or padded with zeros so the rest
+	  of the archive stays valid
+	- a key missing from the metadata in --name is an error
+
+Entries are written one after the other so with --multi-streams, channels
+wait for their turn. The archive is ended when the pipeline terminates.
+*/
+
+type Tar struct {
+	name string
+	mode int64
+	format string
+	tpl *template.Template
+	tarFormat tar.Format
+}
+
+type tarArchive struct {
+	sync.Mutex
+	writer *tar.Writer
+	buff *bytes.Buffer
+	outc chan []byte
+}
+
+func (m *Tar) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.StringVar(&m.name, "name", "{{ .path }}", "Metadata template for the entry name")
+	fs.Int64Var(&m.mode, "mode", 0644, "Entry's mode if not found in metadata")
+	fs.StringVar(&m.format, "format", "", "Force the header format: ustar, pax or gnu. Defaults to the most compatible format for each entry")
+}
+
+func (m *Tar) Init(in, out chan *Message, global *GlobalFlags) (err error) {
+	switch m.format {
+		case "":
+			m.tarFormat = tar.FormatUnknown
+		case "ustar":
+			m.tarFormat = tar.FormatUSTAR
+		case "pax":
+			m.tarFormat = tar.FormatPAX
+		case "gnu":
+			m.tarFormat = tar.FormatGNU
+		default:
+			return errors.Errorf("Format %q is not supported in tar module", m.format)
+	}
+
+	m.tpl, err = template.New("root").Option("missingkey=error").Parse(m.name)
+	if err != nil {
+		return errors.Wrapf(err, "Error parsing template for %q flag", "--name")
+	}
+
+	go func(in, out chan *Message) {
+		wg := &sync.WaitGroup{}
+
+		init := false
+		mc := NewMessageChannel()
+
+		out <- &Message{
+			Type: MessageTypeChannel,
+			Interface: mc.Callback,
+		}
+
+		mc.Start(nil)
+
+		archive := &tarArchive{
+			buff: bytes.NewBuffer(make([]byte, 0)),
+			outc: mc.Channel,
+		}
+
+		archive.writer = tar.NewWriter(archive.buff)
+
+		LOOP: for message := range in {
+			switch message.Type {
+				case MessageTypeTerminate:
+					wg.Wait()
+					tarCloseArchive(archive, init)
+					out <- message
+					break LOOP
+				case MessageTypeChannel:
+					cb, ok := message.Interface.(MessageChannelFunc)
+					if ok {
+						// All channels are written to the same archive
+						init = true
+
+						wg.Add(1)
+						go tarStartHandler(m, archive, cb, wg)
+
+						if ! global.MultiStreams {
+							wg.Wait()
+							tarCloseArchive(archive, init)
+							out <- &Message{Type: MessageTypeTerminate,}
+							break LOOP
+						}
+					}
+			}
+		}
+
+		wg.Wait()
+		// Last message will signal the closing of the channel
+		<- in
+		close(out)
+	}(in, out)
+
+	return nil
+}
+
+// Write the trailer if there are entries then close the channel
+func tarCloseArchive(archive *tarArchive, init bool) {
+	if init {
+		err := archive.writer.Close()
+		if err != nil {
+			err = errors.Wrap(err, "Error closing archive in tar module")
+			log.Println(err.Error())
+		}
+
+		archive.outc <- CopyResetBuffer(archive.buff)
+	}
+
+	close(archive.outc)
+}
+
+func tarStartHandler(m *Tar, archive *tarArchive, cb MessageChannelFunc, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	metadata, inc := cb()
+	defer DrainChannel(inc, nil)
+
+	buff := bytes.NewBuffer(make([]byte, 0))
+	err := m.tpl.Execute(buff, metadata)
+	if err != nil {
+		err = errors.Wrap(err, "Error executing template name in tar module")
+		log.Println(err.Error())
+		return
+	}
+
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name: buff.String(),
+		Mode: m.mode,
+		ModTime: time.Now(),
+		Format: m.tarFormat,
+	}
+
+	if header.Name == "" {
+		log.Println("Entry name is empty in tar module")
+		return
+	}
+
+	if mode, found := MetadataInt64(metadata, "mode"); found {
+		header.Mode = mode & 07777
+	}
+
+	if mtime, found := MetadataTime(metadata, "mtime"); found {
+		header.ModTime = mtime
+	}
+
+	size, found := MetadataInt64(metadata, "size")
+	if ! found {
+		buff.Reset()
+
+		for payload := range inc {
+			buff.Write(payload)
+		}
+
+		size = int64(buff.Len())
+	}
+
+	header.Size = size
+
+	archive.Lock()
+	defer archive.Unlock()
+
+	err = archive.writer.WriteHeader(header)
+	if err != nil {
+		err = errors.Wrapf(err, "Error writing header for %q in tar module", header.Name)
+		log.Println(err.Error())
+		return
+	}
+
+	if ! found {
+		_, err = archive.writer.Write(buff.Bytes())
+		if err != nil {
+			err = errors.Wrapf(err, "Error writing %q in tar module", header.Name)
+			log.Println(err.Error())
+			return
+		}
+
+		archive.outc <- CopyResetBuffer(archive.buff)
+		return
+	}
+
+	// The writer fails for good if more than the header's size is
+	// written or if the entry is not complete
+	var written int64
+	truncated := false
+
+	for payload := range inc {
+		if written + int64(len(payload)) > size {
+			if ! truncated {
+				log.Printf("Entry %q is bigger than its size of %d in tar module, it is truncated\n", header.Name, size)
+				truncated = true
+			}
+
+			payload = payload[:size - written]
+		}
+
+		_, err = archive.writer.Write(payload)
+		if err != nil {
+			err = errors.Wrapf(err, "Error writing %q in tar module", header.Name)
+			log.Println(err.Error())
+			return
+		}
+
+		written += int64(len(payload))
+		archive.outc <- CopyResetBuffer(archive.buff)
+	}
+
+	if written < size {
+		log.Printf("Entry %q is smaller than its size of %d in tar module, it is padded with zeros\n", header.Name, size)
+
+		zeros := make([]byte, 32 * 1024)
+
+		for written < size {
+			n := int64(len(zeros))
+			if size - written < n {
+				n = size - written
+			}
+
+			_, err = archive.writer.Write(zeros[:n])
+			if err != nil {
+				err = errors.Wrapf(err, "Error writing %q in tar module", header.Name)
+				log.Println(err.Error())
+				return
+			}
+
+			written += n
+		}
+	}
+
+	err = archive.writer.Flush()
+	if err != nil {
+		err = errors.Wrapf(err, "Error writing %q in tar module", header.Name)
+		log.Println(err.Error())
+		return
+	}
+
+	archive.outc <- CopyResetBuffer(archive.buff)
+}
+
+func NewTar() (Module) {
+	return &Tar{}
+}
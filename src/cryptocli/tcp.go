@@ -21,6 +21,10 @@ type TCP struct {
 	servername string
 	insecure bool
 	readTimeout time.Duration
+	sendProxyProtocol string
+	starttls string
+	tlsOptions TLSClientOptions
+	tlsConfig *tls.Config
 	tplAddr *template.Template
 	tplTLS *template.Template
 }
@@ -28,8 +32,11 @@ type TCP struct {
 func (m *TCP) SetFlagSet(fs *pflag.FlagSet, args []string) {
 	fs.StringVar(&m.addr, "addr", "", "Tcp address to connect to")
 	fs.StringVar(&m.servername, "tls", "", "Use TLS with servername in client hello")
-	fs.BoolVar(&m.insecure, "insecure", false, "Don't verify certificate chain when \"--servername\" is set")
+	fs.BoolVar(&m.insecure, "insecure", false, "Don't verify certificate chain when \"--tls\" is set")
 	fs.DurationVar(&m.readTimeout, "read-timeout", 3 * time.Second, "Read timeout for the tcp connection")
+	fs.StringVar(&m.sendProxyProtocol, "send-proxy-protocol", "", "Send a PROXY protocol header, v1 or v2, with the \"remote-addr\" and \"local-addr\" metadata")
+	fs.StringVar(&m.starttls, "starttls", "", "Negotiate TLS in plaintext first: smtp, imap, pop3, ftp, postgres, ldap or xmpp. The connection is relayed as is without \"--tls\" or \"--insecure\"")
+	m.tlsOptions.SetFlagSet(fs)
 }
 
 func (m *TCP) Init(in, out chan *Message, global *GlobalFlags) (err error) {
@@ -37,6 +44,23 @@ func (m *TCP) Init(in, out chan *Message, global *GlobalFlags) (err error) {
 		return errors.Errorf("Flag %q has to be greater that 0", "--read-timeout")
 	}
 
+	if m.sendProxyProtocol != "" && m.sendProxyProtocol != "v1" && m.sendProxyProtocol != "v2" {
+		return errors.Errorf("Version %q is not supported for flag %q", m.sendProxyProtocol, "--send-proxy-protocol")
+	}
+
+	if m.starttls != "" && ! StartTLSSupported(m.starttls) {
+		return errors.Errorf("Protocol %q is not supported for flag %q", m.starttls, "--starttls")
+	}
+
+	if m.tlsOptions.IsSet() && m.servername == "" && ! m.insecure {
+		return errors.Errorf("Flag %q or %q is required by the TLS flags", "--tls", "--insecure")
+	}
+
+	m.tlsConfig, err = m.tlsOptions.Config(m.insecure)
+	if err != nil {
+		return errors.Wrap(err, "Error configuring TLS")
+	}
+
 	m.tplAddr, err = template.New("root").Parse(m.addr)
 	if err != nil {
 		return errors.Wrap(err, "Error parsing template for \"--addr\" flag")
@@ -104,10 +128,11 @@ func (m *TCP) Init(in, out chan *Message, global *GlobalFlags) (err error) {
 	return nil
 }
 
+// The channel is started once connected so the TLS
+// parameters can be set in metadata.
 func tcpStartHandler(m *TCP, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	mc.Start(nil)
 	metadata, inc := cb()
 
 	buff := bytes.NewBuffer(make([]byte, 0))
@@ -115,6 +140,7 @@ func tcpStartHandler(m *TCP, cb MessageChannelFunc, mc *MessageChannel, wg *sync
 	if err != nil {
 		err = errors.Wrap(err, "Error executing template addr")
 		log.Println(err.Error())
+		mc.Start(nil)
 		close(mc.Channel)
 		DrainChannel(inc, nil)
 		return
@@ -126,6 +152,7 @@ func tcpStartHandler(m *TCP, cb MessageChannelFunc, mc *MessageChannel, wg *sync
 	if err != nil {
 		err = errors.Wrap(err, "Error executing template tls")
 		log.Println(err.Error())
+		mc.Start(nil)
 		close(mc.Channel)
 		DrainChannel(inc, nil)
 		return
@@ -139,6 +166,7 @@ func tcpStartHandler(m *TCP, cb MessageChannelFunc, mc *MessageChannel, wg *sync
 	if err != nil {
 		err = errors.Wrap(err, "Unable to resolve tcp address")
 		log.Println(err.Error())
+		mc.Start(nil)
 		close(outc)
 		DrainChannel(inc, nil)
 		return
@@ -149,20 +177,92 @@ func tcpStartHandler(m *TCP, cb MessageChannelFunc, mc *MessageChannel, wg *sync
 	if err != nil {
 		err = errors.Wrap(err, "Fail to dial tcp")
 		log.Println(err.Error())
+		mc.Start(nil)
 		close(outc)
 		DrainChannel(inc, nil)
 		return
 	}
 
+	// The header is sent before TLS
+	if m.sendProxyProtocol != "" {
+		var header []byte
+		header, err = ProxyProtocolEncode(m.sendProxyProtocol, ProxyProtocolFromMetadata(metadata))
+		if err != nil {
+			err = errors.Wrap(err, "Error encoding proxy protocol header")
+			log.Println(err.Error())
+			conn.Close()
+			mc.Start(nil)
+			close(outc)
+			DrainChannel(inc, nil)
+			return
+		}
+
+		_, err = conn.Write(header)
+		if err != nil {
+			err = errors.Wrap(err, "Error writing proxy protocol header")
+			log.Println(err.Error())
+			conn.Close()
+			mc.Start(nil)
+			close(outc)
+			DrainChannel(inc, nil)
+			return
+		}
+	}
+
+	// Negotiated before TLS, it can be relayed when the
+	// handshake is done by a module upstream.
+	if m.starttls != "" {
+		domain := servername
+		if domain == "" {
+			domain, _, _ = net.SplitHostPort(addr)
+		}
+
+		conn.SetDeadline(time.Now().Add(m.readTimeout))
+
+		upgraded, err := StartTLSClient(conn, m.starttls, domain)
+		if err != nil {
+			log.Println(err.Error())
+			conn.Close()
+			mc.Start(nil)
+			close(outc)
+			DrainChannel(inc, nil)
+			return
+		}
+
+		conn.SetDeadline(time.Time{})
+		conn = upgraded
+	}
+
+	outMetadata := make(map[string]interface{})
+
 	if servername != "" || m.insecure {
-		config := &tls.Config{
-			InsecureSkipVerify: m.insecure,
-			ServerName: servername,
+		config := m.tlsConfig.Clone()
+		config.ServerName = servername
+
+		sconn := tls.Client(conn, config)
+		sconn.SetDeadline(time.Now().Add(m.readTimeout))
+
+		err = sconn.Handshake()
+		if err != nil {
+			err = errors.Wrap(err, "Error with TLS handshake")
+			log.Println(err.Error())
+			conn.Close()
+			mc.Start(nil)
+			close(outc)
+			DrainChannel(inc, nil)
+			return
 		}
 
-		conn = tls.Client(conn, config)
+		sconn.SetDeadline(time.Time{})
+
+		state := sconn.ConnectionState()
+		TLSClientMetadata(&state, outMetadata)
+
+		conn = sconn
 	}
 
+	mc.Start(outMetadata)
+
 	syn := &sync.WaitGroup{}
 	syn.Add(2)
 
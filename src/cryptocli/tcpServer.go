@@ -1,9 +1,10 @@
 package main
 
 import (
-	"sync"
 	"time"
 	"log"
+	"bufio"
+	"crypto/tls"
 	"net"
 	"github.com/tehmoon/errors"
 	"github.com/spf13/pflag"
@@ -17,110 +18,81 @@ type TCPServer struct {
 	addr string
 	connectTimeout time.Duration
 	readTimeout time.Duration
+	proxyProtocol bool
+	tlsOptions TLSServerOptions
+	tlsConfig *tls.Config
 }
 
-type TCPServerRelayer struct {
-	Callback MessageChannelFunc
-	MessageChannel *MessageChannel
-	Wg *sync.WaitGroup
-}
-
-func tcpServerHandler(conn net.Conn, m *TCPServer, relay *TCPServerRelayer) {
-	mc, cb, wg := relay.MessageChannel, relay.Callback, relay.Wg
-	defer wg.Done()
-	defer conn.Close()
-
-	mc.Start(map[string]interface{}{
-		"local-addr": conn.RemoteAddr().String(),
+func tcpServerHandler(conn net.Conn, m *TCPServer, relay *ServerRelayer) {
+	metadata := map[string]interface{}{
+		"local-addr": conn.LocalAddr().String(),
 		"remote-addr": conn.RemoteAddr().String(),
 		"addr": m.addr,
-	})
+	}
 
-	_, inc := cb()
-	outc := mc.Channel
-	defer close(outc)
+	if m.proxyProtocol {
+		conn.SetReadDeadline(time.Now().Add(m.readTimeout))
 
-	log.Printf("Client %q is connected\n", conn.LocalAddr().String())
-	go func(conn net.Conn, inc chan []byte) {
-		defer conn.Close()
+		reader := bufio.NewReader(conn)
 
-		for payload := range inc {
-			_, err := conn.Write(payload)
-			if err != nil {
-				err = errors.Wrap(err, "Error writing to tcp connection")
-				log.Println(err.Error())
-				break
-			}
+		header, err := ProxyProtocolRead(reader)
+		if err != nil {
+			err = errors.Wrapf(err, "Error reading proxy protocol header from %q", conn.RemoteAddr().String())
+			log.Println(err.Error())
+			ServerRelayAbort(conn, relay)
+			return
 		}
 
-		DrainChannel(inc, nil)
-	}(conn, inc)
-
-	defer conn.Close()
-	conn.SetReadDeadline(time.Now().Add(m.readTimeout))
+		// The proxy's address is kept
+		metadata["proxy-addr"] = conn.RemoteAddr().String()
 
-	err := ReadBytesStep(conn, func(payload []byte) bool {
-		outc <- payload
-		conn.SetReadDeadline(time.Now().Add(m.readTimeout))
+		if header.Source != nil && header.Destination != nil {
+			metadata["remote-addr"] = header.Source.String()
+			metadata["local-addr"] = header.Destination.String()
+		}
 
-		return true
-	})
-	if err != nil {
-		err = errors.Wrap(err, "Error reading from tcp socket")
-		log.Println(err.Error())
-		return
+		conn = ServerBufferedConn{
+			Conn: conn,
+			Reader: reader,
+		}
 	}
-}
-
-func tcpServerServe(conn net.Conn, m *TCPServer, relayer chan *TCPServerRelayer, connc, donec, cancel chan struct{}) {
-	donec <- struct{}{}
-	defer func(donec chan struct{}) {
-		<- donec
-	}(donec)
 
-	select {
-		case relay, opened := <- relayer:
-			if ! opened {
-				return
-			}
+	if m.tlsConfig != nil {
+		sconn := tls.Server(conn, m.tlsConfig)
+		sconn.SetDeadline(time.Now().Add(m.readTimeout))
 
-			tcpServerHandler(conn, m, relay)
+		err := sconn.Handshake()
+		if err != nil {
+			err = errors.Wrapf(err, "Error with TLS handshake from %q", conn.RemoteAddr().String())
+			log.Println(err.Error())
+			ServerRelayAbort(conn, relay)
 			return
-		case <- cancel:
-			return
-		default:
-	}
+		}
 
-	select {
-		case connc <- struct{}{}:
-		case <- cancel:
-			return
-	}
+		sconn.SetDeadline(time.Time{})
 
-	select {
-		case relay, opened := <- relayer:
-			if ! opened {
-				return
-			}
+		state := sconn.ConnectionState()
+		TLSServerMetadata(&state, metadata)
 
-			tcpServerHandler(conn, m, relay)
-			return
-		case <- cancel:
-			return
+		conn = sconn
 	}
+
+	ServerConnHandler("tcp", conn, relay, metadata, m.readTimeout, ReadBytesStep)
 }
 
 func (m *TCPServer) SetFlagSet(fs *pflag.FlagSet, args []string) {
 	fs.StringVar(&m.addr, "listen", "", "Listen on addr:port. If port is 0, random port will be assigned")
 	fs.DurationVar(&m.connectTimeout, "connect-timeout", 30 * time.Second, "Max amount of time to wait for a potential connection when pipeline is closing")
 	fs.DurationVar(&m.readTimeout, "read-timeout", 15 * time.Second, "Amout of time to wait reading from the connection")
+	fs.BoolVar(&m.proxyProtocol, "proxy-protocol", false, "Read a PROXY protocol v1 or v2 header and use its addresses in metadata")
+	m.tlsOptions.SetFlagSet(fs)
 }
 
 func NewTCPServer() (Module) {
 	return &TCPServer{}
 }
 
-func (m *TCPServer) Init(in, out chan *Message, global *GlobalFlags) (error) {
+func (m *TCPServer) Init(in, out chan *Message, global *GlobalFlags) (err error) {
 	if m.readTimeout < 1 {
 		return errors.Errorf("Flag %q cannot be negative or zero", "--read-timeout")
 	}
@@ -129,6 +101,11 @@ func (m *TCPServer) Init(in, out chan *Message, global *GlobalFlags) (error) {
 		return errors.Errorf("Flag %q cannot be negative or zero", "--connect-timeout")
 	}
 
+	m.tlsConfig, err = m.tlsOptions.Config()
+	if err != nil {
+		return errors.Wrap(err, "Error configuring TLS")
+	}
+
 	addr, err := net.ResolveTCPAddr("tcp", m.addr)
 	if err != nil {
 		return errors.Wrap(err, "Unable to resolve tcp address")
@@ -142,144 +119,9 @@ func (m *TCPServer) Init(in, out chan *Message, global *GlobalFlags) (error) {
 
 	log.Printf("Tcp-server listening on %s\n", listener.Addr().String())
 
-	go func() {
-		wg := &sync.WaitGroup{}
-		relayer := make(chan *TCPServerRelayer)
-		connc := make(chan struct{})
-		cancel := make(chan struct{})
-
-		donec := make(chan struct{}, global.MaxConcurrentStreams)
-
-		go func(m *TCPServer, l net.Listener, relayer chan *TCPServerRelayer, connc, done, cancel chan struct{}) {
-			for {
-				conn, err := l.Accept()
-				if err != nil {
-					err = errors.Wrap(err, "Error accepting tcp connection")
-					log.Println(err.Error())
-					return
-				}
-
-				go tcpServerServe(conn, m, relayer, connc, donec, cancel)
-			}
-		}(m, listener, relayer, connc, donec, cancel)
-
-		ticker := time.NewTicker(m.connectTimeout)
-
-		cbs := make([]MessageChannelFunc, 0)
-		mcs := make([]*MessageChannel, 0)
-
-		LOOP: for {
-			select {
-				case <- ticker.C:
-					ticker.Stop()
-					close(cancel)
-					wg.Wait()
-					log.Println("Connect timeout reached, nobody connected and no messages from inputs were received")
-					out <- &Message{
-						Type: MessageTypeTerminate,
-					}
-
-					break LOOP
-				case _, opened := <- connc:
-					if ! opened {
-						break LOOP
-					}
-
-					mc := NewMessageChannel()
-
-					out <- &Message{
-						Type: MessageTypeChannel,
-						Interface: mc.Callback,
-					}
-
-					if len(cbs) == 0 {
-						mcs = append(mcs, mc)
-						continue
-					}
-
-					wg.Add(1)
-
-					cb := cbs[0]
-					cbs = cbs[1:]
-
-					relayer <- &TCPServerRelayer{
-						Callback: cb,
-						MessageChannel: mc,
-						Wg: wg,
-					}
-
-					if ! global.MultiStreams {
-						close(cancel)
-						wg.Wait()
-						out <- &Message{Type: MessageTypeTerminate,}
-						break LOOP
-					}
-
-				case message, opened := <- in:
-					ticker.Stop()
-					if ! opened {
-						close(cancel)
-						wg.Wait()
-						out <- &Message{
-							Type: MessageTypeTerminate,
-						}
-						break LOOP
-					}
-
-					switch message.Type {
-						case MessageTypeTerminate:
-							close(cancel)
-							wg.Wait()
-							out <- message
-							break LOOP
-						case MessageTypeChannel:
-							cb, ok := message.Interface.(MessageChannelFunc)
-							if ok {
-								if len(mcs) == 0 {
-									cbs = append(cbs, cb)
-									continue
-								}
-
-								wg.Add(1)
-								mc := mcs[0]
-								mcs = mcs[1:]
-
-								relayer <- &TCPServerRelayer{
-									Callback: cb,
-									MessageChannel: mc,
-									Wg: wg,
-								}
-
-								if ! global.MultiStreams {
-									close(cancel)
-									wg.Wait()
-									out <- &Message{Type: MessageTypeTerminate,}
-									break LOOP
-								}
-							}
-					}
-			}
-		}
-
-		listener.Close()
-		close(connc)
-
-		for _, mc := range mcs {
-			close(mc.Channel)
-		}
-
-		for _, cb := range cbs {
-			_, inc := cb()
-			DrainChannel(inc, nil)
-		}
-
-		wg.Wait()
-		close(relayer)
-		close(donec)
-
-		<- in
-		close(out)
-	}()
+	go StartServer("tcp", listener, m.connectTimeout, func(conn net.Conn, relay *ServerRelayer) {
+		tcpServerHandler(conn, m, relay)
+	}, in, out, global)
 
 	return nil
 }
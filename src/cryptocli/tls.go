@@ -12,6 +12,7 @@ import (
 	"bytes"
 	"crypto/x509"
 	"crypto/ecdsa"
+	"crypto/rsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto"
@@ -34,10 +35,10 @@ type TLS struct {
 	decrypt string
 	decryptTmpl *template.Template
 	port int
-	caCert *x509.Certificate
-	caKey crypto.PrivateKey
-	caFileCert string
-	caFileKey string
+	ca TLSCAOptions
+	cloneAddr string
+	cloneAddrTmpl *template.Template
+	starttls string
 }
 
 type TLSRelayer struct {
@@ -52,6 +53,25 @@ func tlsHandler(conn net.Conn, m *TLS, relay *TLSRelayer) {
 
 	log.Printf("Client %q is connected\n", conn.LocalAddr().String())
 
+	// The client hello comes after the plaintext negotiation
+	if m.starttls != "" {
+		conn.SetDeadline(time.Now().Add(m.readTimeout))
+
+		upgraded, err := StartTLSServer(conn, m.starttls)
+		if err != nil {
+			log.Println(err.Error())
+			conn.Close()
+			mc.Start(nil)
+			_, inc := cb()
+			close(mc.Channel)
+			DrainChannel(inc, nil)
+			return
+		}
+
+		conn.SetDeadline(time.Time{})
+		conn = upgraded
+	}
+
 	wrapper := NewTLSWrapper(conn)
 
 	log.Printf("New connection accepted from %s\n", wrapper.LocalAddr())
@@ -61,6 +81,15 @@ func tlsHandler(conn net.Conn, m *TLS, relay *TLSRelayer) {
 
 	config := &tls.Config{
 		GetConfigForClient: func(hello *tls.ClientHelloInfo) (config *tls.Config, err error) {
+			firstPacket, err := wrapper.ReadBuffer()
+			if err != nil {
+				err = errors.Wrap(err, "Error reading buffer for new config")
+				log.Println(err.Error())
+				mc.Start(nil)
+				_, inc = cb()
+				return nil, err
+			}
+
 			metadata := map[string]interface{}{
 				"local-addr": conn.RemoteAddr().String(),
 				"remote-addr": conn.RemoteAddr().String(),
@@ -69,27 +98,22 @@ func tlsHandler(conn net.Conn, m *TLS, relay *TLSRelayer) {
 				"port": m.port,
 			}
 
-			buff := bytes.NewBuffer(make([]byte, 0))
-			err = m.decryptTmpl.Execute(buff, metadata)
+			// The raw client hello is in the first packet
+			clientHello, err := TLSParseClientHello(firstPacket)
 			if err != nil {
-				err = errors.Wrap(err, "Error executing template addr")
+				err = errors.Wrap(err, "Error parsing client hello")
 				log.Println(err.Error())
-				mc.Start(nil)
-				_, inc = cb()
-				buff.Reset()
-				return
+			} else {
+				clientHello.SetMetadata(metadata)
 			}
 
-			decrypt, err = strconv.ParseBool(string(buff.Bytes()[:]))
+			decrypt, err = TLSExecuteDecrypt(m.decryptTmpl, metadata)
 			if err != nil {
-				err = errors.Wrap(err, "Error parsing redirect flag to boolean")
 				log.Println(err.Error())
-				buff.Reset()
 				mc.Start(nil)
 				_, inc = cb()
 				return
 			}
-			buff.Reset()
 
 			metadata["decrypt"] = decrypt
 
@@ -99,36 +123,13 @@ func tlsHandler(conn net.Conn, m *TLS, relay *TLSRelayer) {
 
 			_, inc = cb()
 
-			firstPacket, err := wrapper.ReadBuffer()
-			if err != nil {
-				err = errors.Wrap(err, "Error reading buffer for new config")
-				log.Println(err.Error())
-				return nil, err
-			}
-
 			if decrypt {
-				servername := hello.ServerName
-				if servername == "" {
-					servername = "*"
-				}
-
-				cert, key, err := TLSCreateServerCert(servername, m.caCert, m.caKey)
+				config, err = tlsForgeConfig(m, hello.ServerName, metadata)
 				if err != nil {
-					err = errors.Wrap(err, "Error creating server certificate")
 					log.Println(err.Error())
 					return nil, err
 				}
 
-				config = &tls.Config{
-					Certificates: []tls.Certificate{tls.Certificate{
-						Certificate: [][]byte{
-							cert.Raw,
-							m.caCert.Raw,
-						},
-						PrivateKey: key,
-					},},
-				}
-
 				wrapper.Pivot()
 
 				return config, nil
@@ -258,8 +259,9 @@ func (m *TLS) SetFlagSet(fs *pflag.FlagSet, args []string) {
 	fs.DurationVar(&m.connectTimeout, "connect-timeout", 30 * time.Second, "Max amount of time to wait for a potential connection when pipeline is closing")
 	fs.DurationVar(&m.readTimeout, "read-timeout", 15 * time.Second, "Amout of time to wait reading from the connection")
 	fs.StringVar(&m.decrypt, "decrypt", "false", "TLS intercept the handshake and replace with own CA to decrypt the traffic. Use template, return boolean false or true.")
-	fs.StringVar(&m.caFileCert, "ca-cert", "", "Specify the certificate file for the CA")
-	fs.StringVar(&m.caFileKey, "ca-key", "", "Specify the key file for the CA")
+	m.ca.SetFlagSet(fs)
+	fs.StringVar(&m.starttls, "starttls", "", "Play the server side of a plaintext negotiation before TLS: smtp, imap, pop3, ftp, postgres, ldap or xmpp")
+	fs.StringVar(&m.cloneAddr, "clone-addr", "", "Fetch the certificate of the server at addr:port to copy its subject, SANs and validity in the forged one. Use template, empty disables cloning.")
 }
 
 func NewTLS() (Module) {
@@ -275,23 +277,25 @@ func (m *TLS) Init(in, out chan *Message, global *GlobalFlags) (err error) {
 		return errors.Errorf("Flag %q cannot be negative or zero", "--connect-timeout")
 	}
 
-	rander := mathRand.New(mathRand.NewSource(time.Now().UnixNano()))
-
-	m.decryptTmpl, err = template.New("root").Funcs(template.FuncMap{
-		"rand": func(n int64) int64 {
-			return rander.Int63n(n + 1)
-		},
-	}).Parse(m.decrypt)
+	m.decryptTmpl, err = TLSParseDecrypt(m.decrypt)
 	if err != nil {
 		return errors.Wrap(err, "Error parsing template for \"--decrypt\" flag")
 	}
 
-	if m.caFileCert != "" && m.caFileKey == "" {
-		return errors.Errorf("Flag %q is missing when flag %q is set", "--ca-key", "--ca-cert")
+	err = m.ca.Init()
+	if err != nil {
+		return err
+	}
+
+	if m.starttls != "" && ! StartTLSSupported(m.starttls) {
+		return errors.Errorf("Protocol %q is not supported for flag %q", m.starttls, "--starttls")
 	}
 
-	if m.caFileCert == "" && m.caFileKey != "" {
-		return errors.Errorf("Flag %q is missing when flag %q is set", "--ca-cert", "--ca-key")
+	if m.cloneAddr != "" {
+		m.cloneAddrTmpl, err = template.New("root").Parse(m.cloneAddr)
+		if err != nil {
+			return errors.Wrap(err, "Error parsing template for \"--clone-addr\" flag")
+		}
 	}
 
 	addr, err := net.ResolveTCPAddr("tcp", m.addr)
@@ -308,32 +312,9 @@ func (m *TLS) Init(in, out chan *Message, global *GlobalFlags) (err error) {
 	}
 
 	if m.decrypt != "" {
-		if m.caFileCert != "" && m.caFileKey != "" {
-			ca, err := tls.LoadX509KeyPair(m.caFileCert, m.caFileKey)
-			if err != nil {
-				return errors.Wrap(err, "Unable to load CA certificate and key")
-			}
-
-			caCert, err := x509.ParseCertificate(ca.Certificate[0])
-			if err != nil {
-				return errors.Wrap(err, "Error parsing ca certificate from DER")
-			}
-
-			m.caCert = caCert
-			m.caKey = ca.PrivateKey
-			log.Println("CA certificates and key loaded")
-		} else {
-			m.caCert, m.caKey, err = TLSCreateCA()
-			if err != nil {
-				return errors.Wrap(err, "Error creating CA")
-			}
-
-			cacertPEM, cakeyPEM, err := TLSEncodeCertificateKey(m.caCert, m.caKey)
-			if err != nil {
-				return errors.Wrap(err, "Error displaying CA certificate and key")
-			}
-
-			log.Printf("\nCA certificate: \n%s\nCA key: \n%s\n", string(cacertPEM[:]), string(cakeyPEM[:]))
+		err = m.ca.Load()
+		if err != nil {
+			return err
 		}
 	}
 
@@ -481,6 +462,179 @@ func (m *TLS) Init(in, out chan *Message, global *GlobalFlags) (err error) {
 	return nil
 }
 
+// Parse the template of the --decrypt flag
+func TLSParseDecrypt(decrypt string) (*template.Template, error) {
+	rander := mathRand.New(mathRand.NewSource(time.Now().UnixNano()))
+
+	return template.New("root").Funcs(template.FuncMap{
+		"rand": func(n int64) int64 {
+			return rander.Int63n(n + 1)
+		},
+	}).Parse(decrypt)
+}
+
+// Execute the template of the --decrypt flag, it must return a boolean
+func TLSExecuteDecrypt(tmpl *template.Template, metadata map[string]interface{}) (bool, error) {
+	buff := bytes.NewBuffer(make([]byte, 0))
+
+	err := tmpl.Execute(buff, metadata)
+	if err != nil {
+		return false, errors.Wrap(err, "Error executing template decrypt")
+	}
+
+	decrypt, err := strconv.ParseBool(string(buff.Bytes()[:]))
+	if err != nil {
+		return false, errors.Wrap(err, "Error parsing decrypt flag to boolean")
+	}
+
+	return decrypt, nil
+}
+
+// Load the CA from files or create one of keyType when they are empty.
+// A created CA is logged so it can be trusted by clients.
+func TLSLoadCA(certFile, keyFile, keyType string) (*x509.Certificate, crypto.PrivateKey, error) {
+	if certFile != "" && keyFile != "" {
+		ca, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "Unable to load CA certificate and key")
+		}
+
+		caCert, err := x509.ParseCertificate(ca.Certificate[0])
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "Error parsing ca certificate from DER")
+		}
+
+		log.Println("CA certificates and key loaded")
+
+		return caCert, ca.PrivateKey, nil
+	}
+
+	caCert, caKey, err := TLSCreateCA(keyType)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Error creating CA")
+	}
+
+	cacertPEM, cakeyPEM, err := TLSEncodeCertificateKey(caCert, caKey)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Error displaying CA certificate and key")
+	}
+
+	log.Printf("\nCA certificate: \n%s\nCA key: \n%s\n", string(cacertPEM[:]), string(cakeyPEM[:]))
+
+	return caCert, caKey, nil
+}
+
+// Certificate for servername signed by the CA, with the CA in the chain
+func TLSForgeCertificate(servername string, caCert *x509.Certificate, caKey crypto.PrivateKey) (*tls.Certificate, error) {
+	if servername == "" {
+		servername = "*"
+	}
+
+	cert, key, err := TLSCreateServerCert(servername, caCert, caKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating server certificate")
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{
+			cert.Raw,
+			caCert.Raw,
+		},
+		PrivateKey: key,
+	}, nil
+}
+
+// Certificate signed by the CA with the subject, SANs and validity of
+// the upstream certificate.
+func TLSCloneCertificate(upstream, caCert *x509.Certificate, caKey crypto.PrivateKey) (*tls.Certificate, error) {
+	req, err := TLSCreateReqCert(false, upstream.Subject.CommonName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating req certificate")
+	}
+
+	req.Subject = upstream.Subject
+	req.RawSubject = upstream.RawSubject
+	req.DNSNames = upstream.DNSNames
+	req.IPAddresses = upstream.IPAddresses
+	req.EmailAddresses = upstream.EmailAddresses
+	req.URIs = upstream.URIs
+	req.NotBefore = upstream.NotBefore
+	req.NotAfter = upstream.NotAfter
+
+	cert, key, err := TLSSignServerCert(req, caCert, caKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error creating cloned certificate")
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{
+			cert.Raw,
+			caCert.Raw,
+		},
+		PrivateKey: key,
+	}, nil
+}
+
+// Fetch the leaf certificate of the server at addr without verifying it
+func TLSFetchCertificate(addr, servername string, timeout time.Duration) (*x509.Certificate, error) {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+	}
+
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{
+		ServerName: servername,
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error connecting to %q", addr)
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil, errors.Errorf("No certificate sent by %q", addr)
+	}
+
+	return certs[0], nil
+}
+
+// Forged certificates are cached per servername and upstream address
+func tlsForgeConfig(m *TLS, servername string, metadata map[string]interface{}) (*tls.Config, error) {
+	addr := ""
+
+	if m.cloneAddrTmpl != nil {
+		buff := bytes.NewBuffer(make([]byte, 0))
+
+		err := m.cloneAddrTmpl.Execute(buff, metadata)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error executing template clone-addr")
+		}
+
+		addr = string(buff.Bytes()[:])
+	}
+
+	if addr == "" {
+		return m.ca.ForgeConfig(servername)
+	}
+
+	cert, err := m.ca.Certificate(servername + " " + addr, func() (*tls.Certificate, error) {
+
+		upstream, err := TLSFetchCertificate(addr, servername, m.readTimeout)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error fetching upstream certificate")
+		}
+
+		return TLSCloneCertificate(upstream, m.ca.Cert, m.ca.Key)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert,},
+	}, nil
+}
+
 type TLSWrapper struct {
 	conn net.Conn
 	buffer *bytes.Buffer
@@ -557,14 +711,19 @@ func (w TLSWrapper) SetWriteDeadline(t time.Time) error {
 }
 
 func TLSCreateServerCert(name string, cacert *x509.Certificate, cakey crypto.PrivateKey) (cert *x509.Certificate, key *ecdsa.PrivateKey, err error) {
-	key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	req, err := TLSCreateReqCert(false, name)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "Failed to create the private key")
+		return nil, nil, errors.Wrap(err, "Error create CA req certificate")
 	}
 
-	req, err := TLSCreateReqCert(false, name)
+	return TLSSignServerCert(req, cacert, cakey)
+}
+
+// Sign req with the CA for a new P-256 key
+func TLSSignServerCert(req, cacert *x509.Certificate, cakey crypto.PrivateKey) (cert *x509.Certificate, key *ecdsa.PrivateKey, err error) {
+	key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "Error create CA req certificate")
+		return nil, nil, errors.Wrap(err, "Failed to create the private key")
 	}
 
 	cert, err = TLSSignCertificate(req, cacert, cakey, key.Public())
@@ -575,8 +734,16 @@ func TLSCreateServerCert(name string, cacert *x509.Certificate, cakey crypto.Pri
 	return cert, key, nil
 }
 
-func TLSCreateCA() (cert *x509.Certificate, key *ecdsa.PrivateKey, err error) {
-	key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+// Create a self signed CA with a P-256 key for "ecdsa" or a 2048 bits key for "rsa"
+func TLSCreateCA(keyType string) (cert *x509.Certificate, key crypto.Signer, err error) {
+	switch keyType {
+		case "ecdsa":
+			key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		case "rsa":
+			key, err = rsa.GenerateKey(rand.Reader, 2048)
+		default:
+			return nil, nil, errors.Errorf("Key type %q is not supported", keyType)
+	}
 	if err != nil {
 		return nil, nil, errors.Wrap(err, "Failed to create the private key")
 	}
@@ -673,6 +840,10 @@ func TLSEncodePrivateKey(priv crypto.PrivateKey) ([]byte, error) {
 
 			t = "EC PRIVATE KEY"
 
+		case *rsa.PrivateKey:
+			data = x509.MarshalPKCS1PrivateKey(p)
+			t = "RSA PRIVATE KEY"
+
 		default:
 			return nil, errors.Errorf("Unsupported private key of type %T", p)
 	}
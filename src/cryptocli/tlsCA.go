@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/tehmoon/errors"
+	"github.com/spf13/pflag"
+)
+
+/*
+CA options shared by the modules intercepting TLS. The CA is loaded from files
+or created with --ca-key-type, a created one can be written to --ca-out.
+Forged certificates are cached so a key is not generated for each connection.
+*/
+
+type TLSCAOptions struct {
+	certFile string
+	keyFile string
+	out string
+	keyType string
+	cacheSize int
+	cache *TLSCertCache
+	Cert *x509.Certificate
+	Key crypto.PrivateKey
+}
+
+func (o *TLSCAOptions) SetFlagSet(fs *pflag.FlagSet) {
+	fs.StringVar(&o.certFile, "ca-cert", "", "Specify the certificate file for the CA")
+	fs.StringVar(&o.keyFile, "ca-key", "", "Specify the key file for the CA")
+	fs.StringVar(&o.out, "ca-out", "", "Pipeline definition to write the PEM certificate and key of the generated CA")
+	fs.StringVar(&o.keyType, "ca-key-type", "ecdsa", "Key type of the generated CA: ecdsa or rsa")
+	fs.IntVar(&o.cacheSize, "cert-cache-size", 1024, "Number of forged certificates to keep, 0 disables the cache")
+}
+
+// Validate the flags before the CA is loaded
+func (o *TLSCAOptions) Init() (error) {
+	if o.certFile != "" && o.keyFile == "" {
+		return errors.Errorf("Flag %q is missing when flag %q is set", "--ca-key", "--ca-cert")
+	}
+
+	if o.certFile == "" && o.keyFile != "" {
+		return errors.Errorf("Flag %q is missing when flag %q is set", "--ca-cert", "--ca-key")
+	}
+
+	if o.certFile != "" && o.out != "" {
+		return errors.Errorf("Flag %q cannot be used with flag %q", "--ca-out", "--ca-cert")
+	}
+
+	if o.cacheSize < 0 {
+		return errors.Errorf("Flag %q cannot be negative", "--cert-cache-size")
+	}
+
+	o.cache = NewTLSCertCache(o.cacheSize)
+
+	return nil
+}
+
+func (o *TLSCAOptions) Load() (err error) {
+	o.Cert, o.Key, err = TLSLoadCA(o.certFile, o.keyFile, o.keyType)
+	if err != nil {
+		return err
+	}
+
+	if o.out != "" {
+		certPEM, keyPEM, err := TLSEncodeCertificateKey(o.Cert, o.Key)
+		if err != nil {
+			return errors.Wrap(err, "Error encoding CA certificate and key")
+		}
+
+		err = WriteToPipeline(o.out, append(certPEM, keyPEM...))
+		if err != nil {
+			return errors.Wrap(err, "Error writing CA to pipeline")
+		}
+	}
+
+	return nil
+}
+
+// Return the cached certificate for key or call create and cache the result
+func (o *TLSCAOptions) Certificate(key string, create func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	return o.cache.Get(key, create)
+}
+
+// Server config with a cached certificate for servername signed by the CA
+func (o *TLSCAOptions) ForgeConfig(servername string) (*tls.Config, error) {
+	cert, err := o.Certificate(servername, func() (*tls.Certificate, error) {
+		return TLSForgeCertificate(servername, o.Cert, o.Key)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{*cert,},
+	}, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sync"
+	"crypto/tls"
+	"container/list"
+)
+
+/*
+LRU cache of forged certificates so a key is not generated for each
+connection. The least recently used certificate is evicted once the cache
+is full, a size of 0 disables the cache.
+*/
+
+type TLSCertCache struct {
+	size int
+	list *list.List
+	entries map[string]*list.Element
+	sync *sync.Mutex
+}
+
+type tlsCertCacheEntry struct {
+	key string
+	cert *tls.Certificate
+}
+
+func NewTLSCertCache(size int) (*TLSCertCache) {
+	return &TLSCertCache{
+		size: size,
+		list: list.New(),
+		entries: make(map[string]*list.Element),
+		sync: &sync.Mutex{},
+	}
+}
+
+// Return the cached certificate for key or call create and cache the result.
+// Errors are not cached.
+func (c *TLSCertCache) Get(key string, create func() (*tls.Certificate, error)) (*tls.Certificate, error) {
+	c.sync.Lock()
+	element, found := c.entries[key]
+	if found {
+		c.list.MoveToFront(element)
+		cert := element.Value.(*tlsCertCacheEntry).cert
+		c.sync.Unlock()
+
+		return cert, nil
+	}
+	c.sync.Unlock()
+
+	// Created without the lock, concurrent misses for the same key
+	// create their own certificate and the last one is kept.
+	cert, err := create()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.size < 1 {
+		return cert, nil
+	}
+
+	c.sync.Lock()
+	defer c.sync.Unlock()
+
+	element, found = c.entries[key]
+	if found {
+		element.Value.(*tlsCertCacheEntry).cert = cert
+		c.list.MoveToFront(element)
+
+		return cert, nil
+	}
+
+	c.entries[key] = c.list.PushFront(&tlsCertCacheEntry{key: key, cert: cert,})
+
+	if c.list.Len() > c.size {
+		oldest := c.list.Back()
+		c.list.Remove(oldest)
+		delete(c.entries, oldest.Value.(*tlsCertCacheEntry).key)
+	}
+
+	return cert, nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"strings"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"github.com/tehmoon/errors"
+	"github.com/spf13/pflag"
+)
+
+/*
+TLS options shared by the client modules. Pins are the hex SHA256 of the
+certificate, prefixed by "cert:", or of its SubjectPublicKeyInfo, prefixed by
+"spki:". The connection is accepted when any certificate of a verified chain
+matches one of the pins. With --insecure nothing is verified so only the leaf
+is matched, extra certificates sent by the peer could be anything.
+*/
+
+type TLSClientOptions struct {
+	cert string
+	key string
+	ca string
+	pins []string
+	servername string
+	minVersion string
+	maxVersion string
+	ciphers []string
+}
+
+func (o *TLSClientOptions) SetFlagSet(fs *pflag.FlagSet) {
+	fs.StringVar(&o.cert, "cert", "", "PEM client certificate file")
+	fs.StringVar(&o.key, "key", "", "PEM private key file of the client certificate")
+	fs.StringVar(&o.ca, "ca", "", "Verify the server with the CAs from the PEM bundle instead of the system ones")
+	fs.StringArrayVar(&o.pins, "pin", []string{}, "Require a certificate of the chain to match the pin in the form of \"spki:<hex sha256>\" or \"cert:<hex sha256>\"")
+	fs.StringVar(&o.minVersion, "tls-min-version", "1.2", "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	fs.StringVar(&o.maxVersion, "tls-max-version", "1.3", "Maximum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	fs.StringArrayVar(&o.ciphers, "cipher", []string{}, "Only offer the cipher suite, TLS 1.3 suites cannot be chosen")
+}
+
+// True when a flag that only makes sense with TLS is set
+func (o *TLSClientOptions) IsSet() (bool) {
+	return o.cert != "" || o.key != "" || o.ca != "" || len(o.pins) > 0 || len(o.ciphers) > 0
+}
+
+// Servername sent in the client hello instead of the host
+func (o *TLSClientOptions) SetServernameFlag(fs *pflag.FlagSet) {
+	fs.StringVar(&o.servername, "servername", "", "Override the servername sent in the client hello and verified")
+}
+
+func (o *TLSClientOptions) Config(insecure bool) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: insecure,
+		ServerName: o.servername,
+	}
+
+	var found bool
+
+	config.MinVersion, found = TLSVersions[o.minVersion]
+	if ! found {
+		return nil, errors.Errorf("Version %q is not supported for flag %q", o.minVersion, "--tls-min-version")
+	}
+
+	config.MaxVersion, found = TLSVersions[o.maxVersion]
+	if ! found {
+		return nil, errors.Errorf("Version %q is not supported for flag %q", o.maxVersion, "--tls-max-version")
+	}
+
+	if config.MinVersion > config.MaxVersion {
+		return nil, errors.Errorf("Flag %q cannot be greater than flag %q", "--tls-min-version", "--tls-max-version")
+	}
+
+	if (o.cert == "") != (o.key == "") {
+		return nil, errors.Errorf("Flag %q and flag %q are required together", "--cert", "--key")
+	}
+
+	if o.cert != "" {
+		cert, err := tls.LoadX509KeyPair(o.cert, o.key)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error loading client certificate and key")
+		}
+
+		config.Certificates = []tls.Certificate{cert,}
+	}
+
+	if o.ca != "" {
+		data, err := ioutil.ReadFile(o.ca)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error reading CA file")
+		}
+
+		pool := x509.NewCertPool()
+		if ! pool.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("No certificate found in CA file %q", o.ca)
+		}
+
+		config.RootCAs = pool
+	}
+
+	for _, name := range o.ciphers {
+		id, err := TLSCipherSuiteID(name)
+		if err != nil {
+			return nil, err
+		}
+
+		config.CipherSuites = append(config.CipherSuites, id)
+	}
+
+	if len(o.pins) > 0 {
+		pins := make(map[string]bool)
+
+		for _, pin := range o.pins {
+			if ! strings.HasPrefix(pin, "spki:") && ! strings.HasPrefix(pin, "cert:") {
+				return nil, errors.Errorf("Pin %q must start with %q or %q", pin, "spki:", "cert:")
+			}
+
+			pins[strings.ToLower(pin)] = true
+		}
+
+		config.VerifyConnection = func(state tls.ConnectionState) (error) {
+			certs := make([]*x509.Certificate, 0)
+
+			if insecure {
+				if len(state.PeerCertificates) > 0 {
+					certs = append(certs, state.PeerCertificates[0])
+				}
+			} else {
+				for _, chain := range state.VerifiedChains {
+					certs = append(certs, chain...)
+				}
+			}
+
+			for _, cert := range certs {
+				spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				raw := sha256.Sum256(cert.Raw)
+
+				if pins["spki:" + hex.EncodeToString(spki[:])] || pins["cert:" + hex.EncodeToString(raw[:])] {
+					return nil
+				}
+			}
+
+			return errors.New("No certificate of the verified chains matches the pins")
+		}
+	}
+
+	return config, nil
+}
+
+func TLSCipherSuiteID(name string) (uint16, error) {
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		if suite.Name == name {
+			return suite.ID, nil
+		}
+	}
+
+	return 0, errors.Errorf("Cipher suite %q is not supported", name)
+}
+
+// Add the negotiated parameters and the peer chain to metadata,
+// the chain is a list of subjects starting with the leaf.
+func TLSClientMetadata(state *tls.ConnectionState, metadata map[string]interface{}) {
+	metadata["tls-version"] = TLSVersionName(state.Version)
+	metadata["tls-cipher"] = tls.CipherSuiteName(state.CipherSuite)
+	metadata["tls-alpn"] = state.NegotiatedProtocol
+
+	chain := make([]string, 0, len(state.PeerCertificates))
+	for _, cert := range state.PeerCertificates {
+		chain = append(chain, cert.Subject.String())
+	}
+
+	metadata["tls-peer-chain"] = chain
+
+	if len(state.PeerCertificates) > 0 {
+		sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+		metadata["tls-peer-fingerprint"] = hex.EncodeToString(sum[:])
+	}
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"strconv"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/binary"
+	"github.com/tehmoon/errors"
+)
+
+// Fields of a raw ClientHello used to fingerprint the client.
+// GREASE values are kept, they are skipped when fingerprinting.
+type TLSClientHello struct {
+	Version uint16
+	CipherSuites []uint16
+	Extensions []uint16
+	ServerName string
+	SupportedGroups []uint16
+	PointFormats []uint8
+	SignatureAlgorithms []uint16
+	ALPN []string
+	SupportedVersions []uint16
+}
+
+const (
+	tlsExtensionServerName uint16 = 0
+	tlsExtensionSupportedGroups uint16 = 10
+	tlsExtensionPointFormats uint16 = 11
+	tlsExtensionSignatureAlgorithms uint16 = 13
+	tlsExtensionALPN uint16 = 16
+	tlsExtensionSupportedVersions uint16 = 43
+)
+
+// Reads bytes and length prefixed vectors, ok is false
+// once something is truncated.
+type tlsClientHelloReader struct {
+	data []byte
+	ok bool
+}
+
+func (r *tlsClientHelloReader) bytes(n int) ([]byte) {
+	if ! r.ok || len(r.data) < n {
+		r.ok = false
+		return nil
+	}
+
+	b := r.data[:n]
+	r.data = r.data[n:]
+
+	return b
+}
+
+func (r *tlsClientHelloReader) uint8() (uint8) {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+
+	return b[0]
+}
+
+func (r *tlsClientHelloReader) uint16() (uint16) {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+
+	return binary.BigEndian.Uint16(b)
+}
+
+func (r *tlsClientHelloReader) vector8() (*tlsClientHelloReader) {
+	return &tlsClientHelloReader{data: r.bytes(int(r.uint8())), ok: r.ok,}
+}
+
+func (r *tlsClientHelloReader) vector16() (*tlsClientHelloReader) {
+	return &tlsClientHelloReader{data: r.bytes(int(r.uint16())), ok: r.ok,}
+}
+
+func (r *tlsClientHelloReader) uint16s() ([]uint16) {
+	values := make([]uint16, 0, len(r.data) / 2)
+
+	for r.ok && len(r.data) >= 2 {
+		values = append(values, r.uint16())
+	}
+
+	return values
+}
+
+// Parse the ClientHello from the TLS records sent by the client
+func TLSParseClientHello(data []byte) (*TLSClientHello, error) {
+	message := make([]byte, 0)
+	records := &tlsClientHelloReader{data: data, ok: true,}
+
+	// The handshake message can span multiple records
+	for records.ok && len(records.data) > 0 {
+		if records.uint8() != 0x16 {
+			break
+		}
+
+		records.uint16()
+		message = append(message, records.vector16().data...)
+	}
+
+	r := &tlsClientHelloReader{data: message, ok: true,}
+
+	if r.uint8() != 0x01 {
+		return nil, errors.New("Handshake message is not a client hello")
+	}
+
+	length := r.bytes(3)
+	if length == nil || int(length[0]) << 16 | int(length[1]) << 8 | int(length[2]) > len(r.data) {
+		return nil, errors.New("Client hello is truncated")
+	}
+
+	hello := &TLSClientHello{}
+
+	hello.Version = r.uint16()
+	r.bytes(32)
+	r.vector8()
+	hello.CipherSuites = r.vector16().uint16s()
+	r.vector8()
+
+	if ! r.ok {
+		return nil, errors.New("Client hello is truncated")
+	}
+
+	extensions := r.vector16()
+
+	for extensions.ok && len(extensions.data) >= 4 {
+		t := extensions.uint16()
+		ext := extensions.vector16()
+
+		hello.Extensions = append(hello.Extensions, t)
+
+		switch t {
+			case tlsExtensionServerName:
+				names := ext.vector16()
+				for names.ok && len(names.data) > 0 {
+					nameType := names.uint8()
+					name := names.vector16()
+
+					if nameType == 0 {
+						hello.ServerName = string(name.data)
+					}
+				}
+			case tlsExtensionSupportedGroups:
+				hello.SupportedGroups = ext.vector16().uint16s()
+			case tlsExtensionPointFormats:
+				hello.PointFormats = ext.vector8().data
+			case tlsExtensionSignatureAlgorithms:
+				hello.SignatureAlgorithms = ext.vector16().uint16s()
+			case tlsExtensionALPN:
+				protocols := ext.vector16()
+				for protocols.ok && len(protocols.data) > 0 {
+					protocol := protocols.vector8()
+					if protocol.ok {
+						hello.ALPN = append(hello.ALPN, string(protocol.data))
+					}
+				}
+			case tlsExtensionSupportedVersions:
+				hello.SupportedVersions = ext.vector8().uint16s()
+		}
+	}
+
+	if ! extensions.ok {
+		return nil, errors.New("Client hello extensions are truncated")
+	}
+
+	return hello, nil
+}
+
+// GREASE values from RFC 8701, 0x0a0a to 0xfafa
+func TLSIsGREASE(value uint16) (bool) {
+	return value & 0x0f0f == 0x0a0a && value >> 8 == value & 0xff
+}
+
+func tlsWithoutGREASE(values []uint16) ([]uint16) {
+	filtered := make([]uint16, 0, len(values))
+
+	for _, value := range values {
+		if ! TLSIsGREASE(value) {
+			filtered = append(filtered, value)
+		}
+	}
+
+	return filtered
+}
+
+func tlsJoinUint16(values []uint16, format, sep string) (string) {
+	parts := make([]string, 0, len(values))
+
+	for _, value := range values {
+		parts = append(parts, fmt.Sprintf(format, value))
+	}
+
+	return strings.Join(parts, sep)
+}
+
+// JA3 string before hashing
+func (h *TLSClientHello) JA3() (string) {
+	formats := make([]uint16, 0, len(h.PointFormats))
+	for _, format := range h.PointFormats {
+		formats = append(formats, uint16(format))
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(h.Version)),
+		tlsJoinUint16(tlsWithoutGREASE(h.CipherSuites), "%d", "-"),
+		tlsJoinUint16(tlsWithoutGREASE(h.Extensions), "%d", "-"),
+		tlsJoinUint16(tlsWithoutGREASE(h.SupportedGroups), "%d", "-"),
+		tlsJoinUint16(formats, "%d", "-"),
+	}, ",")
+}
+
+func (h *TLSClientHello) JA3Hash() (string) {
+	sum := md5.Sum([]byte(h.JA3()))
+	return hex.EncodeToString(sum[:])
+}
+
+// JA4 fingerprint over TCP
+func (h *TLSClientHello) JA4() (string) {
+	// The highest supported version takes over the legacy one
+	version := h.Version
+	if supported := tlsWithoutGREASE(h.SupportedVersions); len(supported) > 0 {
+		version = 0
+		for _, v := range supported {
+			if v > version {
+				version = v
+			}
+		}
+	}
+
+	versions := map[uint16]string{
+		0x0304: "13",
+		0x0303: "12",
+		0x0302: "11",
+		0x0301: "10",
+		0x0300: "s3",
+	}
+
+	v, found := versions[version]
+	if ! found {
+		v = "00"
+	}
+
+	sni := "i"
+	if h.ServerName != "" {
+		sni = "d"
+	}
+
+	ciphers := tlsWithoutGREASE(h.CipherSuites)
+	extensions := tlsWithoutGREASE(h.Extensions)
+
+	alpn := "00"
+	if len(h.ALPN) > 0 && len(h.ALPN[0]) > 0 {
+		first, last := h.ALPN[0][0], h.ALPN[0][len(h.ALPN[0]) - 1]
+		if tlsIsAlphanumeric(first) && tlsIsAlphanumeric(last) {
+			alpn = string([]byte{first, last,})
+		} else {
+			alpn = hex.EncodeToString([]byte{first,})[:1] + hex.EncodeToString([]byte{last,})[1:]
+		}
+	}
+
+	a := fmt.Sprintf("t%s%s%02d%02d%s", v, sni, tlsMin(len(ciphers), 99), tlsMin(len(extensions), 99), alpn)
+
+	sortedCiphers := append([]uint16{}, ciphers...)
+	sort.Slice(sortedCiphers, func(i, j int) (bool) {
+		return sortedCiphers[i] < sortedCiphers[j]
+	})
+
+	sortedExtensions := make([]uint16, 0, len(extensions))
+	for _, ext := range extensions {
+		if ext != tlsExtensionServerName && ext != tlsExtensionALPN {
+			sortedExtensions = append(sortedExtensions, ext)
+		}
+	}
+
+	sort.Slice(sortedExtensions, func(i, j int) (bool) {
+		return sortedExtensions[i] < sortedExtensions[j]
+	})
+
+	c := tlsJoinUint16(sortedExtensions, "%04x", ",")
+	if len(h.SignatureAlgorithms) > 0 {
+		c += "_" + tlsJoinUint16(h.SignatureAlgorithms, "%04x", ",")
+	}
+
+	return a + "_" + tlsJA4Hash(tlsJoinUint16(sortedCiphers, "%04x", ","), len(sortedCiphers)) + "_" + tlsJA4Hash(c, len(sortedExtensions))
+}
+
+func tlsJA4Hash(s string, count int) (string) {
+	if count == 0 {
+		return "000000000000"
+	}
+
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func tlsIsAlphanumeric(b byte) (bool) {
+	return (b >= '0' && b <= '9') || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+func tlsMin(a, b int) (int) {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// Set the fingerprints and the offered parameters in metadata
+func (h *TLSClientHello) SetMetadata(metadata map[string]interface{}) {
+	ciphers := make([]string, 0, len(h.CipherSuites))
+	for _, id := range tlsWithoutGREASE(h.CipherSuites) {
+		ciphers = append(ciphers, tls.CipherSuiteName(id))
+	}
+
+	versions := make([]string, 0, len(h.SupportedVersions))
+	for _, version := range tlsWithoutGREASE(h.SupportedVersions) {
+		versions = append(versions, TLSVersionName(version))
+	}
+
+	extensions := make([]int, 0, len(h.Extensions))
+	for _, ext := range tlsWithoutGREASE(h.Extensions) {
+		extensions = append(extensions, int(ext))
+	}
+
+	alpn := h.ALPN
+	if alpn == nil {
+		alpn = []string{}
+	}
+
+	metadata["ja3"] = h.JA3()
+	metadata["ja3-hash"] = h.JA3Hash()
+	metadata["ja4"] = h.JA4()
+	metadata["ciphers"] = ciphers
+	metadata["alpn"] = alpn
+	metadata["versions"] = versions
+	metadata["extensions"] = extensions
+}
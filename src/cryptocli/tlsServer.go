@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"github.com/tehmoon/errors"
+	"github.com/spf13/pflag"
+)
+
+/*
+TLS termination shared by the server modules. TLS is enabled when a
+certificate is set or when --tls-self-signed is set. Self-signed certificates
+are created on the fly for the servername of each client hello and cached,
+they are signed by a CA created at start and logged so clients can trust it.
+*/
+
+// Number of self-signed certificates to keep
+const TLSServerCertCacheSize = 1024
+
+var TLSVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+type TLSServerOptions struct {
+	cert string
+	key string
+	certIn string
+	keyIn string
+	clientCA string
+	alpn []string
+	minVersion string
+	selfSigned bool
+	caCert *x509.Certificate
+	caKey crypto.PrivateKey
+	certCache *TLSCertCache
+}
+
+func (o *TLSServerOptions) SetFlagSet(fs *pflag.FlagSet) {
+	fs.StringVar(&o.cert, "tls-cert", "", "Serve TLS with the PEM certificate chain from file")
+	fs.StringVar(&o.key, "tls-key", "", "PEM private key file of the certificate")
+	fs.StringVar(&o.certIn, "tls-cert-in", "", "Pipeline definition to read the PEM certificate chain")
+	fs.StringVar(&o.keyIn, "tls-key-in", "", "Pipeline definition to read the PEM private key")
+	fs.StringVar(&o.clientCA, "tls-client-ca", "", "Require client certificates signed by one of the CAs from the PEM file")
+	fs.StringArrayVar(&o.alpn, "tls-alpn", []string{}, "Protocol to negotiate with ALPN, in order of preference")
+	fs.StringVar(&o.minVersion, "tls-min-version", "1.2", "Minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	fs.BoolVar(&o.selfSigned, "tls-self-signed", false, "Serve TLS with certificates created on the fly")
+}
+
+// Returns nil when TLS is not enabled
+func (o *TLSServerOptions) Config() (*tls.Config, error) {
+	hasCert := o.cert != "" || o.certIn != ""
+	hasKey := o.key != "" || o.keyIn != ""
+
+	if o.cert != "" && o.certIn != "" {
+		return nil, errors.Errorf("Flag %q and flag %q are mutually exclusive", "--tls-cert", "--tls-cert-in")
+	}
+
+	if o.key != "" && o.keyIn != "" {
+		return nil, errors.Errorf("Flag %q and flag %q are mutually exclusive", "--tls-key", "--tls-key-in")
+	}
+
+	if hasCert != hasKey {
+		return nil, errors.New("Both the TLS certificate and key are required")
+	}
+
+	if hasCert && o.selfSigned {
+		return nil, errors.Errorf("Flag %q cannot be used with a certificate", "--tls-self-signed")
+	}
+
+	if ! hasCert && ! o.selfSigned {
+		if o.clientCA != "" || len(o.alpn) > 0 {
+			return nil, errors.Errorf("Flag %q or %q is required to serve TLS", "--tls-cert", "--tls-self-signed")
+		}
+
+		return nil, nil
+	}
+
+	version, found := TLSVersions[o.minVersion]
+	if ! found {
+		return nil, errors.Errorf("Version %q is not supported for flag %q", o.minVersion, "--tls-min-version")
+	}
+
+	config := &tls.Config{
+		MinVersion: version,
+		NextProtos: o.alpn,
+	}
+
+	if hasCert {
+		certPEM, err := tlsServerReadPEM(o.cert, o.certIn)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error reading TLS certificate")
+		}
+
+		keyPEM, err := tlsServerReadPEM(o.key, o.keyIn)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error reading TLS key")
+		}
+
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error loading TLS certificate and key")
+		}
+
+		config.Certificates = []tls.Certificate{cert,}
+	} else {
+		var err error
+
+		o.caCert, o.caKey, err = TLSLoadCA("", "", "ecdsa")
+		if err != nil {
+			return nil, err
+		}
+
+		o.certCache = NewTLSCertCache(TLSServerCertCacheSize)
+
+		config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return o.certCache.Get(hello.ServerName, func() (*tls.Certificate, error) {
+				return TLSForgeCertificate(hello.ServerName, o.caCert, o.caKey)
+			})
+		}
+	}
+
+	if o.clientCA != "" {
+		data, err := ioutil.ReadFile(o.clientCA)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error reading client CA file")
+		}
+
+		pool := x509.NewCertPool()
+		if ! pool.AppendCertsFromPEM(data) {
+			return nil, errors.Errorf("No certificate found in client CA file %q", o.clientCA)
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+func tlsServerReadPEM(file, pipe string) ([]byte, error) {
+	if file != "" {
+		return ioutil.ReadFile(file)
+	}
+
+	return ReadAllPipeline(pipe)
+}
+
+// Add the negotiated parameters and the verified client certificate to metadata
+func TLSServerMetadata(state *tls.ConnectionState, metadata map[string]interface{}) {
+	metadata["tls-version"] = TLSVersionName(state.Version)
+	metadata["tls-alpn"] = state.NegotiatedProtocol
+	metadata["tls-servername"] = state.ServerName
+
+	if len(state.PeerCertificates) == 0 {
+		return
+	}
+
+	cert := state.PeerCertificates[0]
+	sum := sha256.Sum256(cert.Raw)
+
+	metadata["tls-client-subject"] = cert.Subject.String()
+	metadata["tls-client-fingerprint"] = hex.EncodeToString(sum[:])
+}
+
+func TLSVersionName(version uint16) (string) {
+	for name, v := range TLSVersions {
+		if v == version {
+			return name
+		}
+	}
+
+	return ""
+}
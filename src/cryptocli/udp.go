@@ -0,0 +1,219 @@
+package main
+
+import (
+	"time"
+	"net"
+	"github.com/tehmoon/errors"
+	"github.com/spf13/pflag"
+	"sync"
+	"log"
+	"text/template"
+	"bytes"
+)
+
+func init() {
+	MODULELIST.Register("udp", "Sends each message as an UDP datagram and reads the responses", NewUDP)
+}
+
+// Biggest payload of an UDP datagram
+const UDPMaxDatagramSize = 65535
+
+type UDP struct {
+	addr string
+	readTimeout time.Duration
+	tplAddr *template.Template
+}
+
+func (m *UDP) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.StringVar(&m.addr, "addr", "", "Udp address to send datagrams to")
+	fs.DurationVar(&m.readTimeout, "read-timeout", 3 * time.Second, "Once the input is closed, stop reading when no datagram has been received for this amount of time")
+}
+
+func (m *UDP) Init(in, out chan *Message, global *GlobalFlags) (err error) {
+	if m.readTimeout <= 0 {
+		return errors.Errorf("Flag %q has to be greater that 0", "--read-timeout")
+	}
+
+	m.tplAddr, err = template.New("root").Parse(m.addr)
+	if err != nil {
+		return errors.Wrap(err, "Error parsing template for \"--addr\" flag")
+	}
+
+	go func(in, out chan *Message) {
+		wg := &sync.WaitGroup{}
+
+		init := false
+		mc := NewMessageChannel()
+
+		out <- &Message{
+			Type: MessageTypeChannel,
+			Interface: mc.Callback,
+		}
+
+		LOOP: for message := range in {
+			switch message.Type {
+				case MessageTypeTerminate:
+					if ! init {
+						close(mc.Channel)
+					}
+
+					wg.Wait()
+					out <- message
+					break LOOP
+				case MessageTypeChannel:
+					cb, ok := message.Interface.(MessageChannelFunc)
+					if ok {
+						if ! init {
+							init = true
+						} else {
+							mc = NewMessageChannel()
+
+							out <- &Message{
+								Type: MessageTypeChannel,
+								Interface: mc.Callback,
+							}
+						}
+
+						wg.Add(1)
+						go udpStartHandler(m, cb, mc, wg)
+
+						if ! global.MultiStreams {
+							wg.Wait()
+							out <- &Message{Type: MessageTypeTerminate,}
+							break LOOP
+						}
+					}
+			}
+		}
+
+		wg.Wait()
+		// Last message will signal the closing of the channel
+		<- in
+		close(out)
+	}(in, out)
+
+	return nil
+}
+
+// Each message is sent as a datagram and each datagram received is sent
+// as a message. Once all the messages have been sent, reading stops after
+// the read timeout so late responses can still be received.
+func udpStartHandler(m *UDP, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	mc.Start(nil)
+	metadata, inc := cb()
+	outc := mc.Channel
+
+	buff := bytes.NewBuffer(make([]byte, 0))
+	err := m.tplAddr.Execute(buff, metadata)
+	if err != nil {
+		err = errors.Wrap(err, "Error executing template addr")
+		log.Println(err.Error())
+		close(outc)
+		DrainChannel(inc, nil)
+		return
+	}
+	addr := string(buff.Bytes()[:])
+
+	a, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		err = errors.Wrap(err, "Unable to resolve udp address")
+		log.Println(err.Error())
+		close(outc)
+		DrainChannel(inc, nil)
+		return
+	}
+
+	conn, err := net.DialUDP("udp", nil, a)
+	if err != nil {
+		err = errors.Wrap(err, "Fail to dial udp")
+		log.Println(err.Error())
+		close(outc)
+		DrainChannel(inc, nil)
+		return
+	}
+	defer conn.Close()
+
+	deadline := &udpReadDeadline{timeout: m.readTimeout,}
+
+	syn := &sync.WaitGroup{}
+	syn.Add(2)
+
+	go udpStartIn(conn, inc, deadline, syn)
+	go udpStartOut(conn, outc, deadline, syn)
+
+	syn.Wait()
+}
+
+// The read deadline is only set once the input is closed, the lock
+// makes sure a read never starts without it after that.
+type udpReadDeadline struct {
+	sync.Mutex
+	closed bool
+	timeout time.Duration
+}
+
+func (d *udpReadDeadline) Set(conn *net.UDPConn) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.closed {
+		conn.SetReadDeadline(time.Now().Add(d.timeout))
+		return
+	}
+
+	conn.SetReadDeadline(time.Time{})
+}
+
+func (d *udpReadDeadline) Close(conn *net.UDPConn) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.closed = true
+	conn.SetReadDeadline(time.Now().Add(d.timeout))
+}
+
+func udpStartIn(conn *net.UDPConn, inc chan []byte, deadline *udpReadDeadline, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer deadline.Close(conn)
+
+	for payload := range inc {
+		_, err := conn.Write(payload)
+		if err != nil {
+			err = errors.Wrap(err, "Error writing to udp connection in udp")
+			log.Println(err.Error())
+			break
+		}
+	}
+
+	DrainChannel(inc, nil)
+}
+
+func udpStartOut(conn *net.UDPConn, outc chan []byte, deadline *udpReadDeadline, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer close(outc)
+
+	for {
+		deadline.Set(conn)
+
+		buff := make([]byte, UDPMaxDatagramSize)
+
+		i, err := conn.Read(buff)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return
+			}
+
+			err = errors.Wrap(err, "Error reading udp connection in udp")
+			log.Println(err.Error())
+			return
+		}
+
+		outc <- buff[:i]
+	}
+}
+
+func NewUDP() (Module) {
+	return &UDP{}
+}
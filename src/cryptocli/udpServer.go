@@ -0,0 +1,57 @@
+package main
+
+import (
+	"time"
+	"log"
+	"net"
+	"github.com/tehmoon/errors"
+	"github.com/spf13/pflag"
+)
+
+func init() {
+	MODULELIST.Register("udp-server", "Listens UDP and creates a stream per remote address", NewUDPServer)
+}
+
+// udp-server module creates a session per remote address, see StartPacketServer.
+
+type UDPServer struct {
+	addr string
+	connectTimeout time.Duration
+	idleTimeout time.Duration
+}
+
+func (m *UDPServer) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.StringVar(&m.addr, "listen", "", "Listen on addr:port. If port is 0, random port will be assigned")
+	fs.DurationVar(&m.connectTimeout, "connect-timeout", 30 * time.Second, "Max amount of time to wait for a potential datagram when pipeline is closing")
+	fs.DurationVar(&m.idleTimeout, "idle-timeout", 15 * time.Second, "End the session when no datagram has been received from the remote address for this amount of time")
+}
+
+func NewUDPServer() (Module) {
+	return &UDPServer{}
+}
+
+func (m *UDPServer) Init(in, out chan *Message, global *GlobalFlags) (error) {
+	if m.idleTimeout < 1 {
+		return errors.Errorf("Flag %q cannot be negative or zero", "--idle-timeout")
+	}
+
+	if m.connectTimeout < 1 {
+		return errors.Errorf("Flag %q cannot be negative or zero", "--connect-timeout")
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", m.addr)
+	if err != nil {
+		return errors.Wrap(err, "Unable to resolve udp address")
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return errors.Wrap(err, "Unable to listen on udp address")
+	}
+
+	log.Printf("Udp-server listening on %s\n", conn.LocalAddr().String())
+
+	go StartPacketServer("udp", conn, m.addr, m.connectTimeout, m.idleTimeout, in, out, global)
+
+	return nil
+}
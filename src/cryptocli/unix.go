@@ -0,0 +1,219 @@
+package main
+
+import (
+	"time"
+	"net"
+	"os"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"github.com/tehmoon/errors"
+	"github.com/spf13/pflag"
+	"sync"
+	"log"
+	"text/template"
+	"bytes"
+)
+
+func init() {
+	MODULELIST.Register("unix", "Connects to a unix socket file", NewUnix)
+}
+
+/*
+unix module works like tcp in stream and seqpacket modes, seqpacket sends
+one message per packet. In datagram mode, it works like udp: the socket is
+bound to a temporary file so responses can be received.
+*/
+
+type Unix struct {
+	addr string
+	socketType string
+	network string
+	readTimeout time.Duration
+	tplAddr *template.Template
+}
+
+func (m *Unix) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.StringVar(&m.addr, "addr", "", "Path of the unix socket file to connect to")
+	fs.StringVar(&m.socketType, "type", "stream", "Socket type: stream, seqpacket or datagram")
+	fs.DurationVar(&m.readTimeout, "read-timeout", 3 * time.Second, "Read timeout for the unix connection")
+}
+
+func (m *Unix) Init(in, out chan *Message, global *GlobalFlags) (err error) {
+	if m.readTimeout <= 0 {
+		return errors.Errorf("Flag %q has to be greater that 0", "--read-timeout")
+	}
+
+	network, found := UnixSocketTypes[m.socketType]
+	if ! found {
+		return errors.Errorf("Socket type %q is not supported for flag %q", m.socketType, "--type")
+	}
+	m.network = network
+
+	m.tplAddr, err = template.New("root").Parse(m.addr)
+	if err != nil {
+		return errors.Wrap(err, "Error parsing template for \"--addr\" flag")
+	}
+
+	go func(in, out chan *Message) {
+		wg := &sync.WaitGroup{}
+
+		init := false
+		mc := NewMessageChannel()
+
+		out <- &Message{
+			Type: MessageTypeChannel,
+			Interface: mc.Callback,
+		}
+
+		LOOP: for message := range in {
+			switch message.Type {
+				case MessageTypeTerminate:
+					if ! init {
+						close(mc.Channel)
+					}
+
+					wg.Wait()
+					out <- message
+					break LOOP
+				case MessageTypeChannel:
+					cb, ok := message.Interface.(MessageChannelFunc)
+					if ok {
+						if ! init {
+							init = true
+						} else {
+							mc = NewMessageChannel()
+
+							out <- &Message{
+								Type: MessageTypeChannel,
+								Interface: mc.Callback,
+							}
+						}
+
+						wg.Add(1)
+						go unixStartHandler(m, cb, mc, wg)
+
+						if ! global.MultiStreams {
+							wg.Wait()
+							out <- &Message{Type: MessageTypeTerminate,}
+							break LOOP
+						}
+					}
+			}
+		}
+
+		wg.Wait()
+		// Last message will signal the closing of the channel
+		<- in
+		close(out)
+	}(in, out)
+
+	return nil
+}
+
+func unixStartHandler(m *Unix, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	mc.Start(nil)
+	metadata, inc := cb()
+	outc := mc.Channel
+
+	buff := bytes.NewBuffer(make([]byte, 0))
+	err := m.tplAddr.Execute(buff, metadata)
+	if err != nil {
+		err = errors.Wrap(err, "Error executing template addr")
+		log.Println(err.Error())
+		close(outc)
+		DrainChannel(inc, nil)
+		return
+	}
+	addr := string(buff.Bytes()[:])
+
+	var local *net.UnixAddr
+
+	if m.network == "unixgram" {
+		dir, err := ioutil.TempDir("", "cryptocli-unix")
+		if err != nil {
+			err = errors.Wrap(err, "Error creating directory for the local unix socket")
+			log.Println(err.Error())
+			close(outc)
+			DrainChannel(inc, nil)
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		local = &net.UnixAddr{Name: filepath.Join(dir, "socket"), Net: m.network,}
+	}
+
+	conn, err := net.DialUnix(m.network, local, &net.UnixAddr{Name: addr, Net: m.network,})
+	if err != nil {
+		err = errors.Wrap(err, "Fail to dial unix")
+		log.Println(err.Error())
+		close(outc)
+		DrainChannel(inc, nil)
+		return
+	}
+	defer conn.Close()
+
+	step := ReadBytesStep
+	if m.network != "unix" {
+		step = ReadPacketsStep
+	}
+
+	syn := &sync.WaitGroup{}
+	syn.Add(2)
+
+	go unixStartIn(conn, inc, m.network == "unixgram", syn)
+	go unixStartOut(conn, outc, m.readTimeout, step, m.network == "unixgram", syn)
+
+	syn.Wait()
+}
+
+// Connections are closed when there is nothing left to send, except in
+// datagram mode where responses are read until the read timeout.
+func unixStartIn(conn net.Conn, inc chan []byte, datagram bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	if ! datagram {
+		defer conn.Close()
+	}
+
+	for payload := range inc {
+		_, err := conn.Write(payload)
+		if err != nil {
+			err = errors.Wrap(err, "Error writing to unix connection in unix")
+			log.Println(err.Error())
+			break
+		}
+	}
+
+	DrainChannel(inc, nil)
+}
+
+func unixStartOut(conn net.Conn, outc chan []byte, timeout time.Duration, step func(io.Reader, func([]byte) (bool)) (error), datagram bool, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer close(outc)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+
+	err := step(conn, func(payload []byte) (bool) {
+		outc <- payload
+		conn.SetReadDeadline(time.Now().Add(timeout))
+
+		return true
+	})
+	if err != nil {
+		if nerr, ok := err.(net.Error); ok && nerr.Timeout() && datagram {
+			return
+		}
+
+		err = errors.Wrap(err, "Error reading unix connection in unix")
+		log.Println(err.Error())
+		return
+	}
+}
+
+func NewUnix() (Module) {
+	return &Unix{}
+}
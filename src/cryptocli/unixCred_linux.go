@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// Returns the pid, uid and gid of the process on the other end of
+// the unix socket, nil when they are not available.
+func UnixPeerCredentials(conn net.Conn) (map[string]interface{}) {
+	sc, ok := conn.(syscall.Conn)
+	if ! ok {
+		return nil
+	}
+
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return nil
+	}
+
+	var ucred *syscall.Ucred
+
+	err = raw.Control(func(fd uintptr) {
+		ucred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || ucred == nil {
+		return nil
+	}
+
+	return map[string]interface{}{
+		"peer-pid": int64(ucred.Pid),
+		"peer-uid": int64(ucred.Uid),
+		"peer-gid": int64(ucred.Gid),
+	}
+}
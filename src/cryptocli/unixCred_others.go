@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"net"
+)
+
+// Peer credentials are only supported on linux
+func UnixPeerCredentials(conn net.Conn) (map[string]interface{}) {
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"time"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"github.com/tehmoon/errors"
+	"github.com/spf13/pflag"
+)
+
+func init() {
+	MODULELIST.Register("unix-server", "Listens on a unix socket file and wait for a single connection to complete", NewUnixServer)
+}
+
+/*
+unix-server module works like tcp-server in stream and seqpacket modes, each
+connection has its own channel with the peer credentials in the metadata when
+the system supports them. Seqpacket connections send one message per packet.
+
+In datagram mode, it works like udp-server: a session is created per sender
+socket path. Senders that did not bind their socket share the same session and
+cannot receive responses.
+*/
+
+// Socket types mapped to their network
+var UnixSocketTypes = map[string]string{
+	"stream": "unix",
+	"seqpacket": "unixpacket",
+	"datagram": "unixgram",
+}
+
+type UnixServer struct {
+	path string
+	socketType string
+	network string
+	mode string
+	removeStale bool
+	connectTimeout time.Duration
+	readTimeout time.Duration
+}
+
+func unixServerHandler(conn net.Conn, m *UnixServer, relay *ServerRelayer) {
+	metadata := map[string]interface{}{
+		"local-addr": conn.LocalAddr().String(),
+		"remote-addr": conn.RemoteAddr().String(),
+		"addr": m.path,
+	}
+
+	for k, v := range UnixPeerCredentials(conn) {
+		metadata[k] = v
+	}
+
+	step := ReadBytesStep
+	if m.socketType == "seqpacket" {
+		step = ReadPacketsStep
+	}
+
+	ServerConnHandler("unix", conn, relay, metadata, m.readTimeout, step)
+}
+
+func (m *UnixServer) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.StringVar(&m.path, "listen", "", "Path of the unix socket file to listen on")
+	fs.StringVar(&m.socketType, "type", "stream", "Socket type: stream, seqpacket or datagram")
+	fs.StringVar(&m.mode, "mode", "0600", "Permissions of the socket file in octal")
+	fs.BoolVar(&m.removeStale, "remove-stale", true, "Remove the socket file if nobody is listening on it")
+	fs.DurationVar(&m.connectTimeout, "connect-timeout", 30 * time.Second, "Max amount of time to wait for a potential connection when pipeline is closing")
+	fs.DurationVar(&m.readTimeout, "read-timeout", 15 * time.Second, "Amout of time to wait reading from the connection. In datagram mode, end the session when nothing has been received for this amount of time")
+}
+
+func NewUnixServer() (Module) {
+	return &UnixServer{}
+}
+
+func (m *UnixServer) Init(in, out chan *Message, global *GlobalFlags) (error) {
+	if m.path == "" {
+		return errors.Errorf("Flag %q must be present", "--listen")
+	}
+
+	network, found := UnixSocketTypes[m.socketType]
+	if ! found {
+		return errors.Errorf("Socket type %q is not supported for flag %q", m.socketType, "--type")
+	}
+	m.network = network
+
+	mode, err := strconv.ParseUint(m.mode, 8, 32)
+	if err != nil {
+		return errors.Wrapf(err, "Error parsing octal for flag %q", "--mode")
+	}
+
+	if m.readTimeout < 1 {
+		return errors.Errorf("Flag %q cannot be negative or zero", "--read-timeout")
+	}
+
+	if m.connectTimeout < 1 {
+		return errors.Errorf("Flag %q cannot be negative or zero", "--connect-timeout")
+	}
+
+	if m.removeStale {
+		err = UnixRemoveStale(m.network, m.path)
+		if err != nil {
+			return errors.Wrap(err, "Error removing stale unix socket")
+		}
+	}
+
+	addr := &net.UnixAddr{Name: m.path, Net: m.network,}
+
+	if m.network == "unixgram" {
+		conn, err := net.ListenUnixgram(m.network, addr)
+		if err != nil {
+			return errors.Wrap(err, "Unable to listen on unix socket")
+		}
+
+		err = os.Chmod(m.path, os.FileMode(mode))
+		if err != nil {
+			conn.Close()
+			os.Remove(m.path)
+			return errors.Wrap(err, "Error changing permissions of unix socket")
+		}
+
+		log.Printf("Unix-server listening on %s\n", m.path)
+
+		go func() {
+			StartPacketServer("unix", conn, m.path, m.connectTimeout, m.readTimeout, in, out, global)
+			os.Remove(m.path)
+		}()
+
+		return nil
+	}
+
+	// The socket file is removed when the listener is closed
+	listener, err := net.ListenUnix(m.network, addr)
+	if err != nil {
+		return errors.Wrap(err, "Unable to listen on unix socket")
+	}
+
+	err = os.Chmod(m.path, os.FileMode(mode))
+	if err != nil {
+		listener.Close()
+		return errors.Wrap(err, "Error changing permissions of unix socket")
+	}
+
+	log.Printf("Unix-server listening on %s\n", m.path)
+
+	go StartServer("unix", listener, m.connectTimeout, func(conn net.Conn, relay *ServerRelayer) {
+		unixServerHandler(conn, m, relay)
+	}, in, out, global)
+
+	return nil
+}
+
+// Remove the socket file at path if nobody is listening on it.
+// Files that are not sockets are left untouched.
+func UnixRemoveStale(network, path string) (error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	if info.Mode() & os.ModeSocket == 0 {
+		return errors.Errorf("File %q exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout(network, path, time.Second)
+	if err == nil {
+		conn.Close()
+		return errors.Errorf("Socket %q is in use", path)
+	}
+
+	// Other errors like a wrong socket type don't mean nobody is listening
+	if operr, ok := err.(*net.OpError); ok {
+		if serr, ok := operr.Err.(*os.SyscallError); ok && serr.Err == syscall.ECONNREFUSED {
+			return os.Remove(path)
+		}
+	}
+
+	return errors.Wrapf(err, "Unable to tell if socket %q is stale", path)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"sync"
+	"github.com/spf13/pflag"
+	"github.com/tehmoon/errors"
+	"log"
+	"io"
+	"archive/tar"
+	"regexp"
+)
+
+func init() {
+	MODULELIST.Register("untar", "Read a tar archive and send each matching file to its own channel", NewUntar)
+}
+
+type Untar struct {
+	patterns []string
+	rePatterns []*regexp.Regexp
+}
+
+func (m *Untar) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.StringArrayVar(&m.patterns, "pattern", []string{".*",}, "Send the file if its name matches one of the patterns")
+}
+
+func (m *Untar) Init(in, out chan *Message, global *GlobalFlags) (error) {
+	if ! global.MultiStreams {
+		return errors.Errorf("Flag %q is required since each file is sent to its own channel", "--multi-streams")
+	}
+
+	m.rePatterns = make([]*regexp.Regexp, 0)
+
+	for _, pattern := range m.patterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return errors.Wrapf(err, "Err compiling pattern %q", pattern)
+		}
+
+		m.rePatterns = append(m.rePatterns, re)
+	}
+
+	go func(in, out chan *Message) {
+		wg := &sync.WaitGroup{}
+
+		init := false
+		mc := NewMessageChannel()
+
+		out <- &Message{
+			Type: MessageTypeChannel,
+			Interface: mc.Callback,
+		}
+
+		LOOP: for message := range in {
+			switch message.Type {
+				case MessageTypeTerminate:
+					if ! init {
+						close(mc.Channel)
+					}
+
+					wg.Wait()
+					out <- message
+					break LOOP
+				case MessageTypeChannel:
+					cb, ok := message.Interface.(MessageChannelFunc)
+					if ok {
+						if ! init {
+							init = true
+						} else {
+							mc = NewMessageChannel()
+
+							out <- &Message{
+								Type: MessageTypeChannel,
+								Interface: mc.Callback,
+							}
+						}
+
+						wg.Add(1)
+						go untarStartHandler(m, out, cb, mc, wg)
+					}
+			}
+		}
+
+		wg.Wait()
+		// Last message will signal the closing of the channel
+		<- in
+		close(out)
+	}(in, out)
+
+	return nil
+}
+
+func (m *Untar) match(name string) (bool) {
+	for _, re := range m.rePatterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The archive is read as it comes, each matching regular file
+// is sent to its own channel.
+func untarStartHandler(m *Untar, out chan *Message, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	_, inc := cb()
+	defer DrainChannel(inc, nil)
+
+	mr := NewMessageReader(inc)
+	defer mr.Close()
+
+	reader := tar.NewReader(mr)
+
+	fanOut := NewMessageFanOut(out, mc)
+	defer fanOut.Close()
+
+	for {
+		header, err := reader.Next()
+		if err != nil {
+			if err != io.EOF {
+				err = errors.Wrap(err, "Error reading archive in untar module")
+				log.Println(err.Error())
+			}
+
+			return
+		}
+
+		if ! header.FileInfo().Mode().IsRegular() || ! m.match(header.Name) {
+			continue
+		}
+
+		metadata := map[string]interface{}{
+			"index": fanOut.Count(),
+			"name": header.Name,
+			"mode": header.FileInfo().Mode(),
+			"size": header.Size,
+			"mtime": header.ModTime,
+			"uid": header.Uid,
+			"gid": header.Gid,
+			"uname": header.Uname,
+			"gname": header.Gname,
+		}
+
+		mc = fanOut.Next(metadata)
+
+		err = ReadBytesSendMessages(reader, mc.Channel)
+		close(mc.Channel)
+
+		if err != nil && err != io.EOF {
+			err = errors.Wrapf(err, "Error reading %q in untar module", header.Name)
+			log.Println(err.Error())
+			return
+		}
+	}
+}
+
+func NewUntar() (Module) {
+	return &Untar{}
+}
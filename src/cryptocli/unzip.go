@@ -3,26 +3,156 @@ package main
 import (
 	"io"
 	"io/ioutil"
+	"bytes"
 	"sync"
 	"github.com/spf13/pflag"
 	"github.com/tehmoon/errors"
 	"log"
 	"os"
 	"archive/zip"
+	"compress/flate"
 	"regexp"
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"strings"
+	"time"
 )
 
 func init() {
-	MODULELIST.Register("unzip", "Buffer the zip file to disk and read selected file patterns.", NewUnzip)
+	MODULELIST.Register("unzip", "Read a zip archive and send each matching file to its own channel", NewUnzip)
 }
 
+const (
+	unzipLocalHeaderSignature = 0x04034b50
+	unzipCentralHeaderSignature = 0x02014b50
+	unzipEndSignature = 0x06054b50
+	unzipZip64EndSignature = 0x06064b50
+	unzipDataDescriptorSignature = 0x08074b50
+	unzipLocalHeaderLen = 26
+	unzipFlagEncrypted = 0x1
+	unzipFlagDataDescriptor = 0x8
+	unzipZip64ExtraID = 0x0001
+	unzipExtTimeExtraID = 0x5455
+)
+
+/*
+unzip module reads the archive as it comes using the local headers so
+nothing is buffered. The central directory is ignored, only "index", "name",
+"mtime" and "size" when it is known are set as metadata.
+
+Entries that use a data descriptor are supported. Stored ones are read up to
+the descriptor's signature whose CRC and sizes match what was read, like the
+zip module writes them. Stored entries with a descriptor without signature
+need --buffer which writes the archive to a temporary file and reads it using
+the central directory. In that case "mode" is also set.
+
+Encrypted entries are skipped.
+*/
+
 type Unzip struct {
 	patterns []string
 	rePatterns []*regexp.Regexp
+	buffer bool
+}
+
+type unzipEntry struct {
+	name string
+	flags uint16
+	method uint16
+	crc uint32
+	compressedSize uint64
+	size uint64
+	mtime time.Time
+	zip64 bool
+}
+
+// Compute the CRC32 and the size of what has been read
+type unzipChecksumReader struct {
+	reader io.Reader
+	crc uint32
+	size uint64
+}
+
+func (r *unzipChecksumReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.crc = crc32.Update(r.crc, crc32.IEEETable, p[:n])
+	r.size += uint64(n)
+
+	return n, err
+}
+
+// Read a stored entry of unknown size up to its data descriptor, which is
+// left in the reader. The signature can be part of the data so the
+// descriptor must also match the CRC and the size of what was read.
+type unzipStoredReader struct {
+	reader *bufio.Reader
+	crc uint32
+	size uint64
+	done bool
+}
+
+func (r *unzipStoredReader) Read(p []byte) (int, error) {
+	if r.done {
+		return 0, io.EOF
+	}
+
+	window, err := r.reader.Peek(r.reader.Size())
+	if len(window) < 4 {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+
+		return 0, err
+	}
+
+	i := bytes.Index(window, []byte{0x50, 0x4b, 0x07, 0x08,})
+	switch {
+		case i == -1:
+			// The signature can start in the last 3 bytes
+			i = len(window) - 3
+		case i == 0:
+			if r.descriptor(window) {
+				r.done = true
+				return 0, io.EOF
+			}
+
+			i = 1
+	}
+
+	if i > len(p) {
+		i = len(p)
+	}
+
+	n := copy(p, window[:i])
+	r.crc = crc32.Update(r.crc, crc32.IEEETable, p[:n])
+	r.size += uint64(n)
+	r.reader.Discard(n)
+
+	return n, nil
+}
+
+// True if the window starts with a descriptor, 32 or 64 bits, of what was read
+func (r *unzipStoredReader) descriptor(window []byte) (bool) {
+	le := binary.LittleEndian
+
+	if len(window) < 16 || le.Uint32(window[4:8]) != r.crc {
+		return false
+	}
+
+	if uint64(le.Uint32(window[8:12])) == r.size && uint64(le.Uint32(window[12:16])) == r.size {
+		return true
+	}
+
+	return len(window) >= 24 && le.Uint64(window[8:16]) == r.size && le.Uint64(window[16:24]) == r.size
 }
 
 func (m *Unzip) Init(in, out chan *Message, global *GlobalFlags) (error) {
-	rePatterns := make([]*regexp.Regexp, 0)
+	if ! global.MultiStreams {
+		return errors.Errorf("Flag %q is required since each file is sent to its own channel", "--multi-streams")
+	}
+
+	m.rePatterns = make([]*regexp.Regexp, 0)
 
 	for _, pattern := range m.patterns {
 		re, err := regexp.Compile(pattern)
@@ -30,11 +160,9 @@ func (m *Unzip) Init(in, out chan *Message, global *GlobalFlags) (error) {
 			return errors.Wrapf(err, "Err compiling pattern %q", pattern)
 		}
 
-		rePatterns = append(rePatterns, re)
+		m.rePatterns = append(m.rePatterns, re)
 	}
 
-	m.patterns = nil
-
 	go func(in, out chan *Message) {
 		wg := &sync.WaitGroup{}
 
@@ -71,60 +199,10 @@ func (m *Unzip) Init(in, out chan *Message, global *GlobalFlags) (error) {
 						}
 
 						wg.Add(1)
-
-						go func(cb MessageChannelFunc, mc *MessageChannel, patterns []*regexp.Regexp, wg *sync.WaitGroup) {
-							defer wg.Done()
-
-							mc.Start(nil)
-							_, inc := cb()
-
-							outc := mc.Channel
-							defer close(outc)
-
-							tempfile, err := ioutil.TempFile("", "cryptocli-zip")
-							if err != nil {
-								err = errors.Wrap(err, "Err writing to temporary file")
-								log.Println(err.Error())
-								DrainChannel(inc, nil)
-								return
-							}
-							defer os.Remove(tempfile.Name())
-							for payload := range inc {
-								_, err = tempfile.Write(payload)
-								if err != nil {
-									err = errors.Wrap(err, "Err writing to temporary file")
-									log.Println(err.Error())
-									tempfile.Close()
-									DrainChannel(inc, nil)
-									return
-								}
-							}
-
-							// Let's close the file so we can open it with the zip reader
-							tempfile.Close()
-
-							reader, err := zip.OpenReader(tempfile.Name())
-							if err != nil {
-								err = errors.Wrap(err, "Err opening zip file")
-								log.Println(err.Error())
-								return
-							}
-
-							err = UnzipReadZip(reader, patterns, outc)
-							if err != nil {
-								err = errors.Wrap(err, "Err reading zipped files")
-								log.Println(err.Error())
-								return
-							}
-						}(cb, mc, rePatterns, wg)
-
-						if ! global.MultiStreams {
-							if ! init {
-								close(mc.Channel)
-							}
-							wg.Wait()
-							out <- &Message{Type: MessageTypeTerminate,}
-							break LOOP
+						if m.buffer {
+							go unzipBufferStartHandler(m, out, cb, mc, wg)
+						} else {
+							go unzipStreamStartHandler(m, out, cb, mc, wg)
 						}
 					}
 			}
@@ -139,44 +217,346 @@ func (m *Unzip) Init(in, out chan *Message, global *GlobalFlags) (error) {
 	return nil
 }
 
-func UnzipReadZippedFile(zfile *zip.File, outc chan []byte) (error) {
-	file, err := zfile.Open()
+func (m *Unzip) match(name string) (bool) {
+	for _, re := range m.rePatterns {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func unzipStreamStartHandler(m *Unzip, out chan *Message, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	_, inc := cb()
+	defer DrainChannel(inc, nil)
+
+	mr := NewMessageReader(inc)
+	defer mr.Close()
+
+	// flate needs an io.ByteReader so it doesn't read past the entry
+	reader := bufio.NewReader(mr)
+
+	fanOut := NewMessageFanOut(out, mc)
+	defer fanOut.Close()
+
+	for {
+		var signature uint32
+
+		err := binary.Read(reader, binary.LittleEndian, &signature)
+		if err != nil {
+			if err != io.EOF {
+				err = errors.Wrap(err, "Error reading signature in unzip module")
+				log.Println(err.Error())
+			}
+
+			return
+		}
+
+		switch signature {
+			case unzipLocalHeaderSignature:
+			case unzipCentralHeaderSignature, unzipEndSignature, unzipZip64EndSignature:
+				// All the entries have been read
+				return
+			default:
+				log.Printf("Bad signature 0x%08x in unzip module\n", signature)
+				return
+		}
+
+		entry, err := unzipReadLocalHeader(reader)
+		if err != nil {
+			err = errors.Wrap(err, "Error reading local header in unzip module")
+			log.Println(err.Error())
+			return
+		}
+
+		descriptor := entry.flags & unzipFlagDataDescriptor != 0
+
+		var raw io.Reader = reader
+		if ! descriptor {
+			raw = io.LimitReader(reader, int64(entry.compressedSize))
+		}
+
+		skip := entry.flags & unzipFlagEncrypted != 0 ||
+			strings.HasSuffix(entry.name, "/") ||
+			! m.match(entry.name)
+
+		if skip && ! descriptor {
+			_, err = io.Copy(ioutil.Discard, raw)
+			if err != nil {
+				err = errors.Wrapf(err, "Error skipping %q in unzip module", entry.name)
+				log.Println(err.Error())
+				return
+			}
+
+			continue
+		}
+
+		var decompressor io.ReadCloser
+
+		switch {
+			case entry.flags & unzipFlagEncrypted != 0:
+				log.Printf("Entry %q is encrypted and uses a data descriptor, the rest of the archive cannot be read in unzip module\n", entry.name)
+				return
+			case entry.method == zip.Deflate:
+				decompressor = flate.NewReader(raw)
+			case entry.method == zip.Store && ! descriptor:
+				decompressor = ioutil.NopCloser(raw)
+			case entry.method == zip.Store:
+				decompressor = ioutil.NopCloser(&unzipStoredReader{reader: reader,})
+			default:
+				log.Printf("Compression method %d of %q is not supported in unzip module\n", entry.method, entry.name)
+				return
+		}
+
+		checksum := &unzipChecksumReader{reader: decompressor,}
+
+		if skip {
+			_, err = io.Copy(ioutil.Discard, checksum)
+		} else {
+			metadata := map[string]interface{}{
+				"index": fanOut.Count(),
+				"name": entry.name,
+				"mtime": entry.mtime,
+			}
+
+			if ! descriptor {
+				metadata["size"] = int64(entry.size)
+			}
+
+			mc = fanOut.Next(metadata)
+
+			err = ReadBytesSendMessages(checksum, mc.Channel)
+			close(mc.Channel)
+		}
+
+		decompressor.Close()
+
+		if err != nil && err != io.EOF {
+			err = errors.Wrapf(err, "Error reading %q in unzip module", entry.name)
+			log.Println(err.Error())
+			return
+		}
+
+		if descriptor {
+			zip64 := entry.zip64 || checksum.size >= 0xffffffff
+
+			err = unzipReadDataDescriptor(reader, entry, zip64)
+			if err != nil {
+				err = errors.Wrapf(err, "Error reading data descriptor of %q in unzip module", entry.name)
+				log.Println(err.Error())
+				return
+			}
+		}
+
+		if checksum.crc != entry.crc || checksum.size != entry.size {
+			log.Printf("Checksum mismatch for %q in unzip module\n", entry.name)
+			return
+		}
+	}
+}
+
+func unzipReadLocalHeader(reader io.Reader) (*unzipEntry, error) {
+	buff := make([]byte, unzipLocalHeaderLen)
+
+	_, err := io.ReadFull(reader, buff)
 	if err != nil {
-		return errors.Wrapf(err, "Err opening zipped file %q", zfile.Name)
+		return nil, err
+	}
+
+	le := binary.LittleEndian
+
+	entry := &unzipEntry{
+		flags: le.Uint16(buff[2:4]),
+		method: le.Uint16(buff[4:6]),
+		mtime: unzipMSDosTime(le.Uint16(buff[8:10]), le.Uint16(buff[6:8])),
+		crc: le.Uint32(buff[10:14]),
+		compressedSize: uint64(le.Uint32(buff[14:18])),
+		size: uint64(le.Uint32(buff[18:22])),
 	}
 
-	defer file.Close()
+	nameLen := int(le.Uint16(buff[22:24]))
+	buff = make([]byte, nameLen + int(le.Uint16(buff[24:26])))
 
-	err = ReadBytesSendMessages(file, outc)
+	_, err = io.ReadFull(reader, buff)
 	if err != nil {
-		if err != io.EOF {
-			return errors.Wrapf(err, "Err reading zipped file %q", zfile.Name)
+		return nil, err
+	}
+
+	entry.name = string(buff[:nameLen])
+	extra := buff[nameLen:]
+
+	for len(extra) >= 4 {
+		id := le.Uint16(extra[:2])
+		size := int(le.Uint16(extra[2:4]))
+		extra = extra[4:]
+
+		if size > len(extra) {
+			break
+		}
+
+		field := extra[:size]
+		extra = extra[size:]
+
+		switch id {
+			case unzipZip64ExtraID:
+				entry.zip64 = true
+
+				// Only the fields that overflow are present
+				if entry.size == 0xffffffff && len(field) >= 8 {
+					entry.size = le.Uint64(field[:8])
+					field = field[8:]
+				}
+
+				if entry.compressedSize == 0xffffffff && len(field) >= 8 {
+					entry.compressedSize = le.Uint64(field[:8])
+				}
+			case unzipExtTimeExtraID:
+				if len(field) >= 5 && field[0] & 0x1 != 0 {
+					entry.mtime = time.Unix(int64(int32(le.Uint32(field[1:5]))), 0)
+				}
 		}
 	}
 
-	return nil
+	return entry, nil
 }
 
-func UnzipReadZip(reader *zip.ReadCloser, patterns []*regexp.Regexp, outc chan []byte) (error) {
-	for _, zfile := range reader.File {
-		for _, pattern := range patterns {
-			ok := pattern.MatchString(zfile.Name)
-			if ok {
-				err := UnzipReadZippedFile(zfile, outc)
-				if err != nil {
-					return err
-				}
-			}
+func unzipReadDataDescriptor(reader io.Reader, entry *unzipEntry, zip64 bool) (error) {
+	le := binary.LittleEndian
+
+	buff := make([]byte, 4)
+
+	_, err := io.ReadFull(reader, buff)
+	if err != nil {
+		return err
+	}
+
+	// The signature is optional
+	if le.Uint32(buff) == unzipDataDescriptorSignature {
+		_, err = io.ReadFull(reader, buff)
+		if err != nil {
+			return err
 		}
 	}
 
+	entry.crc = le.Uint32(buff)
+
+	if zip64 {
+		buff = make([]byte, 16)
+	} else {
+		buff = make([]byte, 8)
+	}
+
+	_, err = io.ReadFull(reader, buff)
+	if err != nil {
+		return err
+	}
+
+	if zip64 {
+		entry.compressedSize = le.Uint64(buff[:8])
+		entry.size = le.Uint64(buff[8:])
+	} else {
+		entry.compressedSize = uint64(le.Uint32(buff[:4]))
+		entry.size = uint64(le.Uint32(buff[4:]))
+	}
+
 	return nil
 }
 
+func unzipMSDosTime(dosDate, dosTime uint16) (time.Time) {
+	return time.Date(
+		int(dosDate >> 9 + 1980),
+		time.Month(dosDate >> 5 & 0xf),
+		int(dosDate & 0x1f),
+		int(dosTime >> 11),
+		int(dosTime >> 5 & 0x3f),
+		int(dosTime & 0x1f * 2),
+		0,
+		time.UTC,
+	)
+}
+
+// The whole archive is written to a temporary file so the central directory
+// can be read.
+func unzipBufferStartHandler(m *Unzip, out chan *Message, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	_, inc := cb()
+	defer DrainChannel(inc, nil)
+
+	fanOut := NewMessageFanOut(out, mc)
+	defer fanOut.Close()
+
+	tempfile, err := ioutil.TempFile("", "cryptocli-zip")
+	if err != nil {
+		err = errors.Wrap(err, "Err writing to temporary file")
+		log.Println(err.Error())
+		return
+	}
+	defer os.Remove(tempfile.Name())
+
+	for payload := range inc {
+		_, err = tempfile.Write(payload)
+		if err != nil {
+			err = errors.Wrap(err, "Err writing to temporary file")
+			log.Println(err.Error())
+			tempfile.Close()
+			return
+		}
+	}
+
+	// Let's close the file so we can open it with the zip reader
+	tempfile.Close()
+
+	reader, err := zip.OpenReader(tempfile.Name())
+	if err != nil {
+		err = errors.Wrap(err, "Err opening zip file")
+		log.Println(err.Error())
+		return
+	}
+	defer reader.Close()
+
+	for _, zfile := range reader.File {
+		if ! zfile.Mode().IsRegular() || zfile.Flags & unzipFlagEncrypted != 0 || ! m.match(zfile.Name) {
+			continue
+		}
+
+		file, err := zfile.Open()
+		if err != nil {
+			err = errors.Wrapf(err, "Err opening zipped file %q", zfile.Name)
+			log.Println(err.Error())
+			return
+		}
+
+		metadata := map[string]interface{}{
+			"index": fanOut.Count(),
+			"name": zfile.Name,
+			"mode": zfile.Mode(),
+			"size": int64(zfile.UncompressedSize64),
+			"mtime": zfile.Modified,
+		}
+
+		mc = fanOut.Next(metadata)
+
+		err = ReadBytesSendMessages(file, mc.Channel)
+		close(mc.Channel)
+		file.Close()
+
+		if err != nil && err != io.EOF {
+			err = errors.Wrapf(err, "Err reading zipped file %q", zfile.Name)
+			log.Println(err.Error())
+			return
+		}
+	}
+}
+
 func NewUnzip() (Module) {
 	return &Unzip{}
 }
 
 func (m *Unzip) SetFlagSet(fs *pflag.FlagSet, args []string) {
-	fs.StringArrayVar(&m.patterns, "pattern", []string{".*",}, "Read the file each time it matches a pattern.")
+	fs.StringArrayVar(&m.patterns, "pattern", []string{".*",}, "Send the file if its name matches one of the patterns")
+	fs.BoolVar(&m.buffer, "buffer", false, "Buffer the archive to disk and read it using the central directory")
 }
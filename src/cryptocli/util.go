@@ -7,6 +7,8 @@ import (
 	"regexp"
 	"strings"
 	"net/http"
+	"os"
+	"time"
 )
 
 // Copy the content of a *io.Buffer and return it
@@ -69,3 +71,29 @@ func ShowHTTPHeaders(client bool, headers http.Header) {
 		}
 	}
 }
+
+// Return the metadata value as an int64 if it is a number
+func MetadataInt64(metadata map[string]interface{}, key string) (int64, bool) {
+	switch v := metadata[key].(type) {
+		case int:
+			return int64(v), true
+		case int64:
+			return v, true
+		case uint32:
+			return int64(v), true
+		case uint64:
+			return int64(v), true
+		case os.FileMode:
+			return int64(v), true
+		case float64:
+			return int64(v), true
+	}
+
+	return 0, false
+}
+
+// Return the metadata value as a time.Time if it is one
+func MetadataTime(metadata map[string]interface{}, key string) (time.Time, bool) {
+	t, ok := metadata[key].(time.Time)
+	return t, ok
+}
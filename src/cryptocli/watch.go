@@ -0,0 +1,392 @@
+package main
+
+import (
+	"github.com/tehmoon/errors"
+	"sync"
+	"log"
+	"github.com/spf13/pflag"
+	"os"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+func init() {
+	MODULELIST.Register("watch", "Watch directories and send each created or written file to its own channel", NewWatch)
+}
+
+/*
+watch module never terminates. When a file that has been created or written to
+is closed, it is sent to its own channel. A file that is created then written
+to is sent once with the "create" event, a file moved in is sent right away.
+
+Close events are only reported by inotify on linux. On the other platforms, or
+for files found when a new sub directory is watched since they might have been
+closed already, the file is sent once there has been no writes for --settle.
+
+Channels that come back from the end of the pipeline are discarded.
+*/
+
+type Watch struct {
+	dirs []string
+	recursive bool
+	includes []string
+	excludes []string
+	settle time.Duration
+	watcher *watchWatcher
+}
+
+type watchPending struct {
+	event string
+	root string
+	last time.Time
+	settle bool
+}
+
+type watchOp uint8
+
+const (
+	watchOpCreate watchOp = 1 << iota
+	watchOpWrite
+	watchOpClose
+	watchOpRemove
+)
+
+// Event from the platform's watcher
+type watchEvent struct {
+	Name string
+	Op watchOp
+}
+
+func (e watchEvent) Has(op watchOp) (bool) {
+	return e.Op & op != 0
+}
+
+func (m *Watch) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.StringArrayVar(&m.dirs, "dir", []string{}, "Directory to watch")
+	fs.BoolVar(&m.recursive, "recursive", false, "Also watch sub directories, including the ones created later")
+	fs.StringArrayVar(&m.includes, "include", []string{}, "Only send files matching one of the glob patterns")
+	fs.StringArrayVar(&m.excludes, "exclude", []string{}, "Skip files matching one of the glob patterns")
+	fs.DurationVar(&m.settle, "settle", time.Second, "Time without writes before a file is considered closed when close events are not available")
+}
+
+func (m *Watch) Init(in, out chan *Message, global *GlobalFlags) (err error) {
+	if len(m.dirs) == 0 {
+		return errors.Errorf("Flag %q must be present", "--dir")
+	}
+
+	if ! global.MultiStreams {
+		return errors.Errorf("Flag %q is required since each file is sent to its own channel", "--multi-streams")
+	}
+
+	if m.settle <= 0 {
+		return errors.Errorf("Flag %q has to be greater than 0", "--settle")
+	}
+
+	for _, pattern := range append(m.includes, m.excludes...) {
+		_, err = filepath.Match(pattern, "")
+		if err != nil {
+			return errors.Wrapf(err, "Err compiling pattern %q", pattern)
+		}
+	}
+
+	m.watcher, err = newWatchWatcher()
+	if err != nil {
+		return errors.Wrap(err, "Error initializing watcher")
+	}
+
+	for i, dir := range m.dirs {
+		m.dirs[i] = filepath.Clean(dir)
+
+		err = m.add(m.dirs[i])
+		if err != nil {
+			m.watcher.Close()
+			return errors.Wrapf(err, "Error watching directory %q", dir)
+		}
+	}
+
+	go func(in, out chan *Message) {
+		wg := &sync.WaitGroup{}
+
+		init := false
+		mc := NewMessageChannel()
+
+		out <- &Message{
+			Type: MessageTypeChannel,
+			Interface: mc.Callback,
+		}
+
+		LOOP: for message := range in {
+			switch message.Type {
+				case MessageTypeTerminate:
+					if ! init {
+						close(mc.Channel)
+					}
+
+					wg.Wait()
+					out <- message
+					break LOOP
+				case MessageTypeChannel:
+					cb, ok := message.Interface.(MessageChannelFunc)
+					if ok {
+						// Events are watched once, the other channels
+						// are coming back from the end of the pipeline.
+						if init {
+							go func(cb MessageChannelFunc) {
+								_, inc := cb()
+								DrainChannel(inc, nil)
+							}(cb)
+
+							continue
+						}
+
+						init = true
+
+						wg.Add(1)
+						go watchStartHandler(m, out, cb, mc, wg)
+					}
+			}
+		}
+
+		wg.Wait()
+		// Last message will signal the closing of the channel
+		<- in
+		close(out)
+	}(in, out)
+
+	return nil
+}
+
+// Watch the directory and its sub directories if recursive
+func (m *Watch) add(dir string) (error) {
+	err := m.watcher.Add(dir)
+	if err != nil {
+		return err
+	}
+
+	if ! m.recursive {
+		return nil
+	}
+
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, info := range infos {
+		if info.IsDir() {
+			err = m.add(filepath.Join(dir, info.Name()))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the watched directory the path belongs to
+func (m *Watch) root(p string) (string) {
+	for _, dir := range m.dirs {
+		rel, err := filepath.Rel(dir, p)
+		if err == nil && rel != ".." && (len(rel) < 3 || rel[:3] != ".." + string(filepath.Separator)) {
+			return dir
+		}
+	}
+
+	return filepath.Dir(p)
+}
+
+func (m *Watch) match(root, p string) (bool) {
+	name, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+
+	name = filepath.ToSlash(name)
+
+	if ReadDirMatchAny(m.excludes, name) {
+		return false
+	}
+
+	if len(m.includes) > 0 && ! ReadDirMatchAny(m.includes, name) {
+		return false
+	}
+
+	return true
+}
+
+func watchStartHandler(m *Watch, out chan *Message, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	defer wg.Done()
+	defer m.watcher.Close()
+
+	// The channel comes back from the end of the pipeline
+	go func(cb MessageChannelFunc) {
+		_, inc := cb()
+		DrainChannel(inc, nil)
+	}(cb)
+
+	fanOut := NewMessageFanOut(out, mc)
+	defer fanOut.Close()
+
+	pending := make(map[string]*watchPending)
+
+	ticker := time.NewTicker(m.settle / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+			case event, opened := <- m.watcher.Events:
+				if ! opened {
+					return
+				}
+
+				watchHandleEvent(m, fanOut, event, pending)
+			case err, opened := <- m.watcher.Errors:
+				if ! opened {
+					return
+				}
+
+				err = errors.Wrap(err, "Error watching in watch module")
+				log.Println(err.Error())
+			case now := <- ticker.C:
+				paths := make([]string, 0)
+
+				for p, pe := range pending {
+					if pe.settle && now.Sub(pe.last) >= m.settle {
+						paths = append(paths, p)
+					}
+				}
+
+				// Oldest first
+				sort.Slice(paths, func(i, j int) (bool) {
+					return pending[paths[i]].last.Before(pending[paths[j]].last)
+				})
+
+				for _, p := range paths {
+					watchSendFile(fanOut, p, pending[p])
+					delete(pending, p)
+				}
+		}
+	}
+}
+
+func watchHandleEvent(m *Watch, fanOut *MessageFanOut, event watchEvent, pending map[string]*watchPending) {
+	p := filepath.Clean(event.Name)
+
+	if event.Has(watchOpRemove) {
+		delete(pending, p)
+		return
+	}
+
+	if event.Has(watchOpCreate) {
+		info, err := os.Stat(p)
+		if err != nil {
+			return
+		}
+
+		if info.IsDir() {
+			if ! m.recursive {
+				return
+			}
+
+			err = m.add(p)
+			if err != nil {
+				err = errors.Wrapf(err, "Error watching directory %q", p)
+				log.Println(err.Error())
+				return
+			}
+
+			// Files might have been created and closed before the directory is watched
+			filepath.Walk(p, func(file string, info os.FileInfo, err error) (error) {
+				if err == nil && info.Mode().IsRegular() {
+					watchAddPending(m, file, "create", true, pending)
+				}
+
+				return nil
+			})
+
+			return
+		}
+
+		if info.Mode().IsRegular() {
+			watchAddPending(m, p, "create", ! watchCloseWrite, pending)
+		}
+	}
+
+	if event.Has(watchOpWrite) {
+		watchAddPending(m, p, "write", ! watchCloseWrite, pending)
+	}
+
+	if event.Has(watchOpClose) {
+		pe, found := pending[p]
+		if found {
+			watchSendFile(fanOut, p, pe)
+			delete(pending, p)
+		}
+	}
+}
+
+// A new event on a pending file only delays it. Once written to, a file
+// found when its directory was watched will be closed.
+func watchAddPending(m *Watch, p, event string, settle bool, pending map[string]*watchPending) {
+	if pe, found := pending[p]; found {
+		pe.last = time.Now()
+		pe.settle = pe.settle && settle
+		return
+	}
+
+	root := m.root(p)
+	if ! m.match(root, p) {
+		return
+	}
+
+	pending[p] = &watchPending{
+		event: event,
+		root: root,
+		last: time.Now(),
+		settle: settle,
+	}
+}
+
+func watchSendFile(fanOut *MessageFanOut, p string, pe *watchPending) {
+	file, err := os.Open(p)
+	if err != nil {
+		err = errors.Wrap(err, "Error opening file in watch module")
+		log.Println(err.Error())
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || ! info.Mode().IsRegular() {
+		return
+	}
+
+	name, _ := filepath.Rel(pe.root, p)
+
+	metadata := map[string]interface{}{
+		"index": fanOut.Count(),
+		"event": pe.event,
+		"path": p,
+		"name": filepath.ToSlash(name),
+		"size": info.Size(),
+		"mode": info.Mode(),
+		"mtime": info.ModTime(),
+	}
+
+	mc := fanOut.Next(metadata)
+	defer close(mc.Channel)
+
+	err = ReadBytesSendMessages(file, mc.Channel)
+	if err != nil && err != io.EOF {
+		err = errors.Wrapf(err, "Error reading file %q in watch module", p)
+		log.Println(err.Error())
+	}
+}
+
+func NewWatch() (Module) {
+	return &Watch{}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"bytes"
+	"unsafe"
+	"syscall"
+	"github.com/tehmoon/errors"
+)
+
+// Inotify reports when a file opened for writing is closed
+const watchCloseWrite = true
+
+const watchInotifyMask = syscall.IN_CREATE | syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE |
+	syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM | syscall.IN_DELETE
+
+// Raw inotify watcher since fsnotify doesn't expose IN_CLOSE_WRITE.
+// The events and errors channels are closed once the watcher is closed.
+type watchWatcher struct {
+	Events chan watchEvent
+	Errors chan error
+	fd int
+	file *os.File
+	paths map[int]string
+	sync *sync.Mutex
+}
+
+func newWatchWatcher() (*watchWatcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error initializing inotify")
+	}
+
+	w := &watchWatcher{
+		Events: make(chan watchEvent),
+		Errors: make(chan error),
+		fd: fd,
+		// Non blocking so Close unblocks the pending read
+		file: os.NewFile(uintptr(fd), "inotify"),
+		paths: make(map[int]string),
+		sync: &sync.Mutex{},
+	}
+
+	go w.read()
+
+	return w, nil
+}
+
+func (w *watchWatcher) Add(dir string) (error) {
+	w.sync.Lock()
+	defer w.sync.Unlock()
+
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, watchInotifyMask)
+	if err != nil {
+		return err
+	}
+
+	w.paths[wd] = dir
+
+	return nil
+}
+
+func (w *watchWatcher) Close() (error) {
+	return w.file.Close()
+}
+
+func (w *watchWatcher) read() {
+	defer close(w.Events)
+	defer close(w.Errors)
+
+	buff := make([]byte, 64 * (syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1))
+
+	for {
+		n, err := w.file.Read(buff)
+		if err != nil {
+			return
+		}
+
+		for offset := 0; offset + syscall.SizeofInotifyEvent <= n; {
+			raw := (*syscall.InotifyEvent)(unsafe.Pointer(&buff[offset]))
+			name := buff[offset + syscall.SizeofInotifyEvent:offset + syscall.SizeofInotifyEvent + int(raw.Len)]
+			offset += syscall.SizeofInotifyEvent + int(raw.Len)
+
+			if raw.Mask & syscall.IN_Q_OVERFLOW != 0 {
+				w.Errors <- errors.New("Inotify queue overflowed, events have been lost")
+				continue
+			}
+
+			w.sync.Lock()
+			dir, found := w.paths[int(raw.Wd)]
+			if raw.Mask & syscall.IN_IGNORED != 0 {
+				delete(w.paths, int(raw.Wd))
+			}
+			w.sync.Unlock()
+
+			if ! found || len(name) == 0 {
+				continue
+			}
+
+			event := watchEvent{
+				Name: dir + string(os.PathSeparator) + string(bytes.TrimRight(name, "\x00")),
+			}
+
+			if raw.Mask & syscall.IN_CREATE != 0 {
+				event.Op |= watchOpCreate
+			}
+
+			// A file moved in has been written already
+			if raw.Mask & syscall.IN_MOVED_TO != 0 {
+				event.Op |= watchOpCreate | watchOpClose
+			}
+
+			if raw.Mask & syscall.IN_MODIFY != 0 {
+				event.Op |= watchOpWrite
+			}
+
+			if raw.Mask & syscall.IN_CLOSE_WRITE != 0 {
+				event.Op |= watchOpClose
+			}
+
+			if raw.Mask & (syscall.IN_DELETE | syscall.IN_MOVED_FROM) != 0 {
+				event.Op |= watchOpRemove
+			}
+
+			if event.Op != 0 {
+				w.Events <- event
+			}
+		}
+	}
+}
@@ -0,0 +1,83 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"github.com/fsnotify/fsnotify"
+)
+
+// Close events are not reported, files are sent once the
+// writes have settled.
+const watchCloseWrite = false
+
+// Translates the fsnotify events. The events and errors channels
+// are closed once the watcher is closed.
+type watchWatcher struct {
+	Events chan watchEvent
+	Errors chan error
+	watcher *fsnotify.Watcher
+}
+
+func newWatchWatcher() (*watchWatcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	w := &watchWatcher{
+		Events: make(chan watchEvent),
+		Errors: make(chan error),
+		watcher: watcher,
+	}
+
+	go w.read()
+
+	return w, nil
+}
+
+func (w *watchWatcher) Add(dir string) (error) {
+	return w.watcher.Add(dir)
+}
+
+func (w *watchWatcher) Close() (error) {
+	return w.watcher.Close()
+}
+
+func (w *watchWatcher) read() {
+	defer close(w.Events)
+	defer close(w.Errors)
+
+	for {
+		select {
+			case e, opened := <- w.watcher.Events:
+				if ! opened {
+					return
+				}
+
+				event := watchEvent{Name: e.Name,}
+
+				if e.Has(fsnotify.Create) {
+					event.Op |= watchOpCreate
+				}
+
+				if e.Has(fsnotify.Write) {
+					event.Op |= watchOpWrite
+				}
+
+				if e.Has(fsnotify.Remove) || e.Has(fsnotify.Rename) {
+					event.Op |= watchOpRemove
+				}
+
+				if event.Op != 0 {
+					w.Events <- event
+				}
+			case err, opened := <- w.watcher.Errors:
+				if ! opened {
+					return
+				}
+
+				w.Errors <- err
+		}
+	}
+}
@@ -28,6 +28,8 @@ type Websocket struct {
 	showClientHeaders bool
 	showServerHeaders bool
 	tplUrl *template.Template
+	tlsOptions TLSClientOptions
+	tlsConfig *tls.Config
 }
 
 func (m *Websocket) SetFlagSet(fs *pflag.FlagSet, args []string) {
@@ -40,6 +42,8 @@ func (m *Websocket) SetFlagSet(fs *pflag.FlagSet, args []string) {
 	fs.DurationVar(&m.pingInterval, "ping-interval", 30 * time.Second, "Interval of time between ping websocket messages")
 	fs.StringArrayVar(&m.headers, "header", make([]string, 0), "Set header in the form of \"header: value\"")
 	fs.BoolVar(&m.text, "text", false, "Set the websocket message's metadata to text")
+	m.tlsOptions.SetFlagSet(fs)
+	m.tlsOptions.SetServernameFlag(fs)
 }
 
 func (m *Websocket) Init(in, out chan *Message, global *GlobalFlags) (err error) {
@@ -55,6 +59,11 @@ func (m *Websocket) Init(in, out chan *Message, global *GlobalFlags) (err error)
 		return errors.Errorf("Flag %q has to be greater that 0", "--ping-interval")
 	}
 
+	m.tlsConfig, err = m.tlsOptions.Config(m.insecure)
+	if err != nil {
+		return errors.Wrap(err, "Error configuring TLS")
+	}
+
 	m.tplUrl, err = template.New("root").Parse(m.url)
 	if err != nil {
 		return errors.Wrap(err, "Error parsing template for \"--url\" flag")
@@ -98,9 +107,7 @@ func (m *Websocket) Init(in, out chan *Message, global *GlobalFlags) (err error)
 							}
 						}
 						dialer := &websocket.Dialer{
-							TLSClientConfig: &tls.Config{
-								InsecureSkipVerify: m.insecure,
-							},
+							TLSClientConfig: m.tlsConfig,
 						}
 
 						wg.Add(1)
@@ -131,7 +138,6 @@ func (m *Websocket) Init(in, out chan *Message, global *GlobalFlags) (err error)
 func websocketStartHandler(m *Websocket, dialer *websocket.Dialer, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	mc.Start(nil)
 	metadata, inc := cb()
 
 	buff := bytes.NewBuffer(make([]byte, 0))
@@ -139,6 +145,7 @@ func websocketStartHandler(m *Websocket, dialer *websocket.Dialer, cb MessageCha
 	if err != nil {
 		err = errors.Wrap(err, "Error executing template url")
 		log.Println(err.Error())
+		mc.Start(nil)
 		close(mc.Channel)
 		DrainChannel(inc, nil)
 		return
@@ -154,11 +161,22 @@ func websocketStartHandler(m *Websocket, dialer *websocket.Dialer, cb MessageCha
 	if err != nil {
 		err = errors.Wrap(err, "Error dialing websocket connection")
 		log.Println(err.Error())
+		mc.Start(nil)
 		close(outc)
 		DrainChannel(inc, nil)
 		return
 	}
 
+	// The channel is started once connected so the TLS
+	// parameters can be set in metadata.
+	outMetadata := make(map[string]interface{})
+	if sconn, ok := conn.UnderlyingConn().(*tls.Conn); ok {
+		state := sconn.ConnectionState()
+		TLSClientMetadata(&state, outMetadata)
+	}
+
+	mc.Start(outMetadata)
+
 	if m.showClientHeaders {
 		ShowHTTPClientHeaders(headers)
 	}
@@ -3,6 +3,7 @@ package main
 import (
 	"time"
 	"net/http"
+	"crypto/tls"
 	"github.com/tehmoon/errors"
 	"github.com/gorilla/websocket"
 	"github.com/spf13/pflag"
@@ -26,6 +27,7 @@ type WebsocketServer struct {
 	headers []string
 	showClientHeaders bool
 	showServerHeaders bool
+	tlsOptions TLSServerOptions
 }
 
 func (m *WebsocketServer) SetFlagSet(fs *pflag.FlagSet, args []string) {
@@ -38,20 +40,27 @@ func (m *WebsocketServer) SetFlagSet(fs *pflag.FlagSet, args []string) {
 	fs.DurationVar(&m.readTimeout, "read-timeout", 15 * time.Second, "Read timeout for the websocket connection")
 	fs.DurationVar(&m.readHeaderTimeout, "read-headers-timeout", 15 * time.Second, "Set the amount of time allowed to read request headers.")
 	fs.BoolVar(&m.text, "text", false, "Set the websocket message's metadata to text")
+	m.tlsOptions.SetFlagSet(fs)
 }
 
 func websocketServerUpgrade(m *WebsocketServer, conn *websocket.Conn, req *http.Request, relay *WebsocketServerRelayer) {
 	mc, cb, wg := relay.MessageChannel, relay.Callback, relay.Wg
 	defer wg.Done()
 
-	mc.Start(map[string]interface{}{
+	metadata := map[string]interface{}{
 		"url": req.URL.String(),
 		"headers": req.Header,
 		"host": req.Host,
 		"remote-addr": conn.RemoteAddr(),
 		"request-uri": req.RequestURI,
 		"addr": m.addr,
-	})
+	}
+
+	if req.TLS != nil {
+		TLSServerMetadata(req.TLS, metadata)
+	}
+
+	mc.Start(metadata)
 	_, inc := cb()
 	outc := mc.Channel
 
@@ -211,11 +220,21 @@ func (m *WebsocketServer) Init(in, out chan *Message, global *GlobalFlags) (erro
 		return errors.Wrap(err, "Unable to resolve tcp address")
 	}
 
-	listener, err := net.ListenTCP("tcp", addr)
+	tlsConfig, err := m.tlsOptions.Config()
+	if err != nil {
+		return errors.Wrap(err, "Error configuring TLS")
+	}
+
+	var listener net.Listener
+	listener, err = net.ListenTCP("tcp", addr)
 	if err != nil {
 		return errors.Wrap(err, "Unable to listen on tcp address")
 	}
 
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+
 	go func() {
 		wg := &sync.WaitGroup{}
 		relayer := make(chan *WebsocketServerRelayer)
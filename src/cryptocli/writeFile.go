@@ -9,24 +9,69 @@ import (
 	"path/filepath"
 	"bytes"
 	"text/template"
+	"time"
+	"io"
+	"io/ioutil"
 )
 
 func init() {
 	MODULELIST.Register("write-file", "Writes to a file.", NewWriteFile)
 }
 
+/*
+write-file module writes each channel to the file rendered from --path.
+
+With --atomic, data is written to a temporary file in the same directory
+which is renamed once closed so readers never see a partial file.
+
+Rotation closes the current file when one of the limits is reached and
+renames it to --rotate-name. The template is rendered with the channel's
+metadata, "path" the file's path, "index" the number of the rotation
+starting at 1 and "time" the time of the rotation. Rotated files are never
+overwritten, the index is incremented until the name is free so a restart
+continues after the existing rotations. Compressed rotated files get the
+extension of the algorithm.
+*/
+
 type WriteFile struct {
 	file *os.File
 	mode uint32
 	append bool
 	path string
 	tpl *template.Template
+	atomic bool
+	fsync bool
+	mkdir bool
+	rotateSize int64
+	rotateInterval time.Duration
+	rotateMessages int
+	rotateName string
+	rotateCompress string
+	rotateTpl *template.Template
+	rotateCodec *CompressionCodec
+}
+
+// File being written to. If atomic, tmp is the actual file on disk.
+type writeFileSegment struct {
+	file *os.File
+	path string
+	tmp string
+	written int64
+	messages int
 }
 
 func (m *WriteFile) SetFlagSet(fs *pflag.FlagSet, args []string) {
 	fs.StringVar(&m.path, "path", "", "Metadata template for file path")
 	fs.Uint32Var(&m.mode, "mode", 0640, "Set file's mode if created when writting")
 	fs.BoolVar(&m.append, "append", false, "Append data instead of truncating when writting")
+	fs.BoolVar(&m.atomic, "atomic", false, "Write to a temporary file then rename it to the path when done")
+	fs.BoolVar(&m.fsync, "fsync", false, "Sync the file to disk before closing it")
+	fs.BoolVar(&m.mkdir, "mkdir", false, "Create the parent directories if they don't exist")
+	fs.Int64Var(&m.rotateSize, "rotate-size", 0, "Rotate the file once it is bigger than this number of bytes")
+	fs.DurationVar(&m.rotateInterval, "rotate-interval", 0, "Rotate the file after this amount of time")
+	fs.IntVar(&m.rotateMessages, "rotate-messages", 0, "Rotate the file after this number of messages")
+	fs.StringVar(&m.rotateName, "rotate-name", "{{ .path }}.{{ .index }}", "Metadata template for the rotated file's path")
+	fs.StringVar(&m.rotateCompress, "rotate-compress", "", "Compress rotated files using one of the compress module's algorithms")
 }
 
 func (m *WriteFile) Init(in, out chan *Message, global *GlobalFlags) (error) {
@@ -40,6 +85,28 @@ func (m *WriteFile) Init(in, out chan *Message, global *GlobalFlags) (error) {
 		return errors.Wrap(err, "Error parsing template for \"--path-template\" flag")
 	}
 
+	if m.atomic && m.append {
+		return errors.Errorf("Flag %q cannot be used with flag %q", "--atomic", "--append")
+	}
+
+	if m.rotateSize < 0 || m.rotateInterval < 0 || m.rotateMessages < 0 {
+		return errors.New("Rotation flags cannot be negative")
+	}
+
+	m.rotateTpl, err = template.New("root").Parse(m.rotateName)
+	if err != nil {
+		return errors.Wrapf(err, "Error parsing template for %q flag", "--rotate-name")
+	}
+
+	if m.rotateCompress != "" {
+		codec, found := CompressionCodecs[m.rotateCompress]
+		if ! found {
+			return errors.Errorf("Algorithm %q is not supported for flag %q", m.rotateCompress, "--rotate-compress")
+		}
+
+		m.rotateCodec = codec
+	}
+
 	go func(in, out chan *Message) {
 		wg := &sync.WaitGroup{}
 
@@ -121,6 +188,180 @@ func WriteFileOpenWrite(p string, append bool, mode os.FileMode) (*os.File, erro
 	return file, nil
 }
 
+func (m *WriteFile) open(p string) (*writeFileSegment, error) {
+	if m.mkdir {
+		err := os.MkdirAll(filepath.Dir(p), 0750)
+		if err != nil {
+			return nil, errors.Wrap(err, "Error creating parent directories")
+		}
+	}
+
+	segment := &writeFileSegment{
+		path: p,
+	}
+
+	if ! m.atomic {
+		file, err := WriteFileOpenWrite(p, m.append, os.FileMode(m.mode))
+		if err != nil {
+			return nil, err
+		}
+
+		segment.file = file
+
+		if m.append {
+			info, err := file.Stat()
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+
+			segment.written = info.Size()
+		}
+
+		return segment, nil
+	}
+
+	file, err := ioutil.TempFile(filepath.Dir(p), "." + filepath.Base(p) + ".")
+	if err != nil {
+		return nil, err
+	}
+
+	err = file.Chmod(os.FileMode(m.mode))
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	log.Printf("File %q is opened\n", file.Name())
+
+	segment.file = file
+	segment.tmp = file.Name()
+
+	return segment, nil
+}
+
+// Close the segment and move it to dest
+func (m *WriteFile) close(segment *writeFileSegment, dest string) (error) {
+	if m.fsync {
+		err := segment.file.Sync()
+		if err != nil {
+			segment.file.Close()
+			return errors.Wrap(err, "Error syncing file")
+		}
+	}
+
+	err := segment.file.Close()
+	if err != nil {
+		return errors.Wrap(err, "Error closing file")
+	}
+
+	src := segment.path
+	if m.atomic {
+		src = segment.tmp
+	}
+
+	if src != dest {
+		if m.mkdir {
+			err = os.MkdirAll(filepath.Dir(dest), 0750)
+			if err != nil {
+				return errors.Wrap(err, "Error creating parent directories")
+			}
+		}
+
+		err = os.Rename(src, dest)
+		if err != nil {
+			return errors.Wrapf(err, "Error renaming file to %q", dest)
+		}
+	}
+
+	if m.fsync {
+		// Make the rename durable
+		err = WriteFileSyncDir(filepath.Dir(dest))
+		if err != nil {
+			return errors.Wrap(err, "Error syncing directory")
+		}
+	}
+
+	return nil
+}
+
+// Close the segment after a failure. The temporary file is removed
+// so a partial file is never renamed to the path.
+func (m *WriteFile) abort(segment *writeFileSegment) {
+	segment.file.Close()
+
+	if m.atomic {
+		os.Remove(segment.tmp)
+	}
+}
+
+// Compress the file to the path with the codec's extension and
+// remove the original, using a temporary file.
+func (m *WriteFile) compress(p string) (error) {
+	src, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := ioutil.TempFile(filepath.Dir(p), "." + filepath.Base(p) + ".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	err = dst.Chmod(os.FileMode(m.mode))
+	if err != nil {
+		return err
+	}
+
+	writer, err := m.rotateCodec.NewWriter(dst, -1, 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(writer, src)
+	if err != nil {
+		return err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return err
+	}
+
+	if m.fsync {
+		err = dst.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = dst.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(dst.Name(), p + m.rotateCodec.Extension)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(p)
+}
+
+func WriteFileSyncDir(p string) (error) {
+	dir, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return dir.Sync()
+}
+
 func fileWriteStart(m *WriteFile, cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
 	defer wg.Done()
 
@@ -129,41 +370,148 @@ func fileWriteStart(m *WriteFile, cb MessageChannelFunc, mc *MessageChannel, wg
 	})
 
 	metadata, inc := cb()
+	outc := mc.Channel
+	defer close(outc)
+	defer DrainChannel(inc, nil)
 
 	buff := bytes.NewBuffer(make([]byte, 0))
 	err := m.tpl.Execute(buff, metadata)
 	if err != nil {
 		err = errors.Wrap(err, "Error executing template file")
 		log.Println(err.Error())
-		close(mc.Channel)
-		DrainChannel(inc, nil)
 		return
 	}
 
 	p := filepath.Clean(string(buff.Bytes()[:]))
 	buff.Reset()
 
-	outc := mc.Channel
-
-	file, err := WriteFileOpenWrite(p, m.append, os.FileMode(m.mode))
+	segment, err := m.open(p)
 	if err != nil {
 		err = errors.Wrap(err, "Error opening file in write mode")
 		log.Println(err.Error())
-		close(mc.Channel)
-		DrainChannel(inc, nil)
 		return
 	}
 
-	for message := range inc {
-		_, err := file.Write(message)
+	// Nil channels block forever
+	var tick <-chan time.Time
+	if m.rotateInterval > 0 {
+		ticker := time.NewTicker(m.rotateInterval)
+		defer ticker.Stop()
+
+		tick = ticker.C
+	}
+
+	index := 0
+
+	LOOP: for {
+		select {
+			case payload, opened := <- inc:
+				if ! opened {
+					break LOOP
+				}
+
+				_, err = segment.file.Write(payload)
+				if err != nil {
+					log.Println(errors.Wrap(err, "Error writing to file"))
+					m.abort(segment)
+					return
+				}
+
+				segment.written += int64(len(payload))
+				segment.messages++
+
+				if (m.rotateSize > 0 && segment.written >= m.rotateSize) ||
+					(m.rotateMessages > 0 && segment.messages >= m.rotateMessages) {
+					segment, index, err = writeFileRotate(m, segment, metadata, index + 1)
+					if err != nil {
+						log.Println(err.Error())
+						return
+					}
+				}
+			case <- tick:
+				if segment.written == 0 {
+					continue
+				}
+
+				segment, index, err = writeFileRotate(m, segment, metadata, index + 1)
+				if err != nil {
+					log.Println(err.Error())
+					return
+				}
+		}
+	}
+
+	err = m.close(segment, p)
+	if err != nil {
+		err = errors.Wrap(err, "Error closing file")
+		log.Println(err.Error())
+	}
+}
+
+// Move the current segment to its rotated name then open a new one.
+// The index is incremented while the name is taken and is returned.
+func writeFileRotate(m *WriteFile, segment *writeFileSegment, metadata map[string]interface{}, index int) (*writeFileSegment, int, error) {
+	data := make(map[string]interface{})
+	for k, v := range metadata {
+		data[k] = v
+	}
+
+	data["path"] = segment.path
+	data["time"] = time.Now()
+
+	dest := ""
+
+	for {
+		data["index"] = index
+
+		buff := bytes.NewBuffer(make([]byte, 0))
+		err := m.rotateTpl.Execute(buff, data)
 		if err != nil {
-			log.Println(errors.Wrap(err, "Error writing to file"))
+			m.abort(segment)
+			return nil, index, errors.Wrap(err, "Error executing template rotate name")
+		}
+
+		name := filepath.Clean(buff.String())
+
+		final := name
+		if m.rotateCodec != nil {
+			final += m.rotateCodec.Extension
+		}
+
+		_, err = os.Lstat(final)
+		if os.IsNotExist(err) {
+			dest = name
 			break
 		}
+
+		if name == dest {
+			m.abort(segment)
+			return nil, index, errors.Errorf("Refusing to overwrite rotated file %q", final)
+		}
+
+		dest = name
+		index++
+	}
+
+	err := m.close(segment, dest)
+	if err != nil {
+		return nil, index, errors.Wrap(err, "Error rotating file")
+	}
+
+	log.Printf("File %q is rotated to %q\n", segment.path, dest)
+
+	if m.rotateCodec != nil {
+		err = m.compress(dest)
+		if err != nil {
+			err = errors.Wrapf(err, "Error compressing rotated file %q", dest)
+			log.Println(err.Error())
+		}
 	}
 
-	file.Close()
-	close(outc)
+	segment, err = m.open(segment.path)
+	if err != nil {
+		return nil, index, errors.Wrap(err, "Error opening file in write mode")
+	}
 
-	DrainChannel(inc, nil)
+	return segment, index, nil
 }
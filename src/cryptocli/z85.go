@@ -0,0 +1,245 @@
+package main
+
+import (
+	"sync"
+	"github.com/spf13/pflag"
+	"io"
+	"github.com/tehmoon/errors"
+	"encoding/binary"
+)
+
+func init() {
+	MODULELIST.Register("z85", "Z85 decode or encode", NewZ85)
+}
+
+type Z85 struct {
+	decode bool
+	encode bool
+}
+
+func (m Z85) Init(in, out chan *Message, global *GlobalFlags) (error) {
+	if (m.decode && m.encode) || (! m.decode && ! m.encode) {
+		return errors.Errorf("One of %q and %q is required", "encode", "decode")
+	}
+
+	go func(in, out chan *Message) {
+		wg := &sync.WaitGroup{}
+
+		init := false
+		mc := NewMessageChannel()
+
+		out <- &Message{
+			Type: MessageTypeChannel,
+			Interface: mc.Callback,
+		}
+
+		LOOP: for message := range in {
+			switch message.Type {
+				case MessageTypeTerminate:
+					if ! init {
+						close(mc.Channel)
+					}
+					wg.Wait()
+					out <- message
+					break LOOP
+				case MessageTypeChannel:
+					cb, ok := message.Interface.(MessageChannelFunc)
+					if ok {
+						if ! init {
+							init = true
+						} else {
+							mc = NewMessageChannel()
+
+							out <- &Message{
+								Type: MessageTypeChannel,
+								Interface: mc.Callback,
+							}
+						}
+
+						wg.Add(1)
+						if m.decode {
+							go startZ85Decode(cb, mc, wg)
+						} else if m.encode {
+							go startZ85Encode(cb, mc, wg)
+						}
+
+						if ! global.MultiStreams {
+							if ! init {
+								close(mc.Channel)
+							}
+							wg.Wait()
+							out <- &Message{Type: MessageTypeTerminate,}
+							break LOOP
+						}
+					}
+			}
+		}
+
+		wg.Wait()
+		// Last message will signal the closing of the channel
+		<- in
+		close(out)
+	}(in, out)
+
+	return nil
+}
+
+func startZ85Decode(cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	StartCodecDecode("z85", cb, mc, wg, func(r io.Reader) (io.Reader, error) {
+		return NewZ85Decoder(r), nil
+	})
+}
+
+func startZ85Encode(cb MessageChannelFunc, mc *MessageChannel, wg *sync.WaitGroup) {
+	StartCodecEncode("z85", cb, mc, wg, func(w io.Writer) (io.WriteCloser, error) {
+		return NewZ85Encoder(w), nil
+	})
+}
+
+const Z85Alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ.-:+=^!/*?&<>()[]{}@%$#"
+
+var z85Decode = func() (table [256]int) {
+	for i := range table {
+		table[i] = -1
+	}
+
+	for i := 0; i < len(Z85Alphabet); i++ {
+		table[Z85Alphabet[i]] = i
+	}
+
+	return table
+}()
+
+var ErrZ85InvalidLength = errors.New("Z85 data length is not a multiple of 4 bytes or 5 characters")
+
+// Z85 encodes 4 bytes into 5 characters. The bytes that
+// don't make a full group are kept until the next write.
+type Z85Encoder struct {
+	w io.Writer
+	crumb []byte
+}
+
+func NewZ85Encoder(w io.Writer) (*Z85Encoder) {
+	return &Z85Encoder{
+		w: w,
+		crumb: make([]byte, 0),
+	}
+}
+
+func (e *Z85Encoder) Write(p []byte) (int, error) {
+	e.crumb = append(e.crumb, p...)
+
+	groups := len(e.crumb) / 4
+	if groups == 0 {
+		return len(p), nil
+	}
+
+	buff := make([]byte, groups * 5)
+	for i := 0; i < groups; i++ {
+		value := binary.BigEndian.Uint32(e.crumb[i * 4:])
+
+		for j := 4; j >= 0; j-- {
+			buff[i * 5 + j] = Z85Alphabet[value % 85]
+			value /= 85
+		}
+	}
+
+	e.crumb = e.crumb[groups * 4:]
+
+	_, err := e.w.Write(buff)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (e *Z85Encoder) Close() (error) {
+	if len(e.crumb) != 0 {
+		return ErrZ85InvalidLength
+	}
+
+	return nil
+}
+
+// Z85 decodes 5 characters into 4 bytes. The characters that
+// don't make a full group are kept until the next read, ASCII
+// whitespace is ignored.
+type Z85Decoder struct {
+	r io.Reader
+	crumb []byte
+	decoded []byte
+	err error
+}
+
+func NewZ85Decoder(r io.Reader) (*Z85Decoder) {
+	return &Z85Decoder{
+		r: r,
+		crumb: make([]byte, 0),
+		decoded: make([]byte, 0),
+	}
+}
+
+func (d *Z85Decoder) Read(p []byte) (int, error) {
+	for len(d.decoded) == 0 {
+		if d.err != nil {
+			if d.err == io.EOF && len(d.crumb) != 0 {
+				return 0, ErrZ85InvalidLength
+			}
+
+			return 0, d.err
+		}
+
+		buff := make([]byte, 4096)
+		n, err := d.r.Read(buff)
+		d.err = err
+
+		// Whitespace like the trailing newline is skipped
+		for _, c := range buff[:n] {
+			switch c {
+				case ' ', '\t', '\n', '\r', '\v', '\f':
+					continue
+			}
+
+			d.crumb = append(d.crumb, c)
+		}
+
+		groups := len(d.crumb) / 5
+		for i := 0; i < groups; i++ {
+			value := uint64(0)
+
+			for _, c := range d.crumb[i * 5:i * 5 + 5] {
+				v := z85Decode[c]
+				if v < 0 {
+					return 0, errors.Errorf("Illegal z85 character %q", c)
+				}
+
+				value = value * 85 + uint64(v)
+			}
+
+			if value > 0xffffffff {
+				return 0, errors.New("Z85 group overflows 32 bits")
+			}
+
+			group := make([]byte, 4)
+			binary.BigEndian.PutUint32(group, uint32(value))
+			d.decoded = append(d.decoded, group...)
+		}
+
+		d.crumb = d.crumb[groups * 5:]
+	}
+
+	n := copy(p, d.decoded)
+	d.decoded = d.decoded[n:]
+
+	return n, nil
+}
+
+func NewZ85() (Module) {
+	return &Z85{}
+}
+
+func (m *Z85) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.BoolVar(&m.decode, "decode", false, "Z85 decode")
+	fs.BoolVar(&m.encode, "encode", false, "Z85 encode")
+}
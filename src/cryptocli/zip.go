@@ -0,0 +1,291 @@
+package main
+
+import (
+	"sync"
+	"github.com/spf13/pflag"
+	"github.com/tehmoon/errors"
+	"log"
+	"io"
+	"os"
+	"archive/zip"
+	"compress/flate"
+	"bytes"
+	"text/template"
+	"time"
+	yekazip "github.com/yeka/zip"
+)
+
+func init() {
+	MODULELIST.Register("zip", "Create a zip archive where each incoming channel is a file", NewZip)
+}
+
+/*
+zip module writes a single archive to its first channel, each incoming
+channel becomes a file:
+	- the name is rendered from the channel's metadata using --name, a
+	  missing key is an error
+	- "mode" and "mtime" are used if found in the metadata
+
+Files are streamed using data descriptors so nothing is buffered. They are
+written one after the other so with --multi-streams, channels wait for their
+turn. The archive is ended when the pipeline terminates.
+
+When --password-in is set, files are encrypted using WinZip AES or the legacy
+ZipCrypto. Only the default compression level or no compression are supported
+in that case.
+*/
+
+type Zip struct {
+	name string
+	mode uint32
+	level int
+	passwordIn string
+	encryption string
+	password string
+	encryptionMethod yekazip.EncryptionMethod
+	tpl *template.Template
+}
+
+// Both zip.Writer and yekazip.Writer
+type zipWriter interface {
+	Flush() (error)
+	Close() (error)
+}
+
+type zipArchive struct {
+	sync.Mutex
+	writer zipWriter
+	create func(name string, mode os.FileMode, mtime time.Time) (io.Writer, error)
+	buff *bytes.Buffer
+	outc chan []byte
+}
+
+var ZipEncryptionMethods = map[string]yekazip.EncryptionMethod{
+	"zipcrypto": yekazip.StandardEncryption,
+	"aes128": yekazip.AES128Encryption,
+	"aes192": yekazip.AES192Encryption,
+	"aes256": yekazip.AES256Encryption,
+}
+
+func (m *Zip) SetFlagSet(fs *pflag.FlagSet, args []string) {
+	fs.StringVar(&m.name, "name", "{{ .path }}", "Metadata template for the file name")
+	fs.Uint32Var(&m.mode, "mode", 0644, "File's mode if not found in metadata")
+	fs.IntVar(&m.level, "level", flate.DefaultCompression, "Deflate compression level from 1 to 9, 0 stores files without compression")
+	fs.StringVar(&m.passwordIn, "password-in", "", "Pipeline definition to set the password used to encrypt files")
+	fs.StringVar(&m.encryption, "encryption", "aes256", "Encryption method when a password is set: aes128, aes192, aes256 or zipcrypto")
+}
+
+func (m *Zip) Init(in, out chan *Message, global *GlobalFlags) (err error) {
+	if m.level < flate.HuffmanOnly || m.level > flate.BestCompression {
+		return errors.Errorf("Flag %q has to be between %d and %d", "--level", flate.HuffmanOnly, flate.BestCompression)
+	}
+
+	m.tpl, err = template.New("root").Option("missingkey=error").Parse(m.name)
+	if err != nil {
+		return errors.Wrapf(err, "Error parsing template for %q flag", "--name")
+	}
+
+	if m.passwordIn != "" {
+		var found bool
+
+		m.encryptionMethod, found = ZipEncryptionMethods[m.encryption]
+		if ! found {
+			return errors.Errorf("Encryption %q is not supported in zip module", m.encryption)
+		}
+
+		if m.level != flate.DefaultCompression && m.level != flate.NoCompression {
+			return errors.Errorf("Flag %q can only be %d or %d when flag %q is set", "--level", flate.DefaultCompression, flate.NoCompression, "--password-in")
+		}
+
+		password, err := ReadAllPipeline(m.passwordIn)
+		if err != nil {
+			return errors.Wrapf(err, "Error reading password from %q flag in zip module", "--password-in")
+		}
+
+		if len(password) == 0 {
+			return errors.New("Password cannot be empty in zip module")
+		}
+
+		m.password = string(password[:])
+	}
+
+	go func(in, out chan *Message) {
+		wg := &sync.WaitGroup{}
+
+		init := false
+		mc := NewMessageChannel()
+
+		out <- &Message{
+			Type: MessageTypeChannel,
+			Interface: mc.Callback,
+		}
+
+		mc.Start(nil)
+
+		archive := m.newArchive(mc.Channel)
+
+		LOOP: for message := range in {
+			switch message.Type {
+				case MessageTypeTerminate:
+					wg.Wait()
+					zipCloseArchive(archive, init)
+					out <- message
+					break LOOP
+				case MessageTypeChannel:
+					cb, ok := message.Interface.(MessageChannelFunc)
+					if ok {
+						// All channels are written to the same archive
+						init = true
+
+						wg.Add(1)
+						go zipStartHandler(m, archive, cb, wg)
+
+						if ! global.MultiStreams {
+							wg.Wait()
+							zipCloseArchive(archive, init)
+							out <- &Message{Type: MessageTypeTerminate,}
+							break LOOP
+						}
+					}
+			}
+		}
+
+		wg.Wait()
+		// Last message will signal the closing of the channel
+		<- in
+		close(out)
+	}(in, out)
+
+	return nil
+}
+
+// The standard library is used unless there is a password
+// because it supports setting the compression level.
+func (m *Zip) newArchive(outc chan []byte) (*zipArchive) {
+	archive := &zipArchive{
+		buff: bytes.NewBuffer(make([]byte, 0)),
+		outc: outc,
+	}
+
+	method := zip.Deflate
+	if m.level == flate.NoCompression {
+		method = zip.Store
+	}
+
+	if m.password != "" {
+		writer := yekazip.NewWriter(archive.buff)
+		archive.writer = writer
+
+		archive.create = func(name string, mode os.FileMode, mtime time.Time) (io.Writer, error) {
+			header := &yekazip.FileHeader{
+				Name: name,
+				Method: method,
+			}
+
+			header.SetModTime(mtime)
+			header.SetMode(mode)
+			header.SetPassword(m.password)
+			header.SetEncryptionMethod(m.encryptionMethod)
+
+			return writer.CreateHeader(header)
+		}
+
+		return archive
+	}
+
+	writer := zip.NewWriter(archive.buff)
+	writer.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, m.level)
+	})
+
+	archive.writer = writer
+
+	archive.create = func(name string, mode os.FileMode, mtime time.Time) (io.Writer, error) {
+		header := &zip.FileHeader{
+			Name: name,
+			Method: method,
+			Modified: mtime,
+		}
+
+		header.SetMode(mode)
+
+		return writer.CreateHeader(header)
+	}
+
+	return archive
+}
+
+// Write the central directory if there are files then close the channel
+func zipCloseArchive(archive *zipArchive, init bool) {
+	if init {
+		err := archive.writer.Close()
+		if err != nil {
+			err = errors.Wrap(err, "Error closing archive in zip module")
+			log.Println(err.Error())
+		}
+
+		archive.outc <- CopyResetBuffer(archive.buff)
+	}
+
+	close(archive.outc)
+}
+
+func zipStartHandler(m *Zip, archive *zipArchive, cb MessageChannelFunc, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	metadata, inc := cb()
+	defer DrainChannel(inc, nil)
+
+	buff := bytes.NewBuffer(make([]byte, 0))
+	err := m.tpl.Execute(buff, metadata)
+	if err != nil {
+		err = errors.Wrap(err, "Error executing template name in zip module")
+		log.Println(err.Error())
+		return
+	}
+
+	name := buff.String()
+	if name == "" {
+		log.Println("File name is empty in zip module")
+		return
+	}
+
+	mode := os.FileMode(m.mode)
+	if v, found := MetadataInt64(metadata, "mode"); found {
+		mode = os.FileMode(v) & os.ModePerm
+	}
+
+	mtime := time.Now()
+	if v, found := MetadataTime(metadata, "mtime"); found {
+		mtime = v
+	}
+
+	archive.Lock()
+	defer archive.Unlock()
+
+	writer, err := archive.create(name, mode, mtime)
+	if err != nil {
+		err = errors.Wrapf(err, "Error creating %q in zip module", name)
+		log.Println(err.Error())
+		return
+	}
+
+	for payload := range inc {
+		_, err = writer.Write(payload)
+		if err == nil {
+			err = archive.writer.Flush()
+		}
+
+		if err != nil {
+			err = errors.Wrapf(err, "Error writing %q in zip module", name)
+			log.Println(err.Error())
+			return
+		}
+
+		archive.outc <- CopyResetBuffer(archive.buff)
+	}
+}
+
+func NewZip() (Module) {
+	return &Zip{}
+}